@@ -0,0 +1,129 @@
+// Package axgatetest runs a gate in memory for tests of services using axgate:
+// the tcp server and the http front listen on ephemeral loopback ports and
+// everything is torn down by Close.
+//
+//	g := axgatetest.NewGate()
+//	defer g.Close()
+//	url, err := g.ServeHandler("api", handler)
+//	resp, err := g.Client().Get(url + "/users")
+package axgatetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/axgrid/axgate"
+	"github.com/axgrid/axgate/handler"
+	"github.com/axgrid/axgate/tcp"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Host is the host name of the front, services are at <service>.axgate.test
+const Host = "axgate.test"
+
+// WaitTimeout is how long ServeHandler waits for its client to register
+var WaitTimeout = 5 * time.Second
+
+// Gate is a gate server with its http front
+type Gate struct {
+	// Addr is the tcp address for clients, pass it as the gate address
+	Addr    string
+	Server  *tcp.Server
+	Handler *handler.Handler
+	// Front serves the http side, requests to it need Host <service>.axgate.test
+	Front *httptest.Server
+
+	lock    sync.Mutex
+	clients []*tcp.Client
+}
+
+// NewGate starts a gate, Close it when done
+func NewGate() *Gate {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("axgatetest: failed to listen: %v", err))
+	}
+	g := &Gate{Addr: l.Addr().String(), Server: &tcp.Server{}}
+	go g.Server.Serve(l)
+	g.Handler, err = handler.New(g.Server, []string{Host}, false)
+	if err != nil {
+		panic(fmt.Sprintf("axgatetest: %v", err))
+	}
+	g.Front = httptest.NewUnstartedServer(g.Handler)
+	g.Front.Config.Protocols = new(http.Protocols)
+	g.Front.Config.Protocols.SetHTTP1(true)
+	g.Front.Config.Protocols.SetUnencryptedHTTP2(true)
+	g.Front.Start()
+	return g
+}
+
+// URL is the public url of the service, reach it with Client
+func (g *Gate) URL(name string) string {
+	return "http://" + name + "." + Host
+}
+
+// Client sends every request to the front whatever host the url has
+func (g *Gate) Client() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	front := strings.TrimPrefix(g.Front.URL, "http://")
+	t.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, front)
+	}
+	return &http.Client{Transport: t}
+}
+
+// WaitService waits until a client registers the service and returns its url
+func (g *Gate) WaitService(name string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, n := range g.Server.Names() {
+			if n == name {
+				return g.URL(name), nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("axgatetest: service %s is not registered in %v", name, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ServeHandler tunnels the service to h and returns its url once it is registered,
+// the client is closed with the gate
+func (g *Gate) ServeHandler(name string, h http.Handler) (string, error) {
+	if h == nil {
+		return "", errors.New("axgatetest: handler is nil")
+	}
+	config := &axgate.ClientConfig{
+		Gate:     g.Addr,
+		Services: map[string]*axgate.ClientService{name: {Routes: []*axgate.Route{{Prefix: "/", Handler: h}}}},
+	}
+	client, err := config.NewClient()
+	if err != nil {
+		return "", err
+	}
+	g.lock.Lock()
+	g.clients = append(g.clients, client)
+	g.lock.Unlock()
+	go client.Run()
+	return g.WaitService(name, WaitTimeout)
+}
+
+// Close stops the clients of ServeHandler, the front and the server
+func (g *Gate) Close() {
+	g.lock.Lock()
+	clients := g.clients
+	g.clients = nil
+	g.lock.Unlock()
+	for _, c := range clients {
+		c.Close()
+	}
+	g.Front.Close()
+	g.Server.Close()
+}
@@ -0,0 +1,59 @@
+package axgatetest
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func hello(tag string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", tag, r.URL.Path)
+	})
+}
+
+func get(t *testing.T, g *Gate, url string) (int, string) {
+	resp, err := g.Client().Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(b)
+}
+
+func TestGates(t *testing.T) {
+	// two gates in one process serve the same name independently
+	a, b := NewGate(), NewGate()
+	defer a.Close()
+	defer b.Close()
+	urlA, err := a.ServeHandler("api", hello("a"))
+	require.NoError(t, err)
+	urlB, err := b.ServeHandler("api", hello("b"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://api.axgate.test", urlA)
+
+	code, body := get(t, a, urlA+"/users")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "a /users", body)
+	_, body = get(t, b, urlB+"/users")
+	assert.Equal(t, "b /users", body)
+
+	code, _ = get(t, a, a.URL("missing"))
+	assert.Equal(t, 500, code)
+	_, err = a.WaitService("missing", 50*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestClose(t *testing.T) {
+	g := NewGate()
+	_, err := g.ServeHandler("api", hello("a"))
+	require.NoError(t, err)
+	g.Close()
+	assert.Empty(t, g.Server.Names())
+	_, err = g.Client().Get(g.URL("api"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/axgrid/axgate"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -build-me-for: native
+// -build-me-for: linux
+
+const usage = `usage: axgate [flags] <command> [args]
+
+commands:
+  http <service> <upstream>     tunnel an http upstream (http://, https://, h2c://, unix://)
+  tcp <service> <addr>          tunnel a tcp server, reach it with "axgate connect"
+  static <service> <dir>        serve a directory (-spa, -zip, -no-listing)
+  run <config.yaml>             serve every tunnel of the config
+  connect <url> [listen]        pipe stdin/stdout (or every connection to listen) to a tcp tunnel
+
+flags:
+`
+
+var (
+	gate    string
+	token   string
+	status  bool
+	verbose bool
+)
+
+func init() {
+	flag.StringVar(&gate, "gate", os.Getenv("AXGATE_GATE"), "set gate tcp address, env AXGATE_GATE")
+	flag.StringVar(&token, "token", os.Getenv("AXGATE_TOKEN"), "set gate secret key, env AXGATE_TOKEN")
+	flag.BoolVar(&status, "status", isTerminal(os.Stderr), "show the status view instead of log lines")
+	flag.BoolVar(&verbose, "verbose", false, "show more debug lines")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	level := zerolog.InfoLevel
+	if verbose {
+		level = zerolog.DebugLevel
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05,000"}).Level(level)
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if args[0] == "connect" {
+		if err := connect(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("connect")
+		}
+		return
+	}
+	config, err := tunnels(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	client, err := config.NewClient()
+	if err != nil {
+		log.Fatal().Err(err).Msg("bad tunnels")
+	}
+	var view *statusView
+	if status {
+		view = &statusView{client: client, gate: config.Gate}
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: view, NoColor: true, TimeFormat: "15:04:05"}).Level(level)
+		go view.run(os.Stderr)
+	}
+	client.OnRequest = func(request *pproto.GateRequest, code int32, d time.Duration, err error) {
+		if view != nil {
+			view.request(request, code, d, err)
+			return
+		}
+		log.Info().Str("service", request.Name).Str("request-id", request.RequestId).Str("method", request.Method).Str("url", request.Url).
+			Int32("status", code).Dur("duration", d).Err(err).Msg("request")
+	}
+	err = client.Run()
+	if err != nil {
+		log.Fatal().Err(err).Msg("client")
+	}
+}
+
+// tunnels makes the client config of the command
+func tunnels(args []string) (*axgate.ClientConfig, error) {
+	config := &axgate.ClientConfig{Services: map[string]*axgate.ClientService{}}
+	switch args[0] {
+	case "http":
+		if len(args) != 3 {
+			return nil, errors.New("http needs <service> <upstream>")
+		}
+		config.Services[args[1]] = &axgate.ClientService{Routes: []*axgate.Route{
+			{Prefix: "/", Upstream: &axgate.Upstream{Address: args[2]}},
+		}}
+	case "tcp":
+		if len(args) != 3 {
+			return nil, errors.New("tcp needs <service> <addr>")
+		}
+		config.Services[args[1]] = &axgate.ClientService{TCP: args[2]}
+	case "static":
+		fs := flag.NewFlagSet("static", flag.ExitOnError)
+		opts := &axgate.StaticOptions{}
+		fs.BoolVar(&opts.SPA, "spa", false, "serve /index.html for missing paths without an extension")
+		fs.BoolVar(&opts.Zip, "zip", false, "let download directories as zip, /dir/?zip")
+		fs.BoolVar(&opts.NoListing, "no-listing", false, "hide directory listings")
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			return nil, errors.New("static needs <service> <dir>")
+		}
+		config.Services[fs.Arg(0)] = &axgate.ClientService{Routes: []*axgate.Route{
+			{Prefix: "/", Dir: fs.Arg(1), Static: opts},
+		}}
+	case "run":
+		if len(args) != 2 {
+			return nil, errors.New("run needs <config.yaml>")
+		}
+		c, err := axgate.LoadClientConfig(args[1])
+		if err != nil {
+			return nil, err
+		}
+		config = c
+	default:
+		return nil, fmt.Errorf("unknown command %s", args[0])
+	}
+	// flags and env win over the config file
+	if gate != "" {
+		config.Gate = gate
+	}
+	if token != "" {
+		config.Key = token
+	}
+	if config.Gate == "" {
+		config.Gate = "localhost:9090"
+	}
+	return config, nil
+}
+
+// connect streams connections through a tcp tunnel at url
+func connect(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("connect needs <url> [listen]")
+	}
+	url := args[0]
+	if len(args) == 1 {
+		return pipe(url, os.Stdin, os.Stdout)
+	}
+	l, err := net.Listen("tcp", args[1])
+	if err != nil {
+		return err
+	}
+	log.Info().Str("url", url).Str("address", l.Addr().String()).Msg("start connect-listener")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := pipe(url, conn, conn); err != nil {
+				log.Error().Err(err).Msg("tunnel error")
+			}
+		}()
+	}
+}
+
+// pipe sends in as the request body and copies the response body to out
+func pipe(url string, in io.Reader, out io.Writer) error {
+	rq, err := http.NewRequest("POST", url, io.NopCloser(in))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+const recentSize = 10
+const logSize = 5
+
+// statusView redraws connection state, request counters and recent requests,
+// log lines written to it are shown under them
+type statusView struct {
+	client *tcp.Client
+	gate   string
+
+	lock     sync.Mutex
+	requests int
+	errors   int
+	recent   []string
+	logs     []string
+}
+
+func (v *statusView) Write(p []byte) (int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		v.logs = appendLast(v.logs, line, logSize)
+	}
+	return len(p), nil
+}
+
+func (v *statusView) request(request *pproto.GateRequest, code int32, d time.Duration, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.requests++
+	result := fmt.Sprint(code)
+	if err != nil || code == 0 || code >= 500 {
+		v.errors++
+	}
+	if code == 0 {
+		result = "ERR"
+	}
+	line := fmt.Sprintf("%s %s %-7s %s %s %v", time.Now().Format("15:04:05"), result, request.Method, request.Name, request.Url, d.Round(time.Millisecond))
+	v.recent = appendLast(v.recent, line, recentSize)
+}
+
+func (v *statusView) run(w io.Writer) {
+	for {
+		v.draw(w)
+		time.Sleep(time.Second)
+	}
+}
+
+func (v *statusView) draw(w io.Writer) {
+	state := "connecting"
+	if v.client.Connected() {
+		state = "connected"
+	}
+	names := v.client.Names()
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&b, "axgate %s %s\n", v.gate, state)
+	fmt.Fprintf(&b, "services: %s\n", strings.Join(names, ", "))
+	fmt.Fprintf(&b, "requests: %d errors: %d\n\n", v.requests, v.errors)
+	for _, line := range v.recent {
+		fmt.Fprintln(&b, line)
+	}
+	if len(v.logs) > 0 {
+		b.WriteString("\n")
+		for _, line := range v.logs {
+			fmt.Fprintln(&b, line)
+		}
+	}
+	io.WriteString(w, b.String())
+}
+
+func appendLast(list []string, s string, max int) []string {
+	list = append(list, s)
+	if len(list) > max {
+		list = list[len(list)-max:]
+	}
+	return list
+}
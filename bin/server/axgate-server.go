@@ -14,19 +14,25 @@ import (
 // -build-me-for: linux
 
 var (
-	httpAddress string
-	uri         string
-	tcpAddress  string
-	verbose     bool
-	key         string
+	httpAddress  string
+	adminAddress string
+	uri          string
+	tcpAddress   string
+	verbose      bool
+	key          string
+	proxies      string
+	configPath   string
 )
 
 func init() {
 	flag.StringVar(&httpAddress, "http", ":8081", "setup http bind address")
+	flag.StringVar(&adminAddress, "admin", "", "set admin http bind address, empty - disabled")
 	flag.StringVar(&uri, "hosts", "localhost:8081", "set http host names, (,)separate")
 	flag.StringVar(&tcpAddress, "tcp", ":9090", "set tcp bind address :9090")
 	flag.BoolVar(&verbose, "verbose", false, "show more debug lines")
 	flag.StringVar(&key, "key", "", "set secret key")
+	flag.StringVar(&proxies, "trusted-proxies", "", "set trusted proxies networks, their X-Forwarded-* headers are kept (,)separate")
+	flag.StringVar(&configPath, "config", "", "set yaml config file (limits, access, rewrite, cache, compression, mirror, access log, webhooks, tracing), empty - none of them")
 	flag.Parse()
 }
 
@@ -38,12 +44,32 @@ func main() {
 	}
 
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05,000"}).Level(level)
+	if err := handler.SetTrustedProxies(strings.Split(proxies, ",")); err != nil {
+		log.Fatal().Err(err).Msg("bad trusted proxies")
+	}
+	if configPath != "" {
+		config, err := handler.LoadConfig(configPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", configPath).Msg("fail to load config")
+		}
+		if err = handler.SetConfig(config); err != nil {
+			log.Fatal().Err(err).Str("path", configPath).Msg("bad config")
+		}
+	}
 	go func() {
 		err := tcp.NewServer(tcpAddress, key)
 		if err != nil {
 			log.Fatal().Err(err).Msg("fail to start tcp server")
 		}
 	}()
+	if adminAddress != "" {
+		go func() {
+			err := handler.NewAdminHandler(adminAddress)
+			if err != nil {
+				log.Fatal().Err(err).Msg("fail to start admin-listener")
+			}
+		}()
+	}
 	err := handler.NewHandler(httpAddress, strings.Split(uri, ","), verbose)
 	if err != nil {
 		log.Fatal().Err(err).Msg("fail to start http-listener")
@@ -3,11 +3,14 @@ package axgate
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/rewrite"
 	"github.com/axgrid/axgate/tcp"
+	"github.com/rs/zerolog/log"
+	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,70 +20,258 @@ var tr = &http.Transport{
 	DisableCompression: true,
 }
 
+// h2cTr speaks HTTP/2 with prior knowledge to plaintext upstreams (gRPC servers)
+var h2cTr = &http.Transport{
+	MaxIdleConns:       10,
+	IdleConnTimeout:    time.Second * 20,
+	DisableCompression: true,
+	Protocols:          unencryptedHTTP2(),
+}
+
+func unencryptedHTTP2() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// ProtectWithPassword asks the gate to require basic auth for the service,
+// call it before the client starts. Only the bcrypt hash leaves the process.
+func ProtectWithPassword(name string, user string, password string) error {
+	u, err := pproto.NewGateUser(user, password)
+	if err != nil {
+		return err
+	}
+	tcp.SetAccess(name, &pproto.GateAccess{Users: []*pproto.GateUser{u}})
+	return nil
+}
+
+// exchangeHandler serves one tunneled request
+type exchangeHandler = func(request *pproto.GateRequest, ex *tcp.Exchange) error
+
 func NewHTTPHandlerClient(name string, gateAddress string, handler http.Handler, args ...string) error {
 	if handler == nil {
 		return errors.New("handler is nil")
 	}
-	return tcp.NewClient(name, gateAddress, func(request *pproto.GateRequest) (*pproto.GateResponse, error) {
+	return tcp.NewStreamClient(name, gateAddress, handlerExchange(handler), args...)
+}
+
+// handlerExchange serves requests with handler
+func handlerExchange(handler http.Handler) exchangeHandler {
+	return func(request *pproto.GateRequest, ex *tcp.Exchange) error {
 		wr := &ResponseWriter{
 			header: http.Header{},
 			code:   200,
+			ex:     ex,
 		}
 		hr, err := request.ToHttp()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if request.Stream {
+			hr.Body = io.NopCloser(upstreamBody(request, ex, hr.Trailer))
+			hr.ContentLength = request.ContentLength
 		}
-		handler.ServeHTTP(wr, hr)
-		return wr.ToGate()
-	}, args...)
+		handler.ServeHTTP(wr, hr.WithContext(ex.Context()))
+		return wr.finish()
+	}
 }
 
-func NewHTTPClient(name string, gateAddress string, requestAddress string, args ...string) error {
-	client := &http.Client{Transport: tr}
-	if strings.HasSuffix(requestAddress, "/") {
-		requestAddress = requestAddress[:len(requestAddress)-1]
-	}
-	return tcp.NewClient(name, gateAddress, func(request *pproto.GateRequest) (*pproto.GateResponse, error) {
-		httpRequest, err := http.NewRequest(request.Method, fmt.Sprintf("%s%s", requestAddress, request.Url), bytes.NewReader(request.Body))
-		if err != nil {
-			return nil, err
+// rewrite rules of the upstream by service name
+var (
+	rules     = map[string]*rewrite.Rules{}
+	rulesLock sync.Mutex
+)
+
+// SetRules sets the rules NewHTTPClient applies to requests to the upstream
+// and to its responses, nil removes them
+func SetRules(name string, r *rewrite.Rules) error {
+	if r != nil {
+		if err := r.Compile(); err != nil {
+			return err
 		}
-		httpRequest.Header = pproto.FromGateHeader(request.Header)
-		httpResponse, err := client.Do(httpRequest)
-		if err != nil {
-			return nil, err
+	}
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	if r == nil {
+		delete(rules, name)
+	} else {
+		rules[name] = r
+	}
+	return nil
+}
+
+func rulesOf(name string) *rewrite.Rules {
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	return rules[name]
+}
+
+// NewHTTPClient tunnels requests of the service to requestAddress.
+// Use h2c://host:port for upstreams speaking HTTP/2 without TLS, like gRPC servers,
+// unix:///path/to.sock for ones on a unix socket, NewUpstreamClient for more options.
+func NewHTTPClient(name string, gateAddress string, requestAddress string, args ...string) error {
+	return NewUpstreamClient(name, gateAddress, &Upstream{Address: requestAddress}, args...)
+}
+
+// upstreamBody returns the request body for the upstream, trailer values
+// of a streamed body are copied into trailer when they arrive
+func upstreamBody(request *pproto.GateRequest, ex *tcp.Exchange, trailer http.Header) io.Reader {
+	if !request.Stream {
+		if len(request.Body) == 0 {
+			return nil
 		}
-		resp, err := pproto.NewGateResponse(httpResponse)
-		if err != nil {
-			return nil, err
+		return bytes.NewReader(request.Body)
+	}
+	return &trailerReader{ex: ex, trailer: trailer}
+}
+
+type trailerReader struct {
+	ex      *tcp.Exchange
+	trailer http.Header
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	n, err := r.ex.Read(p)
+	if err == io.EOF && r.trailer != nil {
+		for k, v := range pproto.FromGateHeader(r.ex.Trailer()) {
+			r.trailer[k] = v
 		}
-		return resp, nil
-	}, args...)
+	}
+	return n, err
 }
 
+// flushSize is how much body ResponseWriter holds before sending it to the gate
+const flushSize = 32 * 1024
+
+// ResponseWriter collects the response of a handler. Body is sent to the gate
+// when it grows over flushSize, on Flush and when the handler returns.
 type ResponseWriter struct {
 	body   []byte
 	code   int
 	header http.Header
+	ex     *tcp.Exchange
 }
 
 func (c *ResponseWriter) Header() http.Header { return c.header }
 
 func (c *ResponseWriter) Write(data []byte) (int, error) {
 	c.body = append(c.body, data...)
+	if c.ex != nil && len(c.body) >= flushSize {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
 	return len(data), nil
 }
 
+// Flush sends the head and the body written so far to the gate,
+// server-sent events and long polls need it
+func (c *ResponseWriter) Flush() {
+	err := c.flush()
+	if err != nil {
+		l := &log.Logger
+		if c.ex != nil {
+			l = c.ex.Log()
+		}
+		l.Debug().Err(err).Msg("fail to flush response")
+	}
+}
+
+func (c *ResponseWriter) flush() error {
+	if c.ex == nil {
+		return nil
+	}
+	if !c.ex.HeadSent() {
+		header, _ := c.trailer()
+		err := c.ex.WriteHead(&pproto.GateResponse{
+			StatusCode:    int32(c.code),
+			ContentLength: -1,
+			Header:        pproto.ToGateHeader(header),
+			Trailer:       c.trailerKeys(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.body) == 0 {
+		return nil
+	}
+	_, err := c.ex.Write(c.body)
+	c.body = nil
+	return err
+}
+
+// finish sends what is left of the response after the handler returned
+func (c *ResponseWriter) finish() error {
+	if !c.ex.HeadSent() {
+		res, err := c.ToGate()
+		if err != nil {
+			return err
+		}
+		body, trailer := res.Body, res.Trailer
+		res.Trailer = pproto.TrailerKeys(trailer)
+		if err = c.ex.WriteHead(res); err != nil {
+			return err
+		}
+		if _, err = c.ex.Write(body); err != nil {
+			return err
+		}
+		return c.ex.Finish(trailer)
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	_, trailer := c.trailer()
+	return c.ex.Finish(pproto.ToGateHeader(trailer))
+}
+
 func (c *ResponseWriter) WriteHeader(statusCode int) {
 	c.code = statusCode
 }
 
 func (c *ResponseWriter) ToGate() (*pproto.GateResponse, error) {
+	header, trailer := c.trailer()
 	res := &pproto.GateResponse{
 		StatusCode:    int32(c.code),
 		ContentLength: int64(len(c.body)),
-		Header:        pproto.ToGateHeader(c.header),
+		Header:        pproto.ToGateHeader(header),
 		Body:          c.body,
+		Trailer:       pproto.ToGateHeader(trailer),
 	}
 	return res, nil
 }
+
+// trailerKeys returns the trailers declared in "Trailer"
+func (c *ResponseWriter) trailerKeys() []*pproto.GateHeader {
+	var res []*pproto.GateHeader
+	for _, v := range c.header.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				res = append(res, &pproto.GateHeader{Key: http.CanonicalHeaderKey(k)})
+			}
+		}
+	}
+	return res
+}
+
+// trailer splits the written header into header and trailer,
+// as declared in "Trailer" or set with http.TrailerPrefix
+func (c *ResponseWriter) trailer() (http.Header, http.Header) {
+	header, trailer := c.header.Clone(), http.Header{}
+	for _, v := range header.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if vv, ok := header[k]; ok {
+				trailer[k] = vv
+				delete(header, k)
+			}
+		}
+	}
+	for k, vv := range header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = vv
+			delete(header, k)
+		}
+	}
+	return header, trailer
+}
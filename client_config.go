@@ -0,0 +1,115 @@
+package axgate
+
+import (
+	"errors"
+	"fmt"
+	"github.com/axgrid/axgate/rewrite"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/axgrid/axgate/tracing"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+)
+
+// ClientConfig describes services a client tunnels, it is loaded from yaml:
+//
+//	gate: gate.example.com:9090
+//	key: secret
+//	services:
+//	  myapp:
+//	    routes:
+//	      - prefix: /api
+//	        upstream: {address: http://localhost:8080}
+//	      - prefix: /ws
+//	        strip_prefix: true
+//	        upstream: {address: http://localhost:9000}
+//	      - prefix: /
+//	        dir: ./public
+//	  db:
+//	    tcp: localhost:5432
+type ClientConfig struct {
+	Gate     string                    `yaml:"gate"`
+	Key      string                    `yaml:"key"`
+	Services map[string]*ClientService `yaml:"services"`
+	// Tracing exports a span per request continuing the trace of the gate
+	Tracing *tracing.Config `yaml:"tracing"`
+}
+
+// ClientService has routes or, for a tcp tunnel, the address of a tcp server
+type ClientService struct {
+	Routes  []*Route       `yaml:"routes"`
+	Rewrite *rewrite.Rules `yaml:"rewrite"`
+	TCP     string         `yaml:"tcp"`
+}
+
+// LoadClientConfig reads the client config from path
+func LoadClientConfig(path string) (*ClientConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res ClientConfig
+	if err = yaml.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Services) == 0 {
+		return nil, errors.New("no services")
+	}
+	return &res, nil
+}
+
+// Run serves every service over one connection to the gate
+func (c *ClientConfig) Run() error {
+	client, err := c.NewClient()
+	if err != nil {
+		return err
+	}
+	return client.Run()
+}
+
+// NewClient prepares the client of the config without connecting it
+func (c *ClientConfig) NewClient() (*tcp.Client, error) {
+	if c.Gate == "" {
+		return nil, errors.New("gate address is not set")
+	}
+	var args []string
+	if c.Key != "" {
+		args = append(args, c.Key)
+	}
+	var names []string
+	for name := range c.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	client := tcp.NewMultiClient(c.Gate, args...)
+	for _, name := range names {
+		s := c.Services[name]
+		switch {
+		case s != nil && s.TCP != "" && len(s.Routes) > 0:
+			return nil, fmt.Errorf("service %s: set routes or tcp, not both", name)
+		case s != nil && s.TCP != "":
+			client.Add(name, tcpExchange(s.TCP))
+			continue
+		case s == nil || len(s.Routes) == 0:
+			return nil, fmt.Errorf("service %s: no routes", name)
+		}
+		if s.Rewrite != nil {
+			if err := s.Rewrite.Compile(); err != nil {
+				return nil, fmt.Errorf("service %s: %w", name, err)
+			}
+		}
+		r, err := newRouter(name, s.Rewrite, s.Routes...)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+		client.Add(name, r.exchange)
+	}
+	if c.Tracing != nil {
+		t, err := tracing.New(c.Tracing)
+		if err != nil {
+			return nil, err
+		}
+		client.Tracer = t
+	}
+	return client, nil
+}
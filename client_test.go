@@ -0,0 +1,23 @@
+package axgate
+
+import (
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func TestResponseWriterTrailers(t *testing.T) {
+	w := &ResponseWriter{header: http.Header{}, code: 200}
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Write([]byte("message"))
+	w.Header().Set("Grpc-Status", "0")
+	w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+
+	rs, err := w.ToGate()
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{"Content-Type": {"application/grpc"}}, pproto.FromGateHeader(rs.Header))
+	assert.Equal(t, http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}}, pproto.FromGateHeader(rs.Trailer))
+}
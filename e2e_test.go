@@ -0,0 +1,220 @@
+package axgate
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/axgrid/axgate/handler"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startGate starts gate server and http front, returns their addresses
+func startGate(t *testing.T) (string, string) {
+	tcpAddress, httpAddress := freeAddress(t), freeAddress(t)
+	go tcp.NewServer(tcpAddress, "")
+	go handler.NewHandler(httpAddress, []string{"gate.test"}, false)
+	return tcpAddress, httpAddress
+}
+
+func TestGrpcStyleStreamingOverH2C(t *testing.T) {
+	// gRPC-like upstream: HTTP/2 only, echoes every line as soon as it arrives
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		lines := bufio.NewScanner(r.Body)
+		for lines.Scan() {
+			fmt.Fprintf(w, "echo %s\n", lines.Text())
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "done")
+	}), Protocols: new(http.Protocols)}
+	upstream.Protocols.SetUnencryptedHTTP2(true)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go upstream.Serve(l)
+	defer upstream.Close()
+
+	tcpAddress, httpAddress := startGate(t)
+	go NewHTTPClient("grpc", tcpAddress, "h2c://"+l.Addr().String())
+
+	client := &http.Client{Transport: &http.Transport{Protocols: unencryptedHTTP2()}}
+	url := "http://" + httpAddress + "/echo.Echo/Stream"
+	require.Eventually(t, func() bool {
+		rq, _ := http.NewRequest("POST", url, strings.NewReader("ping\n"))
+		rq.Host = "grpc.gate.test"
+		resp, err := client.Do(rq)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b) == "echo ping\n"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// every answer has to come back before the next message is sent
+	pr, pw := io.Pipe()
+	rq, err := http.NewRequest("POST", url, pr)
+	require.NoError(t, err)
+	rq.Host = "grpc.gate.test"
+	rq.Header.Set("Content-Type", "application/grpc")
+	rq.Header.Set("Te", "trailers")
+	resp, err := client.Do(rq)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+	answers := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		_, err = fmt.Fprintf(pw, "message %d\n", i)
+		require.NoError(t, err)
+		line, err := answers.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("echo message %d\n", i), line)
+	}
+	pw.Close()
+	rest, err := io.ReadAll(answers)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "done", resp.Trailer.Get("Grpc-Message"))
+}
+
+func TestServerSentEventsAndCancel(t *testing.T) {
+	release := make(chan struct{})
+	canceled := make(chan struct{})
+	events := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/events" {
+			<-release
+			fmt.Fprint(w, "data: second\n\n")
+			return
+		}
+		<-r.Context().Done()
+		close(canceled)
+	})
+	tcpAddress, httpAddress := startGate(t)
+	go NewHTTPHandlerClient("events", tcpAddress, events)
+
+	get := func(path string) *http.Response {
+		rq, err := http.NewRequest("GET", "http://"+httpAddress+path, nil)
+		require.NoError(t, err)
+		rq.Host = "events.gate.test"
+		resp, err := http.DefaultClient.Do(rq)
+		require.NoError(t, err)
+		return resp
+	}
+	require.Eventually(t, func() bool {
+		resp := get("/ping")
+		resp.Body.Close()
+		return resp.StatusCode == 200
+	}, 5*time.Second, 50*time.Millisecond)
+
+	resp := get("/events")
+	assert.Equal(t, "no", resp.Header.Get("X-Accel-Buffering"))
+	lines := bufio.NewReader(resp.Body)
+	line, err := lines.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+	close(release)
+	rest, err := io.ReadAll(lines)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: second\n\n", string(rest))
+	resp.Body.Close()
+
+	resp = get("/wait")
+	line, err = bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+	resp.Body.Close() // the browser goes away
+	select {
+	case <-canceled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler is not canceled after the caller went away")
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	handler.SetConfig(&handler.Config{MaxRequestBody: 1024, MaxResponseBody: 4096})
+	defer handler.SetConfig(nil)
+	upstream := http.NewServeMux()
+	upstream.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "%d", n)
+	})
+	upstream.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("length") != "" {
+			w.Header().Set("Content-Length", "8192")
+		}
+		w.Write([]byte(strings.Repeat("x", 8192)))
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go http.Serve(l, upstream)
+	defer l.Close()
+
+	tcpAddress, httpAddress := startGate(t)
+	go NewHTTPClient("limited", tcpAddress, "http://"+l.Addr().String())
+
+	do := func(method, path string, body io.Reader) (*http.Response, error) {
+		rq, _ := http.NewRequest(method, "http://"+httpAddress+path, body)
+		rq.Host = "limited.gate.test"
+		return http.DefaultClient.Do(rq)
+	}
+	require.Eventually(t, func() bool {
+		resp, err := do("POST", "/upload", strings.NewReader("small"))
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b) == "5"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	resp, err := do("POST", "/upload", strings.NewReader(strings.Repeat("x", 2048)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "known length")
+
+	// no Content-Length, the body is cut while it is streamed
+	resp, err = do("POST", "/upload", io.MultiReader(strings.NewReader(strings.Repeat("x", 2048))))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "chunked")
+
+	resp, err = do("GET", "/big?length=1", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	resp, err = do("GET", "/big", nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Error(t, err, "a cut response must not look complete")
+}
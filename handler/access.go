@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	pproto "github.com/axgrid/axgate/proto"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Access is who may call a service, with users or tokens set a request needs one of them
+type Access struct {
+	Allow  []string          `yaml:"allow"` // networks or addresses, empty - any
+	Deny   []string          `yaml:"deny"`
+	Users  map[string]string `yaml:"users"` // name: bcrypt hash of the password
+	Tokens []string          `yaml:"tokens"`
+
+	policy *policy // set by compile
+}
+
+func (a *Access) gate() *pproto.GateAccess {
+	res := &pproto.GateAccess{
+		Allow:  a.Allow,
+		Deny:   a.Deny,
+		Tokens: a.Tokens,
+	}
+	for name, hash := range a.Users {
+		res.Users = append(res.Users, &pproto.GateUser{Name: name, PasswordHash: hash})
+	}
+	sort.Slice(res.Users, func(i, j int) bool { return res.Users[i].Name < res.Users[j].Name })
+	return res
+}
+
+// compile checks the access and parses its networks for check
+func (a *Access) compile() error {
+	p, err := newPolicy(a.gate())
+	if err != nil {
+		return err
+	}
+	a.policy = p
+	return nil
+}
+
+// policy is an access with its networks parsed
+type policy struct {
+	*pproto.GateAccess
+	allow, deny []*net.IPNet
+	invalid     bool // the access does not parse, nothing passes it
+}
+
+func newPolicy(a *pproto.GateAccess) (*policy, error) {
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	p := &policy{GateAccess: a}
+	p.allow, _ = pproto.ParseNetworks(a.Allow)
+	p.deny, _ = pproto.ParseNetworks(a.Deny)
+	return p, nil
+}
+
+// policies returns access policies of the service: the configured one
+// and the one asked by the client, a request must pass all of them
+func (h *Handler) policies(name string) []*policy {
+	var res []*policy
+	if c := h.serviceConfig(name); c != nil && c.Access != nil {
+		res = append(res, c.Access.policy)
+	} else if a := h.defaultAccess(); a != nil {
+		res = append(res, a.policy)
+	}
+	if p := h.clientPolicy(name); p != nil {
+		res = append(res, p)
+	}
+	return res
+}
+
+// clientPolicy returns the access the service asked for in its handshake, nil if none.
+// Its networks are parsed once per connection of the service.
+func (h *Handler) clientPolicy(name string) *policy {
+	a := h.gate.Access(name)
+	if a == nil {
+		return nil
+	}
+	h.lock.RLock()
+	p := h.clientPolicies[name]
+	h.lock.RUnlock()
+	if p != nil && p.GateAccess == a {
+		return p
+	}
+	p, err := newPolicy(a)
+	if err != nil {
+		// the gate checks it in the handshake, this one is not expected
+		h.log().Error().Err(err).Str("service", name).Msg("bad access of the service")
+		p = &policy{GateAccess: a, invalid: true}
+	}
+	h.lock.Lock()
+	if h.clientPolicies == nil {
+		h.clientPolicies = map[string]*policy{}
+	}
+	h.clientPolicies[name] = p
+	h.lock.Unlock()
+	return p
+}
+
+// authorize answers 403 or 401 and returns false if the request is not allowed to the service.
+// Credentials checked by the gate are not passed to the service.
+func (h *Handler) authorize(name string, w http.ResponseWriter, r *http.Request, ip string) bool {
+	credentials := false
+	for _, a := range h.policies(name) {
+		status, used := h.check(a, r, net.ParseIP(ip))
+		switch status {
+		case http.StatusForbidden:
+			h.log().Debug().Str("service", name).Str("request-id", r.Header.Get(pproto.RequestIDHeader)).Str("ip", ip).Msg("access denied")
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return false
+		case http.StatusUnauthorized:
+			h.log().Debug().Str("service", name).Str("request-id", r.Header.Get(pproto.RequestIDHeader)).Str("ip", ip).Msg("unauthorized")
+			if len(a.Users) > 0 {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, name))
+			}
+			if len(a.Tokens) > 0 {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q`, name))
+			}
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		credentials = credentials || used
+	}
+	if credentials {
+		r.Header.Del("Authorization")
+	}
+	return true
+}
+
+// check returns 0 if the request passes a, used tells if it took the credentials
+func (h *Handler) check(a *policy, r *http.Request, ip net.IP) (status int, used bool) {
+	if a.invalid || pproto.ContainsIP(a.deny, ip) {
+		return http.StatusForbidden, false
+	}
+	if len(a.allow) > 0 && !pproto.ContainsIP(a.allow, ip) {
+		return http.StatusForbidden, false
+	}
+	if len(a.Users) == 0 && len(a.Tokens) == 0 {
+		return 0, false
+	}
+	if token := bearerToken(r); token != "" {
+		for _, t := range a.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return 0, true
+			}
+		}
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		for _, u := range a.Users {
+			if u.Name == user && h.passwordMatches(u.PasswordHash, user, password) {
+				return 0, true
+			}
+		}
+	}
+	return http.StatusUnauthorized, false
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// maxVerified is how many matched passwords are remembered
+const maxVerified = 1024
+
+// passwordMatches remembers passwords which matched their hashes,
+// bcrypt is too slow to run it on every request
+func (h *Handler) passwordMatches(hash, user, password string) bool {
+	key := sha256.Sum256([]byte(hash + "\x00" + user + "\x00" + password))
+	h.verifiedLock.Lock()
+	ok := h.verified[key]
+	h.verifiedLock.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	h.verifiedLock.Lock()
+	if h.verified == nil || len(h.verified) >= maxVerified {
+		h.verified = map[[sha256.Size]byte]bool{}
+	}
+	h.verified[key] = true
+	h.verifiedLock.Unlock()
+	return true
+}
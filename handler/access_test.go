@@ -0,0 +1,116 @@
+package handler
+
+import (
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckNetworks(t *testing.T) {
+	h := newHandler(&tcp.Server{})
+	a, err := newPolicy(&pproto.GateAccess{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.6.6.6"}})
+	require.NoError(t, err)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	status, _ := h.check(a, r, net.ParseIP("10.1.2.3"))
+	assert.Equal(t, 0, status)
+	status, _ = h.check(a, r, net.ParseIP("10.6.6.6"))
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = h.check(a, r, net.ParseIP("8.8.8.8"))
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = h.check(a, r, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestCheckCredentials(t *testing.T) {
+	u, err := pproto.NewGateUser("dev", "pa55")
+	require.NoError(t, err)
+	h := newHandler(&tcp.Server{})
+	a, err := newPolicy(&pproto.GateAccess{Users: []*pproto.GateUser{u}, Tokens: []string{"t0ken"}})
+	require.NoError(t, err)
+	ip := net.ParseIP("1.2.3.4")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	status, _ := h.check(a, r, ip)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	r.SetBasicAuth("dev", "pa55")
+	status, used := h.check(a, r, ip)
+	assert.Equal(t, 0, status)
+	assert.True(t, used)
+
+	r.SetBasicAuth("dev", "wrong")
+	status, _ = h.check(a, r, ip)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Len(t, h.verified, 1)
+
+	r.Header.Set("Authorization", "Bearer t0ken")
+	status, _ = h.check(a, r, ip)
+	assert.Equal(t, 0, status)
+
+	r.Header.Set("Authorization", "Bearer t0ke")
+	status, _ = h.check(a, r, ip)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestUnauthorizedNeverSent(t *testing.T) {
+	h := newHandler(&tcp.Server{})
+	h.SetConfig(&Config{Services: map[string]*ServiceConfig{
+		"private": {Access: &Access{Tokens: []string{"t0ken"}}},
+	}})
+
+	w := httptest.NewRecorder()
+	require.NoError(t, h.service("private", w, httptest.NewRequest("GET", "http://private.gate.test/", nil)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="private"`, w.Header().Get("WWW-Authenticate"))
+
+	// authorized requests go on to the service, it is not connected here
+	r := httptest.NewRequest("GET", "http://private.gate.test/", nil)
+	r.Header.Set("Authorization", "Bearer t0ken")
+	assert.EqualError(t, h.service("private", httptest.NewRecorder(), r), "service private not found")
+	assert.Empty(t, r.Header.Get("Authorization"))
+}
+
+func TestLoadConfigValidatesAccess(t *testing.T) {
+	path := t.TempDir() + "/gate.yaml"
+	require.NoError(t, os.WriteFile(path, []byte("services:\n  web:\n    access:\n      allow: [10.0.0.0/33]\n"), 0600))
+	_, err := LoadConfig(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("access:\n  deny: [192.168.0.0/16]\nservices:\n  web:\n    access:\n      tokens: [abc]\n"), 0600))
+	c, err := LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abc"}, c.Services["web"].Access.Tokens)
+	assert.Equal(t, []string{"192.168.0.0/16"}, c.Access.Deny)
+	// networks are parsed once, not on every request
+	require.NotNil(t, c.Access.policy)
+	assert.Equal(t, "192.168.0.0/16", c.Access.policy.deny[0].String())
+	assert.NotNil(t, c.Services["web"].Access.policy)
+}
+
+func TestClientPolicy(t *testing.T) {
+	s, h, addr := startGate(t)
+	tcp.SetAccess("guarded", &pproto.GateAccess{Deny: []string{"192.0.2.1"}})
+	defer tcp.SetAccess("guarded", nil)
+	c := tcp.NewMultiClient(addr)
+	c.Add("guarded", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		return respond(ex, 200, "ok")
+	})
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// httptest requests come from 192.0.2.1
+	assert.Equal(t, http.StatusForbidden, get(h, "http://guarded.gate.test/").Code)
+	p := h.clientPolicy("guarded")
+	require.NotNil(t, p)
+	assert.Equal(t, "192.0.2.1/32", p.deny[0].String())
+	assert.Same(t, p, h.clientPolicy("guarded"))
+}
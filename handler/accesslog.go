@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLog is the config of the access log, a record per request to a service
+type AccessLog struct {
+	// Output is stderr, stdout, syslog or a file path
+	Output string `yaml:"output"`
+	// Format is json (lines, default) or combined (apache)
+	Format string `yaml:"format"`
+	// a file is moved to <path>.1 when it grows over MaxSize bytes, 0 - 100MiB,
+	// MaxBackups of the moved files are kept, 0 - 5
+	MaxSize    int64 `yaml:"max_size"`
+	MaxBackups int   `yaml:"max_backups"`
+}
+
+func (c *AccessLog) validate() error {
+	if c.Output == "" {
+		return fmt.Errorf("no output")
+	}
+	if c.Format != "" && c.Format != "json" && c.Format != "combined" {
+		return fmt.Errorf("unknown format %s", c.Format)
+	}
+	return nil
+}
+
+// AccessRecord is one request to a service
+type AccessRecord struct {
+	Time      time.Time
+	Service   string
+	RequestID string // X-Request-Id, a random 128-bit hex one made by the gate unless the caller sent a sane id
+	ClientIP  string
+	User      string // of basic auth
+	Method    string
+	URL       string
+	Proto     string
+	Host      string
+	Status    int
+	Bytes     int64 // of the response body
+	Referer   string
+	UserAgent string
+	// Duration is the whole request at the gate. Upstream is the time the client took
+	// for the response head, 0 if it does not tell. Tunnel is the rest of the time to
+	// the head, spent between the gate and the client.
+	Duration time.Duration
+	Upstream time.Duration
+	Tunnel   time.Duration
+}
+
+// AccessSink takes the records, Log is called when a request is done
+type AccessSink interface {
+	Log(r *AccessRecord)
+}
+
+// AccessLogger writes records as lines to the output of the config
+type AccessLogger struct {
+	lock   sync.Mutex
+	out    io.WriteCloser
+	format func(r *AccessRecord) []byte
+}
+
+// OpenAccessLog opens the output of the config, Close the logger when done
+func OpenAccessLog(c *AccessLog) (*AccessLogger, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	l := &AccessLogger{format: jsonRecord}
+	if c.Format == "combined" {
+		l.format = combinedRecord
+	}
+	var err error
+	switch c.Output {
+	case "stderr":
+		l.out = nopCloser{os.Stderr}
+	case "stdout":
+		l.out = nopCloser{os.Stdout}
+	case "syslog":
+		l.out, err = openSyslog()
+	default:
+		l.out, err = openRotated(c.Output, c.MaxSize, c.MaxBackups)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AccessLogger) Log(r *AccessRecord) {
+	line := l.format(r)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(line)
+}
+
+func (l *AccessLogger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.out.Close()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func jsonRecord(r *AccessRecord) []byte {
+	b, _ := json.Marshal(&struct {
+		Time      time.Time `json:"time"`
+		Service   string    `json:"service"`
+		RequestID string    `json:"request_id,omitempty"`
+		ClientIP  string    `json:"client_ip"`
+		User      string    `json:"user,omitempty"`
+		Method    string    `json:"method"`
+		URL       string    `json:"url"`
+		Proto     string    `json:"proto"`
+		Host      string    `json:"host"`
+		Status    int       `json:"status"`
+		Bytes     int64     `json:"bytes"`
+		Referer   string    `json:"referer,omitempty"`
+		UserAgent string    `json:"user_agent,omitempty"`
+		Duration  float64   `json:"duration_ms"`
+		Upstream  float64   `json:"upstream_ms,omitempty"`
+		Tunnel    float64   `json:"tunnel_ms,omitempty"`
+	}{r.Time, r.Service, r.RequestID, r.ClientIP, r.User, r.Method, r.URL, r.Proto, r.Host, r.Status, r.Bytes,
+		r.Referer, r.UserAgent, ms(r.Duration), ms(r.Upstream), ms(r.Tunnel)})
+	return append(b, '\n')
+}
+
+// combinedRecord is the apache combined log format
+func combinedRecord(r *AccessRecord) []byte {
+	user, size := "-", "-"
+	if r.User != "" {
+		user = r.User
+	}
+	if r.Bytes > 0 {
+		size = strconv.FormatInt(r.Bytes, 10)
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] %q %d %s %q %q\n", r.ClientIP, user, r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL+" "+r.Proto, r.Status, size, r.Referer, r.UserAgent))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// rotatedFile moves the file to <path>.1 (.1 to .2 and so on) when it gets too big
+type rotatedFile struct {
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotated(path string, maxSize int64, backups int) (*rotatedFile, error) {
+	if maxSize <= 0 {
+		maxSize = 100 << 20
+	}
+	if backups <= 0 {
+		backups = 5
+	}
+	r := &rotatedFile{path: path, maxSize: maxSize, backups: backups}
+	return r, r.open()
+}
+
+func (r *rotatedFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+func (r *rotatedFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatedFile) rotate() error {
+	r.f.Close()
+	for i := r.backups - 1; i > 0; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatedFile) Close() error {
+	return r.f.Close()
+}
+
+// accessWriter notes the status and body size of the response for the record
+type accessWriter struct {
+	http.ResponseWriter
+	record AccessRecord
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.record.Status == 0 && code >= 200 {
+		w.record.Status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.record.Status == 0 {
+		w.record.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.record.Bytes += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessRecord is the record of the response written to w, nil if it is not logged
+func accessRecord(w http.ResponseWriter) *AccessRecord {
+	for {
+		if aw, ok := w.(*accessWriter); ok {
+			return &aw.record
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+// SetAccessSink sends access records to s, nil - nowhere. A sink set here
+// is replaced by the access log of a config with one.
+func (h *Handler) SetAccessSink(s AccessSink) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.setSink(s, false)
+}
+
+// setSink replaces the sink closing the one opened from a config, h.lock is held
+func (h *Handler) setSink(s AccessSink, opened bool) {
+	if old, ok := h.sink.(*AccessLogger); ok && h.sinkOpened {
+		old.Close()
+	}
+	h.sink, h.sinkOpened = s, opened
+}
+
+func (h *Handler) accessSink() AccessSink {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.sink
+}
+
+// logAccess completes the record of the request and sends it to the sink
+func (h *Handler) logAccess(name string, w *accessWriter, r *http.Request, start time.Time) {
+	sink := h.accessSink()
+	if sink == nil {
+		return
+	}
+	rec := &w.record
+	rec.Time, rec.Duration = start, time.Since(start)
+	rec.Service, rec.ClientIP = name, h.clientIP(r)
+	rec.Method, rec.URL, rec.Proto, rec.Host = r.Method, r.URL.RequestURI(), r.Proto, r.Host
+	rec.Referer, rec.UserAgent = r.Referer(), r.UserAgent()
+	sink.Log(rec)
+}
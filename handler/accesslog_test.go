@@ -0,0 +1,127 @@
+package handler
+
+import (
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type records struct {
+	lock sync.Mutex
+	list []*AccessRecord
+}
+
+func (r *records) Log(rec *AccessRecord) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.list = append(r.list, rec)
+}
+
+func TestAccessRecords(t *testing.T) {
+	s, h, addr := startGate(t)
+	c := tcp.NewMultiClient(addr)
+	c.Add("api", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		time.Sleep(10 * time.Millisecond)
+		_, err := ex.Write([]byte("hello"))
+		return err
+	})
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	sink := &records{}
+	h.SetAccessSink(sink)
+
+	r := httptest.NewRequest("GET", "http://api.gate.test/hi?x=1", nil)
+	r.Header.Set("User-Agent", "test/1.0")
+	r.SetBasicAuth("dev", "pa55")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://missing.gate.test/", nil))
+	// the listing is not a request to a service
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://gate.test/", nil))
+
+	require.Len(t, sink.list, 2)
+	rec := sink.list[0]
+	assert.Equal(t, "api", rec.Service)
+	assert.NotEmpty(t, rec.RequestID)
+	assert.Equal(t, "192.0.2.1", rec.ClientIP)
+	assert.Equal(t, "dev", rec.User)
+	assert.Equal(t, "/hi?x=1", rec.URL)
+	assert.Equal(t, 200, rec.Status)
+	assert.Equal(t, int64(5), rec.Bytes)
+	assert.Equal(t, "test/1.0", rec.UserAgent)
+	assert.GreaterOrEqual(t, rec.Upstream, 10*time.Millisecond)
+	assert.Greater(t, rec.Tunnel, time.Duration(0))
+	assert.GreaterOrEqual(t, rec.Duration, rec.Upstream+rec.Tunnel)
+
+	assert.Equal(t, "missing", sink.list[1].Service)
+	assert.Equal(t, 500, sink.list[1].Status)
+}
+
+func TestAccessFormats(t *testing.T) {
+	rec := &AccessRecord{
+		Time:      time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC),
+		Service:   "api",
+		RequestID: "7",
+		ClientIP:  "1.2.3.4",
+		Method:    "GET",
+		URL:       "/hi",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     5,
+		UserAgent: "test/1.0",
+		Duration:  3 * time.Millisecond,
+		Upstream:  2 * time.Millisecond,
+		Tunnel:    500 * time.Microsecond,
+	}
+	assert.Equal(t, `1.2.3.4 - - [01/Mar/2024:10:20:30 +0000] "GET /hi HTTP/1.1" 200 5 "" "test/1.0"`+"\n", string(combinedRecord(rec)))
+	assert.JSONEq(t, `{"time":"2024-03-01T10:20:30Z","service":"api","request_id":"7","client_ip":"1.2.3.4",
+		"method":"GET","url":"/hi","proto":"HTTP/1.1","host":"","status":200,"bytes":5,"user_agent":"test/1.0",
+		"duration_ms":3,"upstream_ms":2,"tunnel_ms":0.5}`, string(jsonRecord(rec)))
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := OpenAccessLog(&AccessLog{Output: path, Format: "combined", MaxSize: 200, MaxBackups: 2})
+	require.NoError(t, err)
+	rec := &AccessRecord{ClientIP: "1.2.3.4", Method: "GET", URL: "/", Proto: "HTTP/1.1", Status: 200}
+	for i := 0; i < 10; i++ {
+		l.Log(rec)
+	}
+	require.NoError(t, l.Close())
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(b), 200)
+		assert.True(t, strings.HasSuffix(string(b), "\n"))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = OpenAccessLog(&AccessLog{Output: path, Format: "common"})
+	assert.Error(t, err)
+}
+
+func TestSetConfigRefusesAccessLog(t *testing.T) {
+	_, h, _ := startGate(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+	kept := &Config{AccessLog: &AccessLog{Output: path}}
+	require.NoError(t, h.SetConfig(kept))
+	defer h.SetConfig(nil)
+
+	// the output can not be opened, the config in effect and its log stay
+	err := h.SetConfig(&Config{AccessLog: &AccessLog{Output: filepath.Join(path, "sub", "access.log")}})
+	assert.Error(t, err)
+	assert.Same(t, kept, h.config)
+	get(h, "http://api.gate.test/")
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"service":"api"`)
+}
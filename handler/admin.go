@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// eventsPing keeps idle event streams from being closed by proxies
+var eventsPing = 30 * time.Second
+
+// NewAdminHandler starts the admin http-listener, keep it on a private address
+func NewAdminHandler(adminAddress string) error {
+	log.Info().Str("address", adminAddress).Msg("start admin-listener")
+	return http.ListenAndServe(adminAddress, std.Admin())
+}
+
+// Admin serves the admin api of the handler, keep it on a private address.
+// /metrics has expvar of the process but cmdline, axgate_limits there is of the package handler.
+func (h *Handler) Admin() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/metrics", metrics)
+	r.Get("/services/{name}/limits", h.getLimits)
+	r.Put("/services/{name}/limits", h.putLimits)
+	r.Delete("/services/{name}/limits", h.deleteLimits)
+	r.Get("/services/{name}/cache", h.getCache)
+	r.Delete("/services/{name}/cache", h.purgeCache)
+	r.Get("/services/{name}/mirror", h.getMirror)
+	r.Get("/events", h.events)
+	return r
+}
+
+// metrics writes expvar like expvar.Handler does, without cmdline: it has the -key of the server
+func metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
+
+// getLimits answers the limits in effect for the service, null if it is unlimited
+func (h *Handler) getLimits(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, h.limits(chi.URLParam(r, "name")))
+}
+
+// putLimits overrides the configured limits of the service until restart
+func (h *Handler) putLimits(w http.ResponseWriter, r *http.Request) {
+	var limits Limits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		http.Error(w, "400 bad limits: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := limits.validate(); err != nil {
+		http.Error(w, "400 bad limits: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := chi.URLParam(r, "name")
+	h.limiter.override(name, &limits)
+	h.log().Info().Str("service", name).Interface("limits", limits).Msg("limits overridden")
+	writeJson(w, http.StatusOK, &limits)
+}
+
+// deleteLimits drops the override, the configured limits apply again
+func (h *Handler) deleteLimits(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	h.limiter.override(name, nil)
+	h.log().Info().Str("service", name).Msg("limits override removed")
+	writeJson(w, http.StatusOK, h.limits(name))
+}
+
+// getCache answers stats of the service cache
+func (h *Handler) getCache(w http.ResponseWriter, r *http.Request) {
+	c := h.openedCache(chi.URLParam(r, "name"))
+	if c == nil {
+		http.Error(w, "404 service has no cache", http.StatusNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, c.stats())
+}
+
+// purgeCache drops stored responses of the service, ?prefix=/static/ picks urls starting with it
+func (h *Handler) purgeCache(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	c := h.openedCache(name)
+	if c == nil {
+		http.Error(w, "404 service has no cache", http.StatusNotFound)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	n := c.purge(prefix)
+	h.log().Info().Str("service", name).Str("prefix", prefix).Int("purged", n).Msg("cache purged")
+	writeJson(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+// getMirror answers how the mirror of the service compares to it
+func (h *Handler) getMirror(w http.ResponseWriter, r *http.Request) {
+	m := h.mirrorState(chi.URLParam(r, "name"))
+	if m == nil {
+		http.Error(w, "404 service has no mirror", http.StatusNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, m.snapshot())
+}
+
+// events streams gate events as server-sent events until the caller goes away,
+// ?type=service.connected,service.disconnected picks the types
+func (h *Handler) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	var types []string
+	if t := r.URL.Query().Get("type"); t != "" {
+		types = strings.Split(t, ",")
+	}
+	events, cancel := h.gate.Events.Subscribe(webhookQueue)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ping := time.NewTicker(eventsPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+		case ev := <-events:
+			if len(types) > 0 && !contains(types, ev.Type) {
+				continue
+			}
+			b, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
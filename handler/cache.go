@@ -0,0 +1,510 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	pproto "github.com/axgrid/axgate/proto"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache keeps responses of services at the gate as a shared http cache
+// (Cache-Control, Expires, ETag and Last-Modified revalidation, Vary)
+type Cache struct {
+	// Disabled turns the cache of the config off for a service
+	Disabled bool `yaml:"disabled"`
+	// Storage is memory (default) or disk, disk keeps responses in Dir/<service>
+	Storage string `yaml:"storage"`
+	Dir     string `yaml:"dir"`
+	// MaxSize is bytes of responses kept per service, 0 - 64MiB,
+	// MaxObject is the biggest response kept, 0 - 8MiB
+	MaxSize   int64 `yaml:"max_size"`
+	MaxObject int64 `yaml:"max_object"`
+	// StaleIfError is seconds a stale response is served when the service fails
+	// or is not connected, responses may allow more with Cache-Control: stale-if-error
+	StaleIfError int `yaml:"stale_if_error"`
+}
+
+func (c *Cache) validate() error {
+	switch c.Storage {
+	case "", "memory":
+	case "disk":
+		if c.Dir == "" {
+			return fmt.Errorf("disk storage needs dir")
+		}
+	default:
+		return fmt.Errorf("unknown storage %s", c.Storage)
+	}
+	return nil
+}
+
+// responseCache is the cache of one service
+type responseCache struct {
+	config Cache
+	store  cacheStore
+
+	lock sync.Mutex
+	vary map[string][]string // Vary headers of responses by primary key
+
+	hits, misses, stale int64 // atomic
+}
+
+func newResponseCache(service string, c *Cache) (*responseCache, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	rc := &responseCache{config: *c, vary: map[string][]string{}}
+	if rc.config.MaxSize <= 0 {
+		rc.config.MaxSize = 64 << 20
+	}
+	if rc.config.MaxObject <= 0 {
+		rc.config.MaxObject = 8 << 20
+	}
+	if c.Storage == "disk" {
+		s, err := newDiskStore(storeDir(c.Dir, service), rc.config.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		rc.store = s
+	} else {
+		rc.store = newMemoryStore(rc.config.MaxSize)
+	}
+	rc.store.each(func(e *cacheEntry) {
+		rc.vary[e.Primary] = e.Vary
+	})
+	return rc, nil
+}
+
+// purge drops entries with urls starting with prefix, all for an empty one
+func (c *responseCache) purge(prefix string) int {
+	var keys []string
+	c.store.each(func(e *cacheEntry) {
+		if prefix == "" || strings.HasPrefix(urlOf(e.Primary), prefix) {
+			keys = append(keys, e.Key)
+		}
+	})
+	for _, k := range keys {
+		c.store.remove(k)
+	}
+	return len(keys)
+}
+
+// CacheStats of a service cache
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Stale   int64 `json:"stale"` // stale responses served on errors
+}
+
+func (c *responseCache) stats() *CacheStats {
+	n, size := c.store.stats()
+	return &CacheStats{Entries: n, Size: size, Hits: atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses), Stale: atomic.LoadInt64(&c.stale)}
+}
+
+// primaryKey is host and url, the part of the key without Vary
+func primaryKey(r *http.Request) string {
+	return r.Host + " " + r.URL.RequestURI()
+}
+
+func urlOf(primary string) string {
+	return primary[strings.IndexByte(primary, ' ')+1:]
+}
+
+func varyKey(primary string, vary []string, h http.Header) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(h.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// varyOf returns canonical names of the Vary headers, ok is false for Vary: *
+func varyOf(h http.Header) (names []string, ok bool) {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			k, val := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				k, val = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			cc[strings.ToLower(k)] = val
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(d string) bool {
+	_, ok := cc[d]
+	return ok
+}
+
+// seconds of the directive, ok is false if it is missing or broken
+func (cc cacheControl) seconds(d string) (time.Duration, bool) {
+	v, ok := cc[d]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// lifetime is how long the response is fresh, explicit is false if it does not tell
+func lifetime(h http.Header, cc cacheControl) (d time.Duration, explicit bool) {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if d = expires.Sub(date); d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 410: true}
+
+// storable tells if the response to r may be kept by a shared cache
+func storable(r *http.Request, status int, h http.Header) bool {
+	if r.Method != "GET" || r.Header.Get("Range") != "" || !cacheableStatus[status] {
+		return false
+	}
+	if parseCacheControl(r.Header).has("no-store") {
+		return false
+	}
+	cc := parseCacheControl(h)
+	if cc.has("no-store") || cc.has("private") || h.Get("Set-Cookie") != "" {
+		return false
+	}
+	if _, ok := varyOf(h); !ok {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	_, explicit := lifetime(h, cc)
+	return explicit || h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return now.Sub(e.Stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	cc := parseCacheControl(e.Header)
+	if cc.has("no-cache") {
+		return false
+	}
+	d, _ := lifetime(e.Header, cc)
+	return e.age(now) < d
+}
+
+// staleOK tells if the entry may be served as the service fails
+func (c *responseCache) staleOK(e *cacheEntry, now time.Time) bool {
+	cc := parseCacheControl(e.Header)
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		return false
+	}
+	allowed := time.Duration(c.config.StaleIfError) * time.Second
+	if d, ok := cc.seconds("stale-if-error"); ok && d > allowed {
+		allowed = d
+	}
+	d, _ := lifetime(e.Header, cc)
+	return e.age(now)-d <= allowed
+}
+
+// notModified tells if the conditionals of the caller match the entry
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err1 := http.ParseTime(ims)
+		modified, err2 := http.ParseTime(h.Get("Last-Modified"))
+		return err1 == nil && err2 == nil && !modified.After(since)
+	}
+	return false
+}
+
+func hasConditionals(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// cacheLookup is the cache side of one request to a service
+type cacheLookup struct {
+	cache        *responseCache
+	name         string
+	primary, key string
+	entry        *cacheEntry // nil - nothing stored
+	revalidating bool        // conditionals of the entry are added to the request
+}
+
+// lookupCache serves a fresh stored response, done is true then.
+// Otherwise it adds validators of a stale one to rq for revalidation.
+func (h *Handler) lookupCache(name string, w http.ResponseWriter, r *http.Request, rq *pproto.GateRequest) (l *cacheLookup, done bool) {
+	c := h.cache(name)
+	if c == nil || r.Method != "GET" && r.Method != "HEAD" || r.Header.Get("Range") != "" {
+		return nil, false
+	}
+	l = &cacheLookup{cache: c, name: name, primary: primaryKey(r)}
+	c.lock.Lock()
+	vary := c.vary[l.primary]
+	c.lock.Unlock()
+	l.key = varyKey(l.primary, vary, r.Header)
+	l.entry = c.store.get(l.key)
+	if l.entry == nil {
+		atomic.AddInt64(&c.misses, 1)
+		w.Header().Set("X-Cache", "MISS")
+		return l, false
+	}
+	cc := parseCacheControl(r.Header)
+	if l.entry.fresh(time.Now()) && !cc.has("no-cache") && cc["max-age"] != "0" {
+		atomic.AddInt64(&c.hits, 1)
+		l.serve(w, r, "HIT")
+		return l, true
+	}
+	if r.Method == "GET" && !hasConditionals(r) {
+		header := pproto.FromGateHeader(rq.Header)
+		if etag := l.entry.Header.Get("ETag"); etag != "" {
+			header.Set("If-None-Match", etag)
+			l.revalidating = true
+		}
+		if lm := l.entry.Header.Get("Last-Modified"); lm != "" {
+			header.Set("If-Modified-Since", lm)
+			l.revalidating = true
+		}
+		rq.Header = pproto.ToGateHeader(header)
+	}
+	w.Header().Set("X-Cache", "MISS")
+	return l, false
+}
+
+// serve writes the stored response, state goes to X-Cache
+func (l *cacheLookup) serve(w http.ResponseWriter, r *http.Request, state string) {
+	e := l.entry
+	for k, v := range e.Header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(e.age(time.Now()).Seconds())))
+	w.Header().Set("X-Cache", state)
+	w.Header().Set("x-gate-ref", l.name)
+	if notModified(r, e.Header) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != "HEAD" {
+		w.Write(e.Body)
+	}
+}
+
+// serveStale serves the stored response if the service failed and it is allowed
+func (l *cacheLookup) serveStale(w http.ResponseWriter, r *http.Request) bool {
+	if l == nil || l.entry == nil || !l.cache.staleOK(l.entry, time.Now()) {
+		return false
+	}
+	atomic.AddInt64(&l.cache.stale, 1)
+	w.Header().Del("X-Cache")
+	l.serve(w, r, "STALE")
+	return true
+}
+
+// revalidated serves the stored response if the service answered 304 to its validators,
+// the stored headers are updated by the ones of rs
+func (l *cacheLookup) revalidated(w http.ResponseWriter, r *http.Request, rs *pproto.GateResponse) bool {
+	if l == nil || !l.revalidating || rs.StatusCode != http.StatusNotModified {
+		return false
+	}
+	e := *l.entry
+	e.Header = e.Header.Clone()
+	for k, v := range pproto.FromGateHeader(rs.Header) {
+		if k != "Content-Length" {
+			e.Header[k] = v
+		}
+	}
+	e.Stored = storedAt(e.Header)
+	if e.Body == nil {
+		e.Body = []byte{}
+	}
+	l.cache.store.put(&e)
+	l.entry = &e
+	w.Header().Del("X-Cache")
+	l.serve(w, r, "REVALIDATED")
+	return true
+}
+
+// storedAt is when the response was made, by its Age
+func storedAt(h http.Header) time.Time {
+	now := time.Now()
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		now = now.Add(-time.Duration(age) * time.Second)
+	}
+	return now
+}
+
+// recorder keeps a copy of the response body while it is sent to the caller,
+// nil if the response is not to be stored
+func (l *cacheLookup) recorder(r *http.Request, rs *pproto.GateResponse, body io.Reader) *cacheRecorder {
+	if l == nil || rs.ContentLength > l.cache.config.MaxObject || len(rs.Trailer) > 0 {
+		return nil
+	}
+	header := pproto.FromGateHeader(rs.Header)
+	if !storable(r, int(rs.StatusCode), header) {
+		return nil
+	}
+	rec := &cacheRecorder{body: body, max: l.cache.config.MaxObject, status: int(rs.StatusCode), header: header}
+	rec.buf.Write(rs.Body)
+	return rec
+}
+
+type cacheRecorder struct {
+	body   io.Reader
+	max    int64
+	buf    bytes.Buffer
+	over   bool
+	status int
+	header http.Header
+}
+
+func (c *cacheRecorder) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if !c.over {
+		if int64(c.buf.Len()+n) > c.max {
+			c.over = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// store keeps the recorded response, trailer is of the finished stream
+func (l *cacheLookup) store(r *http.Request, rec *cacheRecorder, trailer []*pproto.GateHeader) {
+	if rec == nil || rec.over || len(trailer) > 0 {
+		return
+	}
+	vary, _ := varyOf(rec.header)
+	header := rec.header.Clone()
+	header.Del("X-Cache")
+	e := &cacheEntry{
+		Key:     varyKey(l.primary, vary, r.Header),
+		Primary: l.primary,
+		Vary:    vary,
+		Status:  rec.status,
+		Header:  header,
+		Stored:  storedAt(header),
+		Body:    rec.buf.Bytes(),
+	}
+	l.cache.lock.Lock()
+	l.cache.vary[l.primary] = vary
+	l.cache.lock.Unlock()
+	if e.Key != l.key && l.entry != nil {
+		l.cache.store.remove(l.key)
+	}
+	l.cache.store.put(e)
+}
+
+// cache returns the response cache of the service, nil if it has none. Names come
+// from the Host header, so a cache is opened only for configured or connected services.
+func (h *Handler) cache(name string) *responseCache {
+	h.lock.RLock()
+	c, ok := h.caches[name]
+	h.lock.RUnlock()
+	if ok {
+		return c
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if c, ok := h.caches[name]; ok {
+		return c
+	}
+	config := h.config.Cache
+	s := h.config.Services[name]
+	if s != nil && s.Cache != nil {
+		config = s.Cache
+	}
+	if config == nil || config.Disabled || s == nil && !h.gate.Connected(name) {
+		return nil
+	}
+	c, err := newResponseCache(name, config)
+	if err != nil {
+		h.log().Error().Err(err).Str("service", name).Msg("fail to open cache")
+		if s == nil {
+			return nil
+		}
+		// a configured one is not retried on every request
+		c = nil
+	}
+	if h.caches == nil {
+		h.caches = map[string]*responseCache{}
+	}
+	h.caches[name] = c
+	return c
+}
+
+// openedCache returns the cache of the service if requests opened it, it opens none
+func (h *Handler) openedCache(name string) *responseCache {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.caches[name]
+}
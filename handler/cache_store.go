@@ -0,0 +1,336 @@
+package handler
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	Key     string      `json:"key"`     // primary key and values of the Vary headers
+	Primary string      `json:"primary"` // host and url of the request
+	Vary    []string    `json:"vary,omitempty"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Stored  time.Time   `json:"stored"` // when the response was made, Age of it included
+	Body    []byte      `json:"-"`
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for k, v := range e.Header {
+		n += int64(len(k))
+		for _, s := range v {
+			n += int64(len(s))
+		}
+	}
+	return n
+}
+
+// cacheStore keeps entries up to its size dropping the least recently used
+type cacheStore interface {
+	get(key string) *cacheEntry
+	put(e *cacheEntry)
+	remove(key string)
+	// each calls fn for every entry, its body may be left out
+	each(fn func(e *cacheEntry))
+	stats() (entries int, size int64)
+}
+
+// memoryStore keeps entries in memory
+type memoryStore struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List // of *cacheEntry, the most recent first
+	items   map[string]*list.Element
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{maxSize: maxSize, lru: list.New(), items: map[string]*list.Element{}}
+}
+
+func (s *memoryStore) get(key string) *cacheEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (s *memoryStore) put(e *cacheEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeLocked(e.Key)
+	s.items[e.Key] = s.lru.PushFront(e)
+	s.size += e.size()
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		s.removeLocked(s.lru.Back().Value.(*cacheEntry).Key)
+	}
+}
+
+func (s *memoryStore) remove(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *memoryStore) removeLocked(key string) {
+	if el, ok := s.items[key]; ok {
+		s.size -= el.Value.(*cacheEntry).size()
+		s.lru.Remove(el)
+		delete(s.items, key)
+	}
+}
+
+func (s *memoryStore) each(fn func(e *cacheEntry)) {
+	s.lock.Lock()
+	list := make([]*cacheEntry, 0, len(s.items))
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		list = append(list, el.Value.(*cacheEntry))
+	}
+	s.lock.Unlock()
+	for _, e := range list {
+		fn(e)
+	}
+}
+
+func (s *memoryStore) stats() (int, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.items), s.size
+}
+
+// diskStore keeps an entry per file: 4 bytes of the meta length, meta json, body.
+// Metas are held in memory, entries of the directory are taken over on open.
+type diskStore struct {
+	dir     string
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List // of *diskItem, the most recent first
+	items   map[string]*list.Element
+}
+
+type diskItem struct {
+	meta *cacheEntry // without body
+	size int64
+}
+
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &diskStore{dir: dir, maxSize: maxSize, lru: list.New(), items: map[string]*list.Element{}}
+	// temp files of puts cut by a crash
+	temps, err := filepath.Glob(filepath.Join(dir, "put-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range temps {
+		os.Remove(name)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.cache"))
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		item  *diskItem
+		mtime time.Time
+	}
+	var list []found
+	for _, name := range files {
+		meta, st, err := readMeta(name)
+		if err != nil || filepath.Base(name) != fileOf(meta.Key) {
+			os.Remove(name)
+			continue
+		}
+		list = append(list, found{&diskItem{meta: meta, size: st.Size()}, st.ModTime()})
+	}
+	// the most recently written go to the front
+	sort.Slice(list, func(i, j int) bool { return list[i].mtime.After(list[j].mtime) })
+	for _, f := range list {
+		s.items[f.item.meta.Key] = s.lru.PushBack(f.item)
+		s.size += f.item.size
+	}
+	s.lock.Lock()
+	s.evictLocked()
+	s.lock.Unlock()
+	return s, nil
+}
+
+// fileOf is the file name of the key
+func fileOf(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16]) + ".cache"
+}
+
+func readMeta(name string) (*cacheEntry, os.FileInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := decodeMeta(f, st.Size())
+	return meta, st, err
+}
+
+func decodeMeta(r io.Reader, size int64) (*cacheEntry, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if int64(n) > size-4 {
+		return nil, errors.New("broken cache file")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	var meta cacheEntry
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (s *diskStore) get(key string) *cacheEntry {
+	s.lock.Lock()
+	el, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(el)
+	}
+	s.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(s.dir, fileOf(key)))
+	if err != nil {
+		s.remove(key)
+		return nil
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	e, err := decodeMeta(f, st.Size())
+	if err == nil {
+		e.Body, err = io.ReadAll(f)
+	}
+	if err != nil || e.Key != key {
+		s.remove(key)
+		return nil
+	}
+	return e
+}
+
+func (s *diskStore) put(e *cacheEntry) {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	name := filepath.Join(s.dir, fileOf(e.Key))
+	tmp, err := os.CreateTemp(s.dir, "put-*")
+	if err != nil {
+		return
+	}
+	err = binary.Write(tmp, binary.BigEndian, uint32(len(meta)))
+	if err == nil {
+		_, err = tmp.Write(meta)
+	}
+	if err == nil {
+		_, err = tmp.Write(e.Body)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	item := &diskItem{meta: &cacheEntry{Key: e.Key, Primary: e.Primary, Vary: e.Vary, Status: e.Status, Header: e.Header, Stored: e.Stored},
+		size: int64(4 + len(meta) + len(e.Body))}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if el, ok := s.items[e.Key]; ok {
+		s.size -= el.Value.(*diskItem).size
+		s.lru.Remove(el)
+	}
+	s.items[e.Key] = s.lru.PushFront(item)
+	s.size += item.size
+	s.evictLocked()
+}
+
+func (s *diskStore) evictLocked() {
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		s.removeLocked(s.lru.Back().Value.(*diskItem).meta.Key)
+	}
+}
+
+func (s *diskStore) remove(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *diskStore) removeLocked(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+	s.size -= el.Value.(*diskItem).size
+	s.lru.Remove(el)
+	delete(s.items, key)
+	os.Remove(filepath.Join(s.dir, fileOf(key)))
+}
+
+func (s *diskStore) each(fn func(e *cacheEntry)) {
+	s.lock.Lock()
+	list := make([]*cacheEntry, 0, len(s.items))
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		list = append(list, el.Value.(*diskItem).meta)
+	}
+	s.lock.Unlock()
+	for _, e := range list {
+		fn(e)
+	}
+}
+
+func (s *diskStore) stats() (int, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.items), s.size
+}
+
+// storeDir is the directory of the service in dir, names are kept to safe characters
+func storeDir(dir, service string) string {
+	return filepath.Join(dir, strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, service))
+}
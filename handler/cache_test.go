@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cachedService runs a client serving api with the header, it counts requests
+func cachedService(t *testing.T, addr string, fn func(request *pproto.GateRequest, ex *tcp.Exchange) error) (*tcp.Client, *int32) {
+	var calls int32
+	c := tcp.NewMultiClient(addr)
+	c.Add("api", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		atomic.AddInt32(&calls, 1)
+		return fn(request, ex)
+	})
+	go c.Run()
+	t.Cleanup(func() { c.Close() })
+	return c, &calls
+}
+
+func respond(ex *tcp.Exchange, status int, body string, header ...string) error {
+	var h []*pproto.GateHeader
+	for i := 0; i < len(header); i += 2 {
+		h = append(h, &pproto.GateHeader{Key: header[i], Values: []string{header[i+1]}})
+	}
+	if err := ex.WriteHead(&pproto.GateResponse{StatusCode: int32(status), Header: h}); err != nil {
+		return err
+	}
+	_, err := ex.Write([]byte(body))
+	return err
+}
+
+func get(h http.Handler, url string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCacheFresh(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Cache: &Cache{}})
+	_, calls := cachedService(t, addr, func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		if strings.HasSuffix(request.Url, "/private") {
+			return respond(ex, 200, "mine", "Cache-Control", "private, max-age=60")
+		}
+		return respond(ex, 200, request.Url, "Cache-Control", "max-age=60")
+	})
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	w := get(h, "http://api.gate.test/a")
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	w = get(h, "http://api.gate.test/a")
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "http://api.gate.test/a", w.Body.String())
+	assert.Equal(t, "max-age=60", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "0", w.Header().Get("Age"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(calls))
+
+	// callers may ask for a fresh one
+	get(h, "http://api.gate.test/a", "Cache-Control", "no-cache")
+	assert.EqualValues(t, 2, atomic.LoadInt32(calls))
+	// other urls and private responses are apart
+	get(h, "http://api.gate.test/b")
+	get(h, "http://api.gate.test/private")
+	w = get(h, "http://api.gate.test/private")
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	assert.EqualValues(t, 5, atomic.LoadInt32(calls))
+
+	stats := h.cache("api").stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.EqualValues(t, 1, stats.Hits)
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Cache: &Cache{}})
+	_, calls := cachedService(t, addr, func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		if pproto.FromGateHeader(request.Header).Get("If-None-Match") == `"v1"` {
+			return respond(ex, 304, "", "ETag", `"v1"`, "X-Checked", "yes")
+		}
+		return respond(ex, 200, "body", "ETag", `"v1"`, "Cache-Control", "no-cache")
+	})
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	w := get(h, "http://api.gate.test/")
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	w = get(h, "http://api.gate.test/")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "REVALIDATED", w.Header().Get("X-Cache"))
+	assert.Equal(t, "body", w.Body.String())
+	assert.Equal(t, "yes", w.Header().Get("X-Checked"))
+	assert.EqualValues(t, 2, atomic.LoadInt32(calls))
+
+	// conditionals of the caller are passed through
+	w = get(h, "http://api.gate.test/", "If-None-Match", `"v1"`)
+	assert.Equal(t, 304, w.Code)
+}
+
+func TestCacheVary(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Cache: &Cache{}})
+	_, calls := cachedService(t, addr, func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		lang := pproto.FromGateHeader(request.Header).Get("Accept-Language")
+		return respond(ex, 200, "hello "+lang, "Cache-Control", "max-age=60", "Vary", "Accept-Language")
+	})
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	get(h, "http://api.gate.test/", "Accept-Language", "en")
+	get(h, "http://api.gate.test/", "Accept-Language", "de")
+	w := get(h, "http://api.gate.test/", "Accept-Language", "en")
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "hello en", w.Body.String())
+	w = get(h, "http://api.gate.test/", "Accept-Language", "de")
+	assert.Equal(t, "hello de", w.Body.String())
+	assert.EqualValues(t, 2, atomic.LoadInt32(calls))
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Services: map[string]*ServiceConfig{"api": {Cache: &Cache{StaleIfError: 60}}}})
+	c, _ := cachedService(t, addr, func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		return respond(ex, 200, "kept", "Cache-Control", "max-age=0", "ETag", `"x"`)
+	})
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	get(h, "http://api.gate.test/")
+
+	// the service is gone
+	c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 0 }, 2*time.Second, 10*time.Millisecond)
+	w := get(h, "http://api.gate.test/")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "STALE", w.Header().Get("X-Cache"))
+	assert.Equal(t, "kept", w.Body.String())
+	assert.EqualValues(t, 1, h.cache("api").stats().Stale)
+
+	// not for urls which were not stored
+	w = get(h, "http://api.gate.test/other")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestCacheUnknownService(t *testing.T) {
+	_, h, _ := startGate(t)
+	dir := t.TempDir()
+	h.SetConfig(&Config{Cache: &Cache{Storage: "disk", Dir: dir}})
+
+	// names of the Host header which are neither configured nor connected open nothing
+	assert.Equal(t, http.StatusInternalServerError, get(h, "http://random.gate.test/").Code)
+	assert.Equal(t, http.StatusNotFound, get(h.Admin(), "/services/random/cache").Code)
+	assert.Empty(t, h.caches)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	// configured ones have it before their client connects
+	h.SetConfig(&Config{Cache: &Cache{}, Services: map[string]*ServiceConfig{"api": {}}})
+	assert.NotNil(t, h.cache("api"))
+}
+
+func TestCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newResponseCache("api", &Cache{Storage: "disk", Dir: dir})
+	require.NoError(t, err)
+	header := http.Header{"Vary": {"Accept"}, "Cache-Control": {"max-age=60"}}
+	c.store.put(&cacheEntry{Key: "k1", Primary: "api.gate.test /a", Vary: []string{"Accept"}, Status: 200, Header: header, Stored: time.Now(), Body: []byte("one")})
+	c.store.put(&cacheEntry{Key: "k2", Primary: "api.gate.test /b", Status: 200, Header: header, Stored: time.Now(), Body: []byte("two")})
+
+	// entries are taken over on reopen, temp files of cut puts are removed
+	require.NoError(t, os.WriteFile(filepath.Join(storeDir(dir, "api"), "put-123"), []byte("partial"), 0600))
+	c, err = newResponseCache("api", &Cache{Storage: "disk", Dir: dir})
+	require.NoError(t, err)
+	e := c.store.get("k1")
+	require.NotNil(t, e)
+	assert.Equal(t, "one", string(e.Body))
+	assert.Equal(t, "max-age=60", e.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"Accept"}, c.vary["api.gate.test /a"])
+	assert.NoFileExists(t, filepath.Join(storeDir(dir, "api"), "put-123"))
+
+	assert.Equal(t, 1, c.purge("/a"))
+	assert.Nil(t, c.store.get("k1"))
+	n, _ := c.store.stats()
+	assert.Equal(t, 1, n)
+
+	// the oldest go over the size
+	s, err := newDiskStore(t.TempDir(), 300)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		s.put(&cacheEntry{Key: fmt.Sprint(i), Status: 200, Body: make([]byte, 100)})
+	}
+	assert.Nil(t, s.get("0"))
+	assert.NotNil(t, s.get("4"))
+}
+
+func TestCacheMemoryLRU(t *testing.T) {
+	s := newMemoryStore(250)
+	for i := 0; i < 3; i++ {
+		s.put(&cacheEntry{Key: fmt.Sprint(i), Body: make([]byte, 100)})
+		s.get("0")
+	}
+	assert.NotNil(t, s.get("0"))
+	assert.Nil(t, s.get("1"))
+	assert.NotNil(t, s.get("2"))
+}
+
+func TestStorable(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	ok := func(h ...string) bool {
+		header := http.Header{}
+		for i := 0; i < len(h); i += 2 {
+			header.Add(h[i], h[i+1])
+		}
+		return storable(r, 200, header)
+	}
+	assert.True(t, ok("Cache-Control", "max-age=10"))
+	assert.True(t, ok("Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)))
+	assert.True(t, ok("ETag", `"a"`))
+	assert.False(t, ok())
+	assert.False(t, ok("Cache-Control", "no-store, max-age=10"))
+	assert.False(t, ok("Cache-Control", "max-age=10", "Set-Cookie", "a=b"))
+	assert.False(t, ok("Cache-Control", "max-age=10", "Vary", "*"))
+	r.Header.Set("Authorization", "Bearer x")
+	assert.False(t, ok("Cache-Control", "max-age=10"))
+	assert.True(t, ok("Cache-Control", "public, max-age=10"))
+}
+
+func TestCacheAdmin(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Cache: &Cache{}})
+	cachedService(t, addr, func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		return respond(ex, 200, "x", "Cache-Control", "max-age=60")
+	})
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	get(h, "http://api.gate.test/static/a")
+	get(h, "http://api.gate.test/static/b")
+	get(h, "http://api.gate.test/page")
+
+	admin := h.Admin()
+	w := get(admin, "/services/api/cache")
+	var stats CacheStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, 3, stats.Entries)
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/services/api/cache?prefix=/static/", nil))
+	assert.JSONEq(t, `{"purged":2}`, w.Body.String())
+	assert.Equal(t, "MISS", get(h, "http://api.gate.test/static/a").Header().Get("X-Cache"))
+	assert.Equal(t, "HIT", get(h, "http://api.gate.test/page").Header().Get("X-Cache"))
+
+	h.SetConfig(&Config{})
+	assert.Equal(t, http.StatusNotFound, get(admin, "/services/api/cache").Code)
+}
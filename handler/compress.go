@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compression compresses responses of services to callers which accept gzip or deflate,
+// the client passes bodies as the service wrote them
+type Compression struct {
+	// Disabled turns the compression of the config off for a service
+	Disabled bool `yaml:"disabled"`
+	// Types are media types to compress, text/* takes all of text, empty - defaultCompressTypes
+	Types []string `yaml:"types"`
+	// MinSize is the least Content-Length worth compressing, 0 - 1024,
+	// responses of unknown length (streamed ones) are compressed
+	MinSize int64 `yaml:"min_size"`
+}
+
+// defaultCompressTypes are text formats which shrink well
+var defaultCompressTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/javascript",
+	"text/xml",
+	"text/csv",
+	"text/markdown",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// edgeCompressionStats is published as axgate_edge_compression in expvar
+var edgeCompressionStats = expvar.NewMap("axgate_edge_compression")
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+func (c *Compression) validate() error {
+	if c.MinSize < 0 {
+		return fmt.Errorf("negative min_size")
+	}
+	for _, t := range c.Types {
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return fmt.Errorf("bad type %q", t)
+		}
+	}
+	return nil
+}
+
+// allows tells if bodies of the content type are compressed
+func (c *Compression) allows(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := c.Types
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Compression) minSize() int64 {
+	if c.MinSize == 0 {
+		return 1024
+	}
+	return c.MinSize
+}
+
+// compression returns the compression of the service, nil if it has none
+func (h *Handler) compression(name string) *Compression {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	c := h.config.Compression
+	if s := h.config.Services[name]; s != nil && s.Compression != nil {
+		c = s.Compression
+	}
+	if c == nil || c.Disabled {
+		return nil
+	}
+	return c
+}
+
+// acceptedEncoding picks gzip or deflate by Accept-Encoding, empty if neither is accepted
+func acceptedEncoding(accept string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params := part, ""
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			name, params = part[:i], part[i+1:]
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		value := 1.0
+		for _, p := range strings.Split(params, ";") {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					value = f
+				}
+			}
+		}
+		q[name] = value
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range []string{"gzip", "deflate"} {
+		v, ok := q[enc]
+		if !ok {
+			v = q["*"]
+		}
+		if v > bestQ {
+			best, bestQ = enc, v
+		}
+	}
+	return best
+}
+
+// compressWriter compresses the response if its head allows
+type compressWriter struct {
+	http.ResponseWriter
+	config   *Compression
+	encoding string // accepted by the caller
+
+	wrote bool           // the final head
+	zw    io.WriteCloser // nil - the body goes as is
+	raw   int64
+	out   *countingWriter
+}
+
+// compressor wraps w if the service has compression, nil otherwise.
+// Close the writer after the response.
+func (h *Handler) compressor(name string, w http.ResponseWriter, r *http.Request) *compressWriter {
+	c := h.compression(name)
+	if c == nil || r.Method == "HEAD" {
+		return nil
+	}
+	// callers without compression get the writer too, it sets Vary for caches
+	return &compressWriter{ResponseWriter: w, config: c, encoding: acceptedEncoding(r.Header.Get("Accept-Encoding"))}
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wrote || code < 200 {
+		// informational heads go as they are, the final one follows
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wrote = true
+	if w.eligible(code) {
+		w.start()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// eligible tells if the response may be compressed, Vary is set for the ones which could be
+func (w *compressWriter) eligible(code int) bool {
+	switch code {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	header := w.Header()
+	if ce := header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	if !w.config.allows(header.Get("Content-Type")) {
+		return false
+	}
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if cl := header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n < w.config.minSize() {
+			return false
+		}
+	}
+	if !headerHasToken(header, "Vary", "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	return w.encoding != ""
+}
+
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// start sets the head of the compressed response and the compressor of its body
+func (w *compressWriter) start() {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", w.encoding)
+	// the body is not the one the strong validator stands for
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	w.out = &countingWriter{w: w.ResponseWriter}
+	if w.encoding == "gzip" {
+		zw := gzipWriters.Get().(*gzip.Writer)
+		zw.Reset(w.out)
+		w.zw = zw
+	} else {
+		zw := zlibWriters.Get().(*zlib.Writer)
+		zw.Reset(w.out)
+		w.zw = zw
+	}
+	edgeCompressionStats.Add("responses_"+w.encoding, 1)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.zw == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	w.raw += int64(len(p))
+	return w.zw.Write(p)
+}
+
+// Flush sends what is compressed so far
+func (w *compressWriter) Flush() {
+	if f, ok := w.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close ends the compressed body
+func (w *compressWriter) Close() error {
+	if w.zw == nil {
+		return nil
+	}
+	err := w.zw.Close()
+	edgeCompressionStats.Add("raw_bytes", w.raw)
+	edgeCompressionStats.Add("compressed_bytes", w.out.n)
+	switch zw := w.zw.(type) {
+	case *gzip.Writer:
+		zw.Reset(nil)
+		gzipWriters.Put(zw)
+	case *zlib.Writer:
+		zw.Reset(nil)
+		zlibWriters.Put(zw)
+	}
+	w.zw = nil
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
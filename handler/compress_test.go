@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	for accept, enc := range map[string]string{
+		"":                        "",
+		"gzip, deflate, br":       "gzip",
+		"deflate":                 "deflate",
+		"gzip;q=0.5, deflate":     "deflate",
+		"gzip;q=0, *":             "deflate",
+		"*":                       "gzip",
+		"br, identity":            "",
+		"GZIP ; q=1":              "gzip",
+		"gzip;q=0, deflate;q=0.0": "",
+	} {
+		assert.Equal(t, enc, acceptedEncoding(accept), accept)
+	}
+}
+
+func TestCompressionAllows(t *testing.T) {
+	c := &Compression{}
+	assert.True(t, c.allows("text/html; charset=utf-8"))
+	assert.True(t, c.allows("Application/JSON"))
+	assert.False(t, c.allows("image/png"))
+	assert.False(t, c.allows("text/event-stream"))
+	assert.False(t, c.allows(""))
+	c.Types = []string{"text/*"}
+	assert.True(t, c.allows("text/event-stream"))
+	assert.False(t, c.allows("application/json"))
+	assert.Error(t, (&Compression{MinSize: -1}).validate())
+	assert.Error(t, (&Compression{Types: []string{"text/"}}).validate())
+}
+
+func TestCompression(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{
+		Compression: &Compression{},
+		Services:    map[string]*ServiceConfig{"raw": {Compression: &Compression{Disabled: true}}},
+	})
+	page := strings.Repeat("<p>hello</p>", 200)
+	serve := func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		switch {
+		case strings.HasSuffix(request.Url, "/small"):
+			return respond(ex, 200, "tiny", "Content-Type", "text/html", "Content-Length", "4")
+		case strings.HasSuffix(request.Url, "/png"):
+			return respond(ex, 200, page, "Content-Type", "image/png")
+		case strings.HasSuffix(request.Url, "/encoded"):
+			return respond(ex, 200, page, "Content-Type", "text/html", "Content-Encoding", "br")
+		}
+		return respond(ex, 200, page, "Content-Type", "text/html", "Content-Length", strconv.Itoa(len(page)), "ETag", `"p1"`)
+	}
+	c := tcp.NewMultiClient(addr)
+	c.Add("api", serve)
+	c.Add("raw", serve)
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	w := get(h, "http://api.gate.test/", "Accept-Encoding", "gzip, deflate")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Empty(t, w.Header().Get("Content-Length"))
+	assert.Equal(t, `W/"p1"`, w.Header().Get("ETag"))
+	assert.Less(t, w.Body.Len(), len(page))
+	zr, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	b, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(b))
+
+	w = get(h, "http://api.gate.test/", "Accept-Encoding", "deflate")
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	zr2, err := zlib.NewReader(w.Body)
+	require.NoError(t, err)
+	b, err = io.ReadAll(zr2)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(b))
+
+	// callers without compression get the body as it is, caches are told it varies
+	w = get(h, "http://api.gate.test/")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, page, w.Body.String())
+
+	for _, path := range []string{"/small", "/png", "/encoded"} {
+		w = get(h, "http://api.gate.test"+path, "Accept-Encoding", "gzip")
+		assert.NotEqual(t, "gzip", w.Header().Get("Content-Encoding"), path)
+	}
+	w = get(h, "http://raw.gate.test/", "Accept-Encoding", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, page, w.Body.String())
+}
+
+func TestCompressionStreaming(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Compression: &Compression{Types: []string{"text/event-stream"}}})
+	next := make(chan struct{})
+	c := tcp.NewMultiClient(addr)
+	c.Add("api", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		err := ex.WriteHead(&pproto.GateResponse{StatusCode: 200, Header: []*pproto.GateHeader{{Key: "Content-Type", Values: []string{"text/event-stream"}}}})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := ex.Write([]byte("data: " + strconv.Itoa(i) + "\n\n")); err != nil {
+				return err
+			}
+			<-next
+		}
+		return nil
+	})
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go h.Serve(l)
+	defer h.Close()
+
+	rq, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+	rq.Host = "api.gate.test"
+	rq.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(rq)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	zr, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	// each event comes through before the stream ends
+	events := bufio.NewReader(zr)
+	for i := 0; i < 2; i++ {
+		line, err := events.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "data: "+strconv.Itoa(i)+"\n", line)
+		events.ReadString('\n')
+		next <- struct{}{}
+	}
+	rest, err := io.ReadAll(events)
+	assert.NoError(t, err)
+	assert.Empty(t, rest)
+}
@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/axgrid/axgate/rewrite"
+	"github.com/axgrid/axgate/tracing"
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+// Config is the gate configuration loaded from a yaml file
+type Config struct {
+	// Limits apply to every service which has no limits of its own
+	Limits *Limits `yaml:"limits"`
+	// Access applies to every service which has no access of its own
+	Access   *Access                   `yaml:"access"`
+	Services map[string]*ServiceConfig `yaml:"services"`
+	// body sizes in bytes, 0 - unlimited, larger requests get 413
+	MaxRequestBody  int64 `yaml:"max_request_body"`
+	MaxResponseBody int64 `yaml:"max_response_body"`
+	// biggest packet accepted from clients, 0 - 64MiB
+	MaxFrameSize int `yaml:"max_frame_size"`
+	// Webhooks get events of the gate
+	Webhooks []*Webhook `yaml:"webhooks"`
+	// AccessLog gets a record per request to a service, nil - no access log
+	AccessLog *AccessLog `yaml:"access_log"`
+	// Tracing exports a span per request to a service, nil - no tracing
+	Tracing *tracing.Config `yaml:"tracing"`
+	// Cache applies to every service which has no cache of its own, nil - no cache
+	Cache *Cache `yaml:"cache"`
+	// Compression applies to every service which has no compression of its own, nil - none
+	Compression *Compression `yaml:"compression"`
+}
+
+// ServiceConfig overrides the defaults for one service
+type ServiceConfig struct {
+	Limits      *Limits        `yaml:"limits"`
+	Access      *Access        `yaml:"access"`
+	Rewrite     *rewrite.Rules `yaml:"rewrite"`
+	Cache       *Cache         `yaml:"cache"`
+	Compression *Compression   `yaml:"compression"`
+	Mirror      *Mirror        `yaml:"mirror"`
+	// Priority weights bodies of the service against other streams of its connection, 1-256, 0 - 16
+	Priority uint32 `yaml:"priority"`
+}
+
+// LoadConfig reads the yaml config from path
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res Config
+	if err = yaml.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	if err = res.validate(); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// validate checks the config, parses its access networks and compiles its rewrite rules
+func (c *Config) validate() (err error) {
+	if c.Limits != nil {
+		if err = c.Limits.validate(); err != nil {
+			return fmt.Errorf("limits: %w", err)
+		}
+	}
+	if c.Access != nil {
+		if err = c.Access.compile(); err != nil {
+			return fmt.Errorf("access: %w", err)
+		}
+	}
+	if c.AccessLog != nil {
+		if err = c.AccessLog.validate(); err != nil {
+			return fmt.Errorf("access_log: %w", err)
+		}
+	}
+	if c.Tracing != nil && c.Tracing.Endpoint == "" {
+		return fmt.Errorf("tracing: no endpoint")
+	}
+	if c.Cache != nil {
+		if err = c.Cache.validate(); err != nil {
+			return fmt.Errorf("cache: %w", err)
+		}
+	}
+	if c.Compression != nil {
+		if err = c.Compression.validate(); err != nil {
+			return fmt.Errorf("compression: %w", err)
+		}
+	}
+	for i, w := range c.Webhooks {
+		if err = w.validate(); err != nil {
+			return fmt.Errorf("webhook %d: %w", i, err)
+		}
+	}
+	for name, s := range c.Services {
+		if s != nil && s.Limits != nil {
+			if err = s.Limits.validate(); err != nil {
+				return fmt.Errorf("service %s limits: %w", name, err)
+			}
+		}
+		if s != nil && s.Access != nil {
+			if err = s.Access.compile(); err != nil {
+				return fmt.Errorf("service %s access: %w", name, err)
+			}
+		}
+		if s != nil && s.Cache != nil {
+			if err = s.Cache.validate(); err != nil {
+				return fmt.Errorf("service %s cache: %w", name, err)
+			}
+		}
+		if s != nil && s.Compression != nil {
+			if err = s.Compression.validate(); err != nil {
+				return fmt.Errorf("service %s compression: %w", name, err)
+			}
+		}
+		if s != nil && s.Priority > 256 {
+			return fmt.Errorf("service %s priority %d is out of 1-256", name, s.Priority)
+		}
+		if s != nil && s.Mirror != nil {
+			if err = s.Mirror.validate(); err != nil {
+				return fmt.Errorf("service %s mirror: %w", name, err)
+			}
+			if s.Mirror.Service == name {
+				return fmt.Errorf("service %s mirror: the service itself", name)
+			}
+		}
+		if s != nil && s.Rewrite != nil {
+			if err = s.Rewrite.Compile(); err != nil {
+				return fmt.Errorf("service %s rewrite: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SetConfig replaces the gate configuration, nil resets it
+func SetConfig(c *Config) error {
+	return std.SetConfig(c)
+}
+
+// SetConfig replaces the configuration of the handler and its gate server, nil resets it.
+// A bad config is refused, the one in effect stays.
+func (h *Handler) SetConfig(c *Config) error {
+	if c == nil {
+		c = &Config{}
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	// outputs of the config are opened before it applies
+	var sink *AccessLogger
+	if c.AccessLog != nil {
+		l, err := OpenAccessLog(c.AccessLog)
+		if err != nil {
+			return fmt.Errorf("access_log: %w", err)
+		}
+		sink = l
+	}
+	var spans *tracing.Tracer
+	if c.Tracing != nil {
+		t, err := tracing.New(c.Tracing)
+		if err != nil {
+			if sink != nil {
+				sink.Close()
+			}
+			return fmt.Errorf("tracing: %w", err)
+		}
+		spans = t
+	}
+	h.lock.Lock()
+	h.config = c
+	h.caches, h.mirrors = nil, nil
+	if h.stopHooks != nil {
+		h.stopHooks()
+	}
+	h.stopHooks = h.startWebhooks(c.Webhooks)
+	if sink != nil {
+		h.setSink(sink, true)
+	} else if h.sinkOpened {
+		h.setSink(nil, false)
+	}
+	if h.spans != nil {
+		// flushing may wait for the collector
+		go h.spans.Close()
+	}
+	h.spans = spans
+	h.lock.Unlock()
+	h.limiter.reset()
+	h.gate.SetMaxFrameSize(c.MaxFrameSize)
+	return nil
+}
+
+// serviceConfig returns the configuration of the service, nil if there is none
+func (h *Handler) serviceConfig(name string) *ServiceConfig {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.config.Services[name]
+}
+
+func (h *Handler) defaultLimits() *Limits {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.config.Limits
+}
+
+func (h *Handler) defaultAccess() *Access {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.config.Access
+}
+
+func (h *Handler) maxBodies() (request int64, response int64) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.config.MaxRequestBody, h.config.MaxResponseBody
+}
+
+func (h *Handler) tracer() *tracing.Tracer {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.spans
+}
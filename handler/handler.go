@@ -2,24 +2,78 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	_ "embed"
+	"errors"
 	"fmt"
 	pproto "github.com/axgrid/axgate/proto"
 	"github.com/axgrid/axgate/tcp"
+	"github.com/axgrid/axgate/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //go:embed "template/index.gohtml"
 var index []byte
 
-func NewHandler(httpAddress string, hosts []string, verbose bool) error {
+// Handler is the http front of a gate server, it sends requests
+// for <service>.<host> to the service and lists services on <host>.
+// Mount it in a router or run it with Serve.
+type Handler struct {
+	gate    *tcp.Server
+	hosts   []string
+	matcher *regexp.Regexp
+	router  http.Handler
+	limiter *rateLimiter
+
+	lock       sync.RWMutex
+	config     *Config
+	trusted    []*net.IPNet // proxies in front of the gate whose forwarding headers are kept
+	stopHooks  func()       // stops webhooks of the config
+	sink       AccessSink
+	sinkOpened bool // the sink is opened from the config, it is closed with it
+	spans      *tracing.Tracer
+	caches     map[string]*responseCache // by service, nil for services without cache
+	mirrors    map[string]*mirrorState   // by service, nil for services without mirror
+	// access asked by services in their handshakes, by service
+	clientPolicies map[string]*policy
+
+	verifiedLock sync.Mutex
+	verified     map[[sha256.Size]byte]bool // passwords which matched their hashes
+
+	serverOnce sync.Once
+	server     *http.Server
+}
+
+// std is the handler of the package functions, it fronts tcp.DefaultServer
+var std = newHandler(tcp.DefaultServer)
+
+func newHandler(gate *tcp.Server) *Handler {
+	return &Handler{gate: gate, config: &Config{}, limiter: newRateLimiter()}
+}
+
+// New makes the front of the gate for the host names, it logs with the gate logger
+func New(gate *tcp.Server, hosts []string, verbose bool) (*Handler, error) {
+	h := newHandler(gate)
+	if err := h.route(hosts, verbose); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Handler) route(hosts []string, verbose bool) error {
 	var stringHost string
 	if len(hosts) == 1 {
 		stringHost = regexp.QuoteMeta(hosts[0])
@@ -36,32 +90,141 @@ func NewHandler(httpAddress string, hosts []string, verbose bool) error {
 	if err != nil {
 		return err
 	}
+	h.hosts, h.matcher = hosts, hostMatcher
 	r := chi.NewRouter()
-	level := zerolog.InfoLevel
+	// requests to services go to the access log, this one is for the rest
+	level := zerolog.ErrorLevel
 	if verbose {
-		level = zerolog.ErrorLevel
+		level = zerolog.InfoLevel
 	}
-	httpLogger := log.With().Str("service", "http").Logger().Level(level)
+	httpLogger := h.log().With().Str("service", "http").Logger().Level(level)
 	r.Use(httplog.RequestLogger(httpLogger))
 	r.HandleFunc("/*", func(w http.ResponseWriter, r *http.Request) {
-		matches := hostMatcher.FindStringSubmatch(r.Host)
+		matches := h.matcher.FindStringSubmatch(r.Host)
 		if len(matches) == 0 {
-			root(w, r, hosts[0])
+			h.root(w, r, h.hosts[0])
 		} else {
-			err := service(matches[1], w, r)
+			start := time.Now()
+			// the service, logs and the caller see the same id
+			id := pproto.RequestID(r)
+			r.Header.Set(pproto.RequestIDHeader, id)
+			w.Header().Set(pproto.RequestIDHeader, id)
+			aw := &accessWriter{ResponseWriter: w}
+			aw.record.User, _, _ = r.BasicAuth()
+			aw.record.RequestID = id
+			span := h.tracer().Start("gate "+matches[1], tracing.Server, tracing.FromHeader(r.Header))
+			if span != nil {
+				span.SetAttr("http.request.method", r.Method)
+				span.SetAttr("url.path", r.URL.Path)
+				span.SetAttr("server.address", r.Host)
+				span.SetAttr("axgate.request_id", id)
+				r = r.WithContext(tracing.WithSpan(r.Context(), span))
+			}
+			err := h.service(matches[1], aw, r)
 			if err != nil {
-				w.WriteHeader(500)
-				w.Write(([]byte)("500 internal server error: " + err.Error()))
+				h.requestError(matches[1], r, http.StatusInternalServerError, err.Error())
+				aw.WriteHeader(500)
+				aw.Write(([]byte)("500 internal server error: " + err.Error()))
+			}
+			h.logAccess(matches[1], aw, r, start)
+			if span != nil {
+				span.SetAttr("http.response.status_code", aw.record.Status)
+				if aw.record.Status >= 500 {
+					span.SetError(http.StatusText(aw.record.Status))
+				}
+				span.Finish()
 			}
 		}
 	})
-	log.Info().Str("address", httpAddress).Msg("start http-listener")
-	return http.ListenAndServe(httpAddress, r)
+	h.router = r
+	return nil
+}
+
+func (h *Handler) log() *zerolog.Logger {
+	return h.gate.Logger()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.router.ServeHTTP(w, r)
+}
+
+// httpServer serves the handler over HTTP/1.1 and h2c
+func (h *Handler) httpServer() *http.Server {
+	h.serverOnce.Do(func() {
+		h.server = &http.Server{
+			Handler:   h,
+			Protocols: new(http.Protocols),
+		}
+		// HTTP/2 without TLS (h2c with prior knowledge) is what plaintext gRPC clients speak
+		h.server.Protocols.SetHTTP1(true)
+		h.server.Protocols.SetUnencryptedHTTP2(true)
+	})
+	return h.server
+}
+
+// Serve accepts http connections on l until Close
+func (h *Handler) Serve(l net.Listener) error {
+	h.log().Info().Str("address", l.Addr().String()).Msg("start http-listener")
+	return h.httpServer().Serve(l)
+}
+
+// Close stops Serve and drops its connections, stops webhooks, tracing and the access log
+// of the config, the gate server is left running
+func (h *Handler) Close() error {
+	err := h.httpServer().Close()
+	h.lock.Lock()
+	if h.stopHooks != nil {
+		h.stopHooks()
+		h.stopHooks = nil
+	}
+	spans := h.spans
+	h.spans = nil
+	if h.sinkOpened {
+		h.setSink(nil, false)
+	}
+	h.lock.Unlock()
+	// flushing may wait for the collector, requests are not held by it
+	spans.Close()
+	return err
+}
+
+// SetTrustedProxies sets networks (or addresses) of the proxies in front of the gate
+func SetTrustedProxies(list []string) error {
+	return std.SetTrustedProxies(list)
+}
+
+// SetTrustedProxies sets networks (or addresses) of the proxies in front of the gate
+func (h *Handler) SetTrustedProxies(list []string) error {
+	trusted, err := pproto.ParseTrustedProxies(list)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.trusted = trusted
+	h.lock.Unlock()
+	return nil
+}
+
+func (h *Handler) trustedProxies() []*net.IPNet {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.trusted
 }
 
-func root(w http.ResponseWriter, r *http.Request, host string) {
+func NewHandler(httpAddress string, hosts []string, verbose bool) error {
+	if err := std.route(hosts, verbose); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", httpAddress)
+	if err != nil {
+		return err
+	}
+	return std.Serve(l)
+}
+
+func (h *Handler) root(w http.ResponseWriter, r *http.Request, host string) {
 	var res []*Info
-	for _, name := range tcp.GetServicesNames() {
+	for _, name := range h.gate.Names() {
 		res = append(res, &Info{
 			Name: name,
 			Url:  fmt.Sprintf("http://%s.%s", name, host),
@@ -77,18 +240,269 @@ func root(w http.ResponseWriter, r *http.Request, host string) {
 	w.Write(b)
 }
 
-func service(name string, w http.ResponseWriter, r *http.Request) (err error) {
-	rq, err := pproto.NewGateRequest(r)
+func (h *Handler) service(name string, w http.ResponseWriter, r *http.Request) (err error) {
+	ip := h.clientIP(r)
+	limits := h.limits(name)
+	if retry, ok := h.limiter.allow(name, limits, ip, r.URL.Path, time.Now()); !ok {
+		tooManyRequests(w, retry)
+		return nil
+	}
+	// limits go first, they keep floods of bad passwords off bcrypt
+	if !h.authorize(name, w, r, ip) {
+		return nil
+	}
+	maxInFlight := 0
+	if limits != nil {
+		maxInFlight = limits.MaxInFlight
+	}
+	release, ok := h.gate.Acquire(name, maxInFlight)
+	if !ok {
+		h.limiter.reject(name, rejectInFlight)
+		tooManyRequests(w, time.Second)
+		return nil
+	}
+	defer release()
+	if cw := h.compressor(name, w, r); cw != nil {
+		defer cw.Close()
+		w = cw
+	}
+	maxRequest, maxResponse := h.maxBodies()
+	if maxRequest > 0 && r.ContentLength > maxRequest {
+		http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	rq := pproto.NewGateRequestHead(r)
 	rq.Name = name
+	if c := h.serviceConfig(name); c != nil {
+		rq.Priority = c.Priority
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	rq.SetForwarded(scheme, h.trustedProxies())
+	rules := h.serviceRules(name)
+	if rules != nil {
+		h.rewriteRequest(rules, rq)
+	}
+	cached, done := h.lookupCache(name, w, r, rq)
+	if done {
+		return nil
+	}
+	mirror := h.mirror(name, rq)
+	var body io.Reader
+	var limited *limitedBody
+	if b := pproto.NewRequestBody(r); b != nil {
+		// the response may start before the body ends (tcp tunnels, bidirectional streams)
+		http.NewResponseController(w).EnableFullDuplex()
+		body = b
+		if maxRequest > 0 {
+			limited = &limitedBody{body: b, left: maxRequest}
+			body = limited
+		}
+		body = mirror.tee(body)
+	}
+	rec := accessRecord(w)
+	// the tunnel span is the parent of the client one
+	tunnel := tracing.SpanFrom(r.Context()).Child("tunnel "+name, tracing.Client)
+	if tunnel != nil {
+		header := pproto.FromGateHeader(rq.Header)
+		tunnel.Context.Inject(header)
+		rq.Header = pproto.ToGateHeader(header)
+		defer tunnel.Finish()
+	}
+	sent := time.Now()
+	st, err := h.gate.Send(rq, body)
+	if errors.Is(err, tcp.ErrBodyTooLarge) {
+		http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
 	if err != nil {
+		tunnel.SetError(err.Error())
+		if cached.serveStale(w, r) {
+			return nil
+		}
 		return err
 	}
-	c, err := tcp.Send(rq)
+	defer st.Close()
+	// the caller went away: stop reading the stream, the client is told to cancel
+	stop := context.AfterFunc(r.Context(), func() { st.Close() })
+	defer stop()
+	rs, err := st.Response(r.Context())
 	if err != nil {
+		if r.Context().Err() != nil {
+			return nil
+		}
+		if limited.exceeded() {
+			// the body was cut, the stream is canceled before the client answered
+			http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		tunnel.SetError(err.Error())
+		if cached.serveStale(w, r) {
+			return nil
+		}
 		return err
 	}
-	rs := <-c
-	return rs.ToHttp(w)
+	head := time.Now()
+	h.sendMirror(mirror, int(rs.StatusCode), head.Sub(sent))
+	if rec != nil {
+		rec.Upstream = time.Duration(rs.UpstreamTime)
+		rec.Tunnel = head.Sub(sent) - rec.Upstream
+	}
+	if tunnel != nil {
+		tunnel.SetAttr("http.response.status_code", rs.StatusCode)
+		if rs.UpstreamTime > 0 {
+			// the client tells only how long it took, it is put in the middle of the round trip
+			upstream := time.Duration(rs.UpstreamTime)
+			at := sent.Add((head.Sub(sent) - upstream) / 2)
+			tunnel.ChildAt("upstream "+name, tracing.Internal, at).FinishAt(at.Add(upstream))
+		}
+		tunnel.FinishAt(head)
+	}
+	if maxResponse > 0 && (rs.ContentLength > maxResponse || int64(len(rs.Body)) > maxResponse) {
+		h.log().Warn().Str("service", name).Str("request-id", rq.RequestId).Int64("length", rs.ContentLength).Msg("response is too large")
+		h.requestError(name, r, http.StatusBadGateway, "response is too large")
+		http.Error(w, "502 bad gateway: response is too large", http.StatusBadGateway)
+		return nil
+	}
+	if rules != nil {
+		rewriteResponse(rules, rs)
+	}
+	// the caller has the id from the gate, an echo of the service would double it
+	for i, hd := range rs.Header {
+		if strings.EqualFold(hd.Key, pproto.RequestIDHeader) {
+			rs.Header = append(rs.Header[:i:i], rs.Header[i+1:]...)
+			break
+		}
+	}
+	if cached.revalidated(w, r, rs) {
+		return nil
+	}
+	if rs.StatusCode >= 500 && cached.serveStale(w, r) {
+		return nil
+	}
+	var responseBody io.Reader = st
+	recorder := cached.recorder(r, rs, st)
+	if recorder != nil {
+		responseBody = recorder
+	}
+	if strings.HasPrefix(pproto.FromGateHeader(rs.Header).Get("Content-Type"), "text/event-stream") {
+		// proxies in front of the gate (nginx) must not buffer events
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
+	err = rs.ToHttp(w)
+	if err == nil {
+		if f, ok := w.(http.Flusher); ok && rs.Stream {
+			f.Flush()
+		}
+		limit := int64(-1)
+		if maxResponse > 0 {
+			limit = maxResponse - int64(len(rs.Body))
+		}
+		err = copyFlush(w, responseBody, limit)
+		if errors.Is(err, errResponseTooLarge) {
+			// the head is out already, only a broken response tells the caller it is cut
+			h.log().Warn().Str("service", name).Str("request-id", rq.RequestId).Msg("response is too large")
+			h.requestError(name, r, http.StatusBadGateway, "response is too large")
+			st.Close()
+			abort(w)
+			return nil
+		}
+		pproto.WriteTrailer(w, st.Trailer())
+		if err == nil {
+			cached.store(r, recorder, st.Trailer())
+		}
+	}
+	if err != nil {
+		h.log().Debug().Err(err).Str("service", name).Str("request-id", rq.RequestId).Msg("fail to write response")
+	}
+	return nil
+}
+
+// requestError tells subscribers of the gate events the request failed at the gate
+func (h *Handler) requestError(name string, r *http.Request, status int, reason string) {
+	h.gate.Events.Publish(tcp.Event{
+		Type:      tcp.EventRequestError,
+		Service:   name,
+		RequestID: r.Header.Get(pproto.RequestIDHeader),
+		Method:    r.Method,
+		URL:       r.URL.RequestURI(),
+		Status:    status,
+		Reason:    reason,
+	})
+}
+
+var errResponseTooLarge = errors.New("response is too large")
+
+// copyFlush copies the body flushing every chunk as it arrives,
+// so streamed responses (gRPC, events) are not held in buffers.
+// limit >= 0 is the most bytes to copy, errResponseTooLarge if there is more.
+func copyFlush(w http.ResponseWriter, r io.Reader, limit int64) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if limit >= 0 {
+			if int64(n) > limit {
+				w.Write(buf[:limit])
+				return errResponseTooLarge
+			}
+			limit -= int64(n)
+		}
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// abort breaks the response so the caller does not take it as complete:
+// HTTP/1 connection is closed without the last chunk, HTTP/2 stream is reset
+func abort(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	if rc.SetWriteDeadline(time.Unix(1, 0)) == nil {
+		rc.Flush()
+	}
+}
+
+// limitedBody is a request body which fails with tcp.ErrBodyTooLarge past its size
+type limitedBody struct {
+	body *pproto.RequestBody
+	left int64
+	over int32
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.body.Read(p)
+	if int64(n) > b.left {
+		n = int(b.left)
+		b.left = 0
+		atomic.StoreInt32(&b.over, 1)
+		return n, tcp.ErrBodyTooLarge
+	}
+	b.left -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Trailer() []*pproto.GateHeader { return b.body.Trailer() }
+
+// exceeded tells if the body was bigger than allowed, b may be nil
+func (b *limitedBody) exceeded() bool {
+	return b != nil && atomic.LoadInt32(&b.over) == 1
 }
 
 func render(templateByte []byte, data interface{}) ([]byte, error) {
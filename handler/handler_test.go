@@ -0,0 +1,152 @@
+package handler
+
+import (
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/axgrid/axgate/tracing"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// startGate runs a gate server with its handler on loopback ports
+func startGate(t *testing.T) (*tcp.Server, *Handler, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &tcp.Server{}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	h, err := New(s, []string{"gate.test"}, false)
+	require.NoError(t, err)
+	return s, h, l.Addr().String()
+}
+
+func TestIndependentHandlers(t *testing.T) {
+	s1, h1, addr := startGate(t)
+	_, h2, _ := startGate(t)
+	c := tcp.NewMultiClient(addr)
+	c.Add("api", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		_, err := ex.Write([]byte("api"))
+		return err
+	})
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s1.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	r := chi.NewRouter()
+	r.Mount("/one", h1)
+	r.Mount("/two", h2)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "http://api.gate.test/one", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "api", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "http://api.gate.test/two", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "service api not found")
+}
+
+func TestHandlerServe(t *testing.T) {
+	_, h, _ := startGate(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- h.Serve(l) }()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	require.NoError(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, h.Close())
+	assert.ErrorIs(t, <-done, http.ErrServerClosed)
+}
+
+func TestHandlerCloseStopsWorkers(t *testing.T) {
+	before := runtime.NumGoroutine()
+	h := newHandler(&tcp.Server{})
+	require.NoError(t, h.SetConfig(&Config{
+		Webhooks:  []*Webhook{{URL: "http://127.0.0.1:1/a"}, {URL: "http://127.0.0.1:1/b"}},
+		Tracing:   &tracing.Config{Endpoint: "http://127.0.0.1:1"},
+		AccessLog: &AccessLog{Output: filepath.Join(t.TempDir(), "access.log")},
+	}))
+	assert.Greater(t, runtime.NumGoroutine(), before)
+
+	require.NoError(t, h.Close())
+	assert.Nil(t, h.accessSink())
+	assert.Nil(t, h.tracer())
+	// Eventually would count its own goroutines
+	for i := 0; i < 200 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestServicePriority(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Services: map[string]*ServiceConfig{"bulk": {Priority: 2}}})
+	priorities := make(chan uint32, 2)
+	c := tcp.NewMultiClient(addr)
+	for _, name := range []string{"api", "bulk"} {
+		c.Add(name, func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+			priorities <- request.Priority
+			return nil
+		})
+	}
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://bulk.gate.test/", nil))
+	assert.EqualValues(t, 2, <-priorities)
+	// services without config get the default of the connection
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://api.gate.test/", nil))
+	assert.EqualValues(t, 0, <-priorities)
+}
+
+func TestRequestID(t *testing.T) {
+	s, h, addr := startGate(t)
+	ids := make(chan [2]string, 2)
+	c := tcp.NewMultiClient(addr)
+	c.Add("api", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		id := pproto.FromGateHeader(request.Header).Get(pproto.RequestIDHeader)
+		ids <- [2]string{request.RequestId, id}
+		// services echoing the id do not double it
+		return ex.WriteHead(&pproto.GateResponse{StatusCode: 204, Header: []*pproto.GateHeader{{Key: pproto.RequestIDHeader, Values: []string{id}}}})
+	})
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://api.gate.test/", nil))
+	got := <-ids
+	assert.Len(t, got[0], 32)
+	assert.Equal(t, got[0], got[1])
+	assert.Equal(t, []string{got[0]}, w.Header().Values(pproto.RequestIDHeader))
+	assert.Equal(t, "api", w.Header().Get("x-gate-ref"))
+
+	r := httptest.NewRequest("GET", "http://api.gate.test/", nil)
+	r.Header.Set(pproto.RequestIDHeader, "caller-42")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, [2]string{"caller-42", "caller-42"}, <-ids)
+	assert.Equal(t, "caller-42", w.Header().Get(pproto.RequestIDHeader))
+
+	// errors of the gate carry it too
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://missing.gate.test/", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Len(t, w.Header().Get(pproto.RequestIDHeader), 32)
+}
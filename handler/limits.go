@@ -0,0 +1,349 @@
+package handler
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits protect a service from floods, zero values mean no limit
+type Limits struct {
+	Rate        float64      `yaml:"rate" json:"rate,omitempty"`   // requests per second to the service
+	Burst       int          `yaml:"burst" json:"burst,omitempty"` // default is the rate rounded up
+	IPRate      float64      `yaml:"ip_rate" json:"ip_rate,omitempty"`
+	IPBurst     int          `yaml:"ip_burst" json:"ip_burst,omitempty"`
+	Routes      []RouteLimit `yaml:"routes" json:"routes,omitempty"`
+	MaxInFlight int          `yaml:"max_in_flight" json:"max_in_flight,omitempty"` // per GateConn
+}
+
+func (l *Limits) validate() error {
+	if l.Rate < 0 || l.Burst < 0 || l.IPRate < 0 || l.IPBurst < 0 || l.MaxInFlight < 0 {
+		return fmt.Errorf("negative limit")
+	}
+	for _, r := range l.Routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("route %q: path must start with /", r.Path)
+		}
+		if r.Rate < 0 || r.Burst < 0 {
+			return fmt.Errorf("route %s: negative limit", r.Path)
+		}
+	}
+	return nil
+}
+
+// RouteLimit limits requests to paths starting with Path, the longest match wins
+type RouteLimit struct {
+	Path  string  `yaml:"path" json:"path"`
+	Rate  float64 `yaml:"rate" json:"rate"`
+	Burst int     `yaml:"burst" json:"burst,omitempty"`
+}
+
+const (
+	rejectRate     = "rate"
+	rejectIP       = "ip"
+	rejectRoute    = "route"
+	rejectInFlight = "in_flight"
+
+	sweepInterval = time.Minute
+)
+
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int, now time.Time) *bucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &bucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// wait returns how long to wait for a token, zero if there is one
+func (b *bucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+type bucketKey struct {
+	service string
+	kind    string // one of reject* reasons
+	id      string // client ip or route path
+}
+
+type rateLimiter struct {
+	lock      sync.Mutex
+	overrides map[string]*Limits
+	buckets   map[bucketKey]*bucket
+	rejected  map[string]map[string]int64
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		overrides: map[string]*Limits{},
+		buckets:   map[bucketKey]*bucket{},
+		rejected:  map[string]map[string]int64{},
+	}
+}
+
+func init() {
+	expvar.Publish("axgate_limits", expvar.Func(std.stats))
+}
+
+// limits returns the limits of the service: admin override, service config or defaults
+func (h *Handler) limits(name string) *Limits {
+	l := h.limiter
+	l.lock.Lock()
+	o := l.overrides[name]
+	l.lock.Unlock()
+	if o != nil {
+		return o
+	}
+	if c := h.serviceConfig(name); c != nil && c.Limits != nil {
+		return c.Limits
+	}
+	return h.defaultLimits()
+}
+
+// override replaces the limits of the service, nil removes the override
+func (l *rateLimiter) override(name string, limits *Limits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if limits == nil {
+		delete(l.overrides, name)
+	} else {
+		l.overrides[name] = limits
+	}
+	l.dropLocked(name)
+}
+
+// reset drops buckets of every service after the config changed
+func (l *rateLimiter) reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.buckets = map[bucketKey]*bucket{}
+}
+
+func (l *rateLimiter) dropLocked(name string) {
+	for k := range l.buckets {
+		if k.service == name {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// allow takes a token from every bucket the request falls into,
+// nothing is taken when one of them is empty
+func (l *rateLimiter) allow(name string, limits *Limits, ip, path string, now time.Time) (retry time.Duration, ok bool) {
+	if limits == nil {
+		return 0, true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweepLocked(now)
+	var buckets []*bucket
+	var reasons []string
+	if limits.Rate > 0 {
+		buckets = append(buckets, l.bucketLocked(bucketKey{name, rejectRate, ""}, limits.Rate, limits.Burst, now))
+		reasons = append(reasons, rejectRate)
+	}
+	if limits.IPRate > 0 {
+		buckets = append(buckets, l.bucketLocked(bucketKey{name, rejectIP, ip}, limits.IPRate, limits.IPBurst, now))
+		reasons = append(reasons, rejectIP)
+	}
+	if r := routeLimit(limits.Routes, path); r != nil && r.Rate > 0 {
+		buckets = append(buckets, l.bucketLocked(bucketKey{name, rejectRoute, r.Path}, r.Rate, r.Burst, now))
+		reasons = append(reasons, rejectRoute)
+	}
+	for i, b := range buckets {
+		if wait := b.wait(now); wait > 0 {
+			l.rejectLocked(name, reasons[i])
+			return wait, false
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, true
+}
+
+func (l *rateLimiter) bucketLocked(key bucketKey, rate float64, burst int, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		b = newBucket(rate, burst, now)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// sweepLocked forgets idle client buckets, they are refilled anyway
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if k.kind != rejectIP {
+			continue
+		}
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func (l *rateLimiter) reject(name, reason string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rejectLocked(name, reason)
+}
+
+func (l *rateLimiter) rejectLocked(name, reason string) {
+	if l.rejected[name] == nil {
+		l.rejected[name] = map[string]int64{}
+	}
+	l.rejected[name][reason]++
+}
+
+type limiterStats struct {
+	Limits    *Limits            `json:"limits,omitempty"`
+	Override  bool               `json:"override,omitempty"`
+	Tokens    float64            `json:"tokens"`
+	Routes    map[string]float64 `json:"routes,omitempty"`
+	IPBuckets int                `json:"ip_buckets"`
+	InFlight  int64              `json:"in_flight"`
+	Rejected  map[string]int64   `json:"rejected,omitempty"`
+}
+
+// stats of the limiter, the ones of the package handler are published as axgate_limits in expvar
+func (h *Handler) stats() interface{} {
+	l := h.limiter
+	names := map[string]bool{}
+	for _, name := range h.gate.Names() {
+		names[name] = true
+	}
+	l.lock.Lock()
+	for name := range l.overrides {
+		names[name] = true
+	}
+	for name := range l.rejected {
+		names[name] = true
+	}
+	l.lock.Unlock()
+	now := time.Now()
+	res := map[string]*limiterStats{}
+	for name := range names {
+		s := &limiterStats{
+			Limits:   h.limits(name),
+			InFlight: h.gate.InFlight(name),
+			Tokens:   -1,
+		}
+		l.lock.Lock()
+		s.Override = l.overrides[name] != nil
+		for k, b := range l.buckets {
+			if k.service != name {
+				continue
+			}
+			b.refill(now)
+			switch k.kind {
+			case rejectRate:
+				s.Tokens = b.tokens
+			case rejectIP:
+				s.IPBuckets++
+			case rejectRoute:
+				if s.Routes == nil {
+					s.Routes = map[string]float64{}
+				}
+				s.Routes[k.id] = b.tokens
+			}
+		}
+		if r := l.rejected[name]; r != nil {
+			s.Rejected = map[string]int64{}
+			for k, v := range r {
+				s.Rejected[k] = v
+			}
+		}
+		l.lock.Unlock()
+		res[name] = s
+	}
+	return res
+}
+
+func routeLimit(routes []RouteLimit, path string) *RouteLimit {
+	var res *RouteLimit
+	for i, r := range routes {
+		if strings.HasPrefix(path, r.Path) && (res == nil || len(r.Path) > len(res.Path)) {
+			res = &routes[i]
+		}
+	}
+	return res
+}
+
+// tooManyRequests answers 429 with Retry-After in whole seconds
+func tooManyRequests(w http.ResponseWriter, retry time.Duration) {
+	seconds := int(math.Ceil(retry.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "429 too many requests", http.StatusTooManyRequests)
+}
+
+// clientIP returns the address of the caller, X-Forwarded-For is used
+// only when the request came through the trusted proxies
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !h.isTrusted(net.ParseIP(host)) {
+		return host
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				hops = append(hops, s)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !h.isTrusted(net.ParseIP(hops[i])) {
+			return hops[i]
+		}
+		host = hops[i]
+	}
+	return host
+}
+
+func (h *Handler) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trustedProxies() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newBucket(2, 0, now)
+	assert.Equal(t, 2.0, b.burst)
+	b.tokens -= 2
+	assert.Equal(t, 500*time.Millisecond, b.wait(now))
+	assert.Equal(t, time.Duration(0), b.wait(now.Add(500*time.Millisecond)))
+	assert.Equal(t, 2.0, func() float64 { b.refill(now.Add(time.Hour)); return b.tokens }())
+}
+
+func TestLimiterRejectsWithoutTakingTokens(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Unix(1000, 0)
+	limits := &Limits{Rate: 10, Burst: 10, IPRate: 1, IPBurst: 1}
+
+	_, ok := l.allow("svc", limits, "1.1.1.1", "/", now)
+	require.True(t, ok)
+	retry, ok := l.allow("svc", limits, "1.1.1.1", "/", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retry)
+	_, ok = l.allow("svc", limits, "2.2.2.2", "/", now)
+	assert.True(t, ok)
+
+	// the service bucket was not charged for the rejected request
+	assert.Equal(t, 8.0, l.buckets[bucketKey{"svc", rejectRate, ""}].tokens)
+	assert.Equal(t, int64(1), l.rejected["svc"][rejectIP])
+}
+
+func TestLimiterRoutes(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Unix(1000, 0)
+	limits := &Limits{Routes: []RouteLimit{
+		{Path: "/api", Rate: 100},
+		{Path: "/api/search", Rate: 1},
+	}}
+	_, ok := l.allow("svc", limits, "1.1.1.1", "/api/search?q=1", now)
+	require.True(t, ok)
+	_, ok = l.allow("svc", limits, "1.1.1.1", "/api/search?q=2", now)
+	assert.False(t, ok)
+	_, ok = l.allow("svc", limits, "1.1.1.1", "/api/items", now)
+	assert.True(t, ok)
+	_, ok = l.allow("svc", limits, "1.1.1.1", "/static", now)
+	assert.True(t, ok)
+}
+
+func TestLimiterSweepsIdleClients(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Unix(1000, 0)
+	limits := &Limits{IPRate: 1}
+	l.allow("svc", limits, "1.1.1.1", "/", now)
+	l.allow("svc", limits, "2.2.2.2", "/", now.Add(sweepInterval))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestLimitsOverride(t *testing.T) {
+	h := newHandler(&tcp.Server{})
+	h.SetConfig(&Config{
+		Limits:   &Limits{Rate: 1},
+		Services: map[string]*ServiceConfig{"api": {Limits: &Limits{Rate: 5}}},
+	})
+	admin := h.Admin()
+
+	assert.Equal(t, 1.0, h.limits("web").Rate)
+	assert.Equal(t, 5.0, h.limits("api").Rate)
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("PUT", "/services/api/limits", strings.NewReader(`{"rate":50,"max_in_flight":2}`)))
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, &Limits{Rate: 50, MaxInFlight: 2}, h.limits("api"))
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/services/api/limits", nil))
+	assert.JSONEq(t, `{"rate":50,"max_in_flight":2}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/services/api/limits", nil))
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, 5.0, h.limits("api").Rate)
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("PUT", "/services/api/limits", strings.NewReader(`{"rate":"fast"}`)))
+	assert.Equal(t, 400, w.Code)
+
+	// overrides are checked like the config
+	for _, body := range []string{`{"rate":-1}`, `{"max_in_flight":-2}`, `{"routes":[{"path":"/a","burst":-1}]}`} {
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/services/api/limits", strings.NewReader(body)))
+		assert.Equal(t, 400, w.Code, body)
+	}
+	assert.Equal(t, 5.0, h.limits("api").Rate)
+	assert.Error(t, h.SetConfig(&Config{Limits: &Limits{IPBurst: -1}}))
+}
+
+func TestMetricsHideCommandLine(t *testing.T) {
+	h := newHandler(&tcp.Server{})
+	w := httptest.NewRecorder()
+	h.Admin().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, w.Code)
+	var vars map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars))
+	assert.Contains(t, vars, "axgate_limits")
+	assert.Contains(t, vars, "memstats")
+	// it has -key of the server
+	assert.NotContains(t, vars, "cmdline")
+}
+
+func TestTooManyRequests(t *testing.T) {
+	h := newHandler(&tcp.Server{})
+	h.SetConfig(&Config{Limits: &Limits{Rate: 1}})
+	r := httptest.NewRequest("GET", "http://svc.gate.test/", nil)
+	// the first one passes the limiter and fails as there is no such service
+	assert.Error(t, h.service("limited", httptest.NewRecorder(), r))
+	w := httptest.NewRecorder()
+	require.NoError(t, h.service("limited", w, r))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestClientIP(t *testing.T) {
+	h := newHandler(&tcp.Server{})
+	require.NoError(t, h.SetTrustedProxies([]string{"10.0.0.0/8"}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.2")
+	assert.Equal(t, "1.2.3.4", h.clientIP(r))
+
+	r.RemoteAddr = "5.5.5.5:4000"
+	assert.Equal(t, "5.5.5.5", h.clientIP(r))
+}
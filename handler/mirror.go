@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	pproto "github.com/axgrid/axgate/proto"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorHeader marks copies of requests, it has the name of the service they were sent to
+const MirrorHeader = "X-Axgate-Mirror"
+
+// mirrorTimeout is how long a copy waits for the head of the mirror response
+var mirrorTimeout = 30 * time.Second
+
+// mirrorRecent is how many status differences are kept for the admin api
+const mirrorRecent = 50
+
+// Mirror sends copies of requests of a service to another one, their responses are dropped.
+// The copy goes once the service answered, it never holds the response to the caller.
+type Mirror struct {
+	// Service gets the copies
+	Service string `yaml:"service"`
+	// Percent of requests copied, 0 - all
+	Percent float64 `yaml:"percent"`
+	// MaxBody is the biggest request body copied, 0 - 1MiB, requests with bigger ones are skipped
+	MaxBody int64 `yaml:"max_body"`
+	// MaxInFlight is the most copies waiting for the mirror, 0 - 100, the rest are skipped
+	MaxInFlight int `yaml:"max_in_flight"`
+}
+
+func (m *Mirror) validate() error {
+	if m.Service == "" {
+		return fmt.Errorf("no service")
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("percent %v is out of 0-100", m.Percent)
+	}
+	if m.MaxBody < 0 || m.MaxInFlight < 0 {
+		return fmt.Errorf("negative limit")
+	}
+	return nil
+}
+
+// MirrorStats compare responses of the service and its mirror
+type MirrorStats struct {
+	Service        string        `json:"service"` // the mirror
+	Mirrored       int64         `json:"mirrored"`
+	Skipped        int64         `json:"skipped"` // sampled but not sent: big or cut bodies, too many in flight
+	Errors         int64         `json:"errors"`  // the mirror failed or is not connected
+	StatusDiffs    int64         `json:"status_diffs"`
+	PrimaryLatency float64       `json:"primary_latency_ms"` // average time to the response head
+	MirrorLatency  float64       `json:"mirror_latency_ms"`
+	Recent         []*MirrorDiff `json:"recent,omitempty"` // the last differences, the newest first
+}
+
+// MirrorDiff is a request the service and its mirror answered differently
+type MirrorDiff struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id"`
+	Method         string    `json:"method"`
+	URL            string    `json:"url"`
+	PrimaryStatus  int       `json:"primary_status"`
+	MirrorStatus   int       `json:"mirror_status,omitempty"`
+	PrimaryLatency float64   `json:"primary_latency_ms"`
+	MirrorLatency  float64   `json:"mirror_latency_ms,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// mirrorState is the mirror of one service
+type mirrorState struct {
+	config   Mirror
+	inFlight int64 // atomic
+
+	lock         sync.Mutex
+	stats        MirrorStats
+	primaryTotal time.Duration // of the compared responses
+	mirrorTotal  time.Duration
+	recent       []*MirrorDiff
+}
+
+func newMirrorState(c *Mirror) *mirrorState {
+	m := &mirrorState{config: *c}
+	if m.config.MaxBody == 0 {
+		m.config.MaxBody = 1 << 20
+	}
+	if m.config.MaxInFlight == 0 {
+		m.config.MaxInFlight = 100
+	}
+	m.stats.Service = c.Service
+	return m
+}
+
+func (m *mirrorState) skip() {
+	m.lock.Lock()
+	m.stats.Skipped++
+	m.lock.Unlock()
+}
+
+// record notes the result of a copy, mirror is 0 if it failed with err
+func (m *mirrorState) record(rq *pproto.GateRequest, primary, mirror int, primaryTime, mirrorTime time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stats.Mirrored++
+	diff := &MirrorDiff{
+		Time:           time.Now(),
+		RequestID:      rq.RequestId,
+		Method:         rq.Method,
+		URL:            rq.Url,
+		PrimaryStatus:  primary,
+		MirrorStatus:   mirror,
+		PrimaryLatency: milliseconds(primaryTime),
+	}
+	if err != nil {
+		m.stats.Errors++
+		diff.Error = err.Error()
+	} else {
+		m.primaryTotal += primaryTime
+		m.mirrorTotal += mirrorTime
+		if primary == mirror {
+			return
+		}
+		m.stats.StatusDiffs++
+		diff.MirrorLatency = milliseconds(mirrorTime)
+	}
+	m.recent = append(m.recent, diff)
+	if len(m.recent) > mirrorRecent {
+		m.recent = m.recent[1:]
+	}
+}
+
+func (m *mirrorState) snapshot() *MirrorStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := m.stats
+	if compared := m.stats.Mirrored - m.stats.Errors; compared > 0 {
+		res.PrimaryLatency = milliseconds(m.primaryTotal / time.Duration(compared))
+		res.MirrorLatency = milliseconds(m.mirrorTotal / time.Duration(compared))
+	}
+	for i := len(m.recent) - 1; i >= 0; i-- {
+		res.Recent = append(res.Recent, m.recent[i])
+	}
+	return &res
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// mirrorRequest is a sampled copy of a request waiting for the response of the service
+type mirrorRequest struct {
+	state *mirrorState
+	rq    *pproto.GateRequest
+	body  *mirrorBody
+}
+
+// mirrorState returns the mirror of the service, nil if it has none.
+// States are kept for configured mirrors only, names come from the Host header.
+func (h *Handler) mirrorState(name string) *mirrorState {
+	h.lock.RLock()
+	m := h.mirrors[name]
+	h.lock.RUnlock()
+	if m != nil {
+		return m
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if m := h.mirrors[name]; m != nil {
+		return m
+	}
+	s := h.config.Services[name]
+	if s == nil || s.Mirror == nil {
+		return nil
+	}
+	m = newMirrorState(s.Mirror)
+	if h.mirrors == nil {
+		h.mirrors = map[string]*mirrorState{}
+	}
+	h.mirrors[name] = m
+	return m
+}
+
+// mirror samples the request of the service, nil if it is not copied.
+// Call it before rq is sent, sending changes it.
+func (h *Handler) mirror(name string, rq *pproto.GateRequest) *mirrorRequest {
+	m := h.mirrorState(name)
+	if m == nil || m.config.Percent > 0 && rand.Float64()*100 >= m.config.Percent {
+		return nil
+	}
+	if rq.ContentLength > m.config.MaxBody {
+		m.skip()
+		return nil
+	}
+	c := proto.Clone(rq).(*pproto.GateRequest)
+	c.Id = pproto.NextID()
+	c.Name = m.config.Service
+	header := pproto.FromGateHeader(c.Header)
+	header.Set(MirrorHeader, name)
+	c.Header = pproto.ToGateHeader(header)
+	return &mirrorRequest{state: m, rq: c}
+}
+
+// tee copies the request body for the mirror as the service reads it
+func (mr *mirrorRequest) tee(body io.Reader) io.Reader {
+	if mr == nil {
+		return body
+	}
+	mr.body = &mirrorBody{body: body, max: mr.state.config.MaxBody}
+	return mr.body
+}
+
+// sendMirror copies the request to the mirror in the background, the service answered
+// with status after latency. A body the service has not read to its end is not copied.
+func (h *Handler) sendMirror(mr *mirrorRequest, status int, latency time.Duration) {
+	if mr == nil {
+		return
+	}
+	m := mr.state
+	if mr.body != nil {
+		body, trailer, ok := mr.body.copy()
+		if !ok {
+			m.skip()
+			return
+		}
+		mr.rq.Body, mr.rq.Trailer = body, trailer
+	}
+	if atomic.AddInt64(&m.inFlight, 1) > int64(m.config.MaxInFlight) {
+		atomic.AddInt64(&m.inFlight, -1)
+		m.skip()
+		return
+	}
+	maxInFlight := 0
+	if limits := h.limits(m.config.Service); limits != nil {
+		maxInFlight = limits.MaxInFlight
+	}
+	release, ok := h.gate.Acquire(m.config.Service, maxInFlight)
+	if !ok {
+		atomic.AddInt64(&m.inFlight, -1)
+		m.skip()
+		return
+	}
+	rq := mr.rq
+	go func() {
+		defer atomic.AddInt64(&m.inFlight, -1)
+		defer release()
+		start := time.Now()
+		mirror, err := h.roundTrip(rq)
+		m.record(rq, status, mirror, latency, time.Since(start), err)
+		if err != nil {
+			h.log().Debug().Err(err).Str("service", m.config.Service).Str("request-id", rq.RequestId).Msg("mirror failed")
+		} else if mirror != status {
+			h.log().Debug().Str("service", m.config.Service).Str("request-id", rq.RequestId).
+				Int("status", status).Int("mirror-status", mirror).Msg("mirror answered differently")
+		}
+	}()
+}
+
+// roundTrip sends the copy and waits for the status of the mirror, the body is dropped
+func (h *Handler) roundTrip(rq *pproto.GateRequest) (int, error) {
+	st, err := h.gate.Send(rq, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer st.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+	rs, err := st.Response(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return int(rs.StatusCode), nil
+}
+
+// mirrorBody keeps a copy of the request body up to max
+type mirrorBody struct {
+	body io.Reader
+	max  int64
+
+	lock sync.Mutex
+	buf  bytes.Buffer
+	done bool // the body was read to its end
+	over bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.max {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.done = true
+	}
+	return n, err
+}
+
+func (b *mirrorBody) Trailer() []*pproto.GateHeader {
+	if t, ok := b.body.(interface{ Trailer() []*pproto.GateHeader }); ok {
+		return t.Trailer()
+	}
+	return nil
+}
+
+// copy returns the whole body and its trailer, ok is false if it is not read to its end or too big
+func (b *mirrorBody) copy() (body []byte, trailer []*pproto.GateHeader, ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.done || b.over {
+		return nil, nil, false
+	}
+	return append([]byte(nil), b.buf.Bytes()...), b.Trailer(), true
+}
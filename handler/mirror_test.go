@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"encoding/json"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Services: map[string]*ServiceConfig{"api": {Mirror: &Mirror{Service: "next"}}}})
+	copies := make(chan *pproto.GateRequest, 1)
+	hold := make(chan struct{})
+	c := tcp.NewMultiClient(addr)
+	c.Add("api", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		io.ReadAll(ex)
+		return respond(ex, 200, "primary")
+	})
+	c.Add("next", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		b, _ := io.ReadAll(ex)
+		request.Body = b
+		copies <- request
+		<-hold
+		return respond(ex, 500, "mirror")
+	})
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	r := httptest.NewRequest("POST", "http://api.gate.test/items?x=1", strings.NewReader(`{"a":1}`))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	// the caller has the answer of the service while the mirror still works
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "primary", w.Body.String())
+
+	mirrored := <-copies
+	header := pproto.FromGateHeader(mirrored.Header)
+	assert.Equal(t, "POST", mirrored.Method)
+	assert.Equal(t, "http://api.gate.test/items?x=1", mirrored.Url)
+	assert.Equal(t, `{"a":1}`, string(mirrored.Body))
+	assert.Equal(t, "api", header.Get(MirrorHeader))
+	assert.Equal(t, w.Header().Get(pproto.RequestIDHeader), header.Get(pproto.RequestIDHeader))
+	close(hold)
+
+	var stats *MirrorStats
+	require.Eventually(t, func() bool {
+		stats = h.mirrorState("api").snapshot()
+		return stats.Mirrored == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "next", stats.Service)
+	assert.EqualValues(t, 1, stats.StatusDiffs)
+	require.Len(t, stats.Recent, 1)
+	assert.Equal(t, 200, stats.Recent[0].PrimaryStatus)
+	assert.Equal(t, 500, stats.Recent[0].MirrorStatus)
+	assert.Equal(t, w.Header().Get(pproto.RequestIDHeader), stats.Recent[0].RequestID)
+
+	w = get(h.Admin(), "/services/api/mirror")
+	require.Equal(t, http.StatusOK, w.Code)
+	var answered MirrorStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &answered))
+	assert.EqualValues(t, 1, answered.StatusDiffs)
+	assert.Equal(t, http.StatusNotFound, get(h.Admin(), "/services/next/mirror").Code)
+	assert.Equal(t, http.StatusNotFound, get(h.Admin(), "/services/random/mirror").Code)
+	// only configured mirrors have a state
+	assert.Len(t, h.mirrors, 1)
+}
+
+func TestMirrorSkipped(t *testing.T) {
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Services: map[string]*ServiceConfig{"api": {Mirror: &Mirror{Service: "gone", MaxBody: 4}}}})
+	c := tcp.NewMultiClient(addr)
+	c.Add("api", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		io.ReadAll(ex)
+		return respond(ex, 200, "ok")
+	})
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// bodies over the size are not copied
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://api.gate.test/", strings.NewReader("too big")))
+	// the mirror is not connected
+	w := get(h, "http://api.gate.test/")
+	assert.Equal(t, 200, w.Code)
+
+	var stats *MirrorStats
+	require.Eventually(t, func() bool {
+		stats = h.mirrorState("api").snapshot()
+		return stats.Mirrored == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 1, stats.Skipped)
+	assert.EqualValues(t, 1, stats.Errors)
+	require.Len(t, stats.Recent, 1)
+	assert.Contains(t, stats.Recent[0].Error, "not found")
+}
+
+func TestMirrorValidate(t *testing.T) {
+	assert.NoError(t, (&Mirror{Service: "next", Percent: 10}).validate())
+	assert.Error(t, (&Mirror{}).validate())
+	assert.Error(t, (&Mirror{Service: "next", Percent: 101}).validate())
+	assert.Error(t, (&Mirror{Service: "next", MaxBody: -1}).validate())
+}
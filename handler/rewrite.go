@@ -0,0 +1,32 @@
+package handler
+
+import (
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/rewrite"
+)
+
+// serviceRules returns the rewrite rules of the service, nil if there are none
+func (h *Handler) serviceRules(name string) *rewrite.Rules {
+	if c := h.serviceConfig(name); c != nil {
+		return c.Rewrite
+	}
+	return nil
+}
+
+// rewriteRequest applies rules to the request head, forwarding headers are set
+// before it so they keep what the caller asked for
+func (h *Handler) rewriteRequest(rules *rewrite.Rules, rq *pproto.GateRequest) {
+	req, err := rq.ToHttp()
+	if err != nil {
+		h.log().Warn().Err(err).Str("service", rq.Name).Str("request-id", rq.RequestId).Msg("fail to rewrite request")
+		return
+	}
+	rules.RewriteRequest(req)
+	rq.Url, rq.Host, rq.Header = req.RequestURI, req.Host, pproto.ToGateHeader(req.Header)
+}
+
+func rewriteResponse(rules *rewrite.Rules, rs *pproto.GateResponse) {
+	h := pproto.FromGateHeader(rs.Header)
+	rules.RewriteResponse(h)
+	rs.Header = pproto.ToGateHeader(h)
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/rewrite"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriteKeepsForwardedHost(t *testing.T) {
+	rules := &rewrite.Rules{
+		Host:    "app.local",
+		Path:    []rewrite.PathRule{{Match: "^/api/v1", Replace: "/v1"}},
+		Request: rewrite.HeaderRules{Set: map[string]string{"X-Env": "preview"}},
+	}
+	require.NoError(t, rules.Compile())
+	r := httptest.NewRequest("GET", "http://svc.gate.test/api/v1/items?page=2", nil)
+	r.RemoteAddr = "1.2.3.4:5000"
+	rq := pproto.NewGateRequestHead(r)
+	rq.SetForwarded("http", nil)
+	newHandler(&tcp.Server{}).rewriteRequest(rules, rq)
+
+	assert.Equal(t, "/v1/items?page=2", rq.Url)
+	assert.Equal(t, "app.local", rq.Host)
+	h := pproto.FromGateHeader(rq.Header)
+	assert.Equal(t, "preview", h.Get("X-Env"))
+	assert.Equal(t, "svc.gate.test", h.Get("X-Forwarded-Host"))
+}
+
+func TestSetConfigCompilesRules(t *testing.T) {
+	h := newHandler(&tcp.Server{})
+	bad := &Config{Services: map[string]*ServiceConfig{"svc": {Rewrite: &rewrite.Rules{Path: []rewrite.PathRule{{Match: "("}}}}}}
+	assert.Error(t, h.SetConfig(bad))
+	assert.Nil(t, h.serviceRules("svc"))
+
+	require.NoError(t, h.SetConfig(&Config{Services: map[string]*ServiceConfig{
+		"svc": {Rewrite: &rewrite.Rules{Path: []rewrite.PathRule{{Match: "^/old/", Replace: "/new/"}}}},
+	}}))
+	rq := pproto.NewGateRequestHead(httptest.NewRequest("GET", "http://svc.gate.test/old/a%2Fb", nil))
+	h.rewriteRequest(h.serviceRules("svc"), rq)
+	assert.Equal(t, "/new/a%2Fb", rq.Url)
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"encoding/json"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/axgrid/axgate/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+// collector is a stand-in of an OTLP/HTTP collector
+type collector struct {
+	lock  sync.Mutex
+	spans map[string]exportedSpan // by name
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var rq struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []exportedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	b, _ := io.ReadAll(r.Body)
+	json.Unmarshal(b, &rq)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, rs := range rq.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans[s.Name] = s
+			}
+		}
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	spans := &collector{spans: map[string]exportedSpan{}}
+	endpoint := httptest.NewServer(spans)
+	defer endpoint.Close()
+
+	s, h, addr := startGate(t)
+	h.SetConfig(&Config{Tracing: &tracing.Config{Endpoint: endpoint.URL}})
+	c := tcp.NewMultiClient(addr)
+	var err error
+	c.Tracer, err = tracing.New(&tracing.Config{Endpoint: endpoint.URL, Service: "client"})
+	require.NoError(t, err)
+	upstream := make(chan string, 1)
+	c.Add("api", func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		upstream <- pproto.FromGateHeader(request.Header).Get("traceparent")
+		time.Sleep(5 * time.Millisecond)
+		_, err := ex.Write([]byte("ok"))
+		return err
+	})
+	go c.Run()
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(s.Names()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	r := httptest.NewRequest("GET", "http://api.gate.test/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, c.Tracer.Close())
+	require.NoError(t, h.tracer().Close())
+
+	gate, tunnel, up, client := spans.spans["gate api"], spans.spans["tunnel api"], spans.spans["upstream api"], spans.spans["client api"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", gate.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", gate.ParentSpanID)
+	assert.Equal(t, gate.SpanID, tunnel.ParentSpanID)
+	assert.Equal(t, tunnel.SpanID, up.ParentSpanID)
+	assert.Equal(t, tunnel.SpanID, client.ParentSpanID)
+	assert.Equal(t, gate.TraceID, client.TraceID)
+	// the listener gets the context of the client span
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+client.SpanID+"-01", <-upstream)
+}
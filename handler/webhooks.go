@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/axgrid/axgate/tcp"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	webhookAttempts = 5
+	webhookBackoff  = time.Second // doubles after each failed attempt
+	webhookClient   = &http.Client{Timeout: 10 * time.Second}
+	webhookQueue    = 256 // events waiting for a slow webhook, the rest is dropped
+)
+
+var eventTypes = []string{tcp.EventConnected, tcp.EventDisconnected, tcp.EventReplaced, tcp.EventRejected, tcp.EventRequestError}
+
+// Webhook gets events of the gate as json posts.
+// With a secret the body is signed: X-Axgate-Signature: sha256=<hex hmac of the body>
+type Webhook struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// Events are the types to send, empty - all of them
+	Events []string `yaml:"events"`
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("bad url %q", w.URL)
+	}
+	for _, t := range w.Events {
+		if !contains(eventTypes, t) {
+			return fmt.Errorf("unknown event %s", t)
+		}
+	}
+	return nil
+}
+
+func (w *Webhook) wants(ev tcp.Event) bool {
+	return len(w.Events) == 0 || contains(w.Events, ev.Type)
+}
+
+// startWebhooks delivers events of the gate to the hooks until stop is called
+func (h *Handler) startWebhooks(hooks []*Webhook) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, hook := range hooks {
+		hook := hook
+		events, unsubscribe := h.gate.Events.Subscribe(webhookQueue)
+		go func() {
+			defer unsubscribe()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev := <-events:
+					if hook.wants(ev) {
+						h.deliver(ctx, hook, ev)
+					}
+				}
+			}
+		}()
+	}
+	return cancel
+}
+
+// deliver posts the event retrying with backoff until the hook answers 2xx
+func (h *Handler) deliver(ctx context.Context, hook *Webhook, ev tcp.Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = post(ctx, hook, ev.Type, body)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if attempt >= webhookAttempts {
+			h.log().Error().Err(err).Str("url", hook.URL).Str("event", ev.Type).Msg("fail to deliver webhook")
+			return
+		}
+		h.log().Debug().Err(err).Str("url", hook.URL).Int("attempt", attempt).Msg("webhook failed, retry")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func post(ctx context.Context, hook *Webhook, event string, body []byte) error {
+	rq, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Content-Type", "application/json")
+	rq.Header.Set("X-Axgate-Event", event)
+	if hook.Secret != "" {
+		rq.Header.Set("X-Axgate-Signature", "sha256="+sign(hook.Secret, body))
+	}
+	resp, err := webhookClient.Do(rq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
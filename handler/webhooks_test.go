@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	defer func(b time.Duration) { webhookBackoff = b }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	var calls int32
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- b
+	}))
+	defer hook.Close()
+
+	h := newHandler(&tcp.Server{})
+	h.SetConfig(&Config{Webhooks: []*Webhook{{URL: hook.URL, Secret: "s3cr3t", Events: []string{tcp.EventRejected}}}})
+	defer h.SetConfig(nil)
+	h.gate.Events.Publish(tcp.Event{Type: tcp.EventConnected, Service: "skipped"})
+	h.gate.Events.Publish(tcp.Event{Type: tcp.EventRejected, Service: "preview", Reason: "unauthorized"})
+
+	var r *http.Request
+	select {
+	case r = <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook is not delivered")
+	}
+	b := <-bodies
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, tcp.EventRejected, r.Header.Get("X-Axgate-Event"))
+	assert.Equal(t, "sha256="+sign("s3cr3t", b), r.Header.Get("X-Axgate-Signature"))
+	var ev tcp.Event
+	require.NoError(t, json.Unmarshal(b, &ev))
+	assert.Equal(t, "preview", ev.Service)
+	assert.Equal(t, "unauthorized", ev.Reason)
+}
+
+func TestWebhookValidate(t *testing.T) {
+	assert.NoError(t, (&Webhook{URL: "https://hooks.example.com/x"}).validate())
+	assert.Error(t, (&Webhook{URL: "hooks.example.com"}).validate())
+	assert.Error(t, (&Webhook{URL: "https://hooks.example.com", Events: []string{"service.up"}}).validate())
+}
+
+func TestEventStream(t *testing.T) {
+	s, h, _ := startGate(t)
+	admin := httptest.NewServer(h.Admin())
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "/events?type=" + tcp.EventRequestError)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	s.Events.Publish(tcp.Event{Type: tcp.EventConnected, Service: "api"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://missing.gate.test/path?q=1", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	lines := bufio.NewReader(resp.Body)
+	line, err := lines.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: request.error\n", line)
+	line, err = lines.ReadString('\n')
+	require.NoError(t, err)
+	var ev tcp.Event
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev))
+	assert.Equal(t, "missing", ev.Service)
+	assert.Equal(t, "/path?q=1", ev.URL)
+	assert.Equal(t, 500, ev.Status)
+}
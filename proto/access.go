@@ -0,0 +1,36 @@
+package proto
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// NewGateUser hashes password with bcrypt, the gate never sees it
+func NewGateUser(name string, password string) (*GateUser, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &GateUser{Name: name, PasswordHash: string(hash)}, nil
+}
+
+// Validate checks networks and password hashes of the access
+func (x *GateAccess) Validate() error {
+	if _, err := ParseNetworks(x.Allow); err != nil {
+		return err
+	}
+	if _, err := ParseNetworks(x.Deny); err != nil {
+		return err
+	}
+	for _, u := range x.Users {
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return fmt.Errorf("user %s: %w", u.Name, err)
+		}
+	}
+	for _, t := range x.Tokens {
+		if t == "" {
+			return fmt.Errorf("empty token")
+		}
+	}
+	return nil
+}
@@ -20,16 +20,123 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// GateCapability bits for GateHandshake.capabilities and GateHandshakeAck.capabilities
+type GateCapability int32
+
+const (
+	GateCapability_CAP_NONE          GateCapability = 0
+	GateCapability_CAP_STREAMING     GateCapability = 1 // GateData/GateWindow frames
+	GateCapability_CAP_COMPRESSION   GateCapability = 2
+	GateCapability_CAP_CANCEL        GateCapability = 4
+	GateCapability_CAP_MULTI_SERVICE GateCapability = 8 // GateHandshake.services and GateRegister
+)
+
+// Enum value maps for GateCapability.
+var (
+	GateCapability_name = map[int32]string{
+		0: "CAP_NONE",
+		1: "CAP_STREAMING",
+		2: "CAP_COMPRESSION",
+		4: "CAP_CANCEL",
+		8: "CAP_MULTI_SERVICE",
+	}
+	GateCapability_value = map[string]int32{
+		"CAP_NONE":          0,
+		"CAP_STREAMING":     1,
+		"CAP_COMPRESSION":   2,
+		"CAP_CANCEL":        4,
+		"CAP_MULTI_SERVICE": 8,
+	}
+)
+
+func (x GateCapability) Enum() *GateCapability {
+	p := new(GateCapability)
+	*p = x
+	return p
+}
+
+func (x GateCapability) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (GateCapability) Descriptor() protoreflect.EnumDescriptor {
+	return file_gate_proto_enumTypes[0].Descriptor()
+}
+
+func (GateCapability) Type() protoreflect.EnumType {
+	return &file_gate_proto_enumTypes[0]
+}
+
+func (x GateCapability) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use GateCapability.Descriptor instead.
+func (GateCapability) EnumDescriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{0}
+}
+
+type GateEncoding int32
+
+const (
+	GateEncoding_ENCODING_NONE    GateEncoding = 0
+	GateEncoding_ENCODING_DEFLATE GateEncoding = 1
+)
+
+// Enum value maps for GateEncoding.
+var (
+	GateEncoding_name = map[int32]string{
+		0: "ENCODING_NONE",
+		1: "ENCODING_DEFLATE",
+	}
+	GateEncoding_value = map[string]int32{
+		"ENCODING_NONE":    0,
+		"ENCODING_DEFLATE": 1,
+	}
+)
+
+func (x GateEncoding) Enum() *GateEncoding {
+	p := new(GateEncoding)
+	*p = x
+	return p
+}
+
+func (x GateEncoding) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (GateEncoding) Descriptor() protoreflect.EnumDescriptor {
+	return file_gate_proto_enumTypes[1].Descriptor()
+}
+
+func (GateEncoding) Type() protoreflect.EnumType {
+	return &file_gate_proto_enumTypes[1]
+}
+
+func (x GateEncoding) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use GateEncoding.Descriptor instead.
+func (GateEncoding) EnumDescriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{1}
+}
+
 type Packet struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Requests  *GateRequest   `protobuf:"bytes,1,opt,name=requests,proto3" json:"requests,omitempty"`
-	Responses *GateResponse  `protobuf:"bytes,2,opt,name=responses,proto3" json:"responses,omitempty"`
-	Handshake *GateHandshake `protobuf:"bytes,3,opt,name=handshake,proto3" json:"handshake,omitempty"`
-	Ping      *GatePing      `protobuf:"bytes,4,opt,name=ping,proto3" json:"ping,omitempty"`
-	Pong      *GatePing      `protobuf:"bytes,5,opt,name=pong,proto3" json:"pong,omitempty"`
+	Requests     *GateRequest      `protobuf:"bytes,1,opt,name=requests,proto3" json:"requests,omitempty"`
+	Responses    *GateResponse     `protobuf:"bytes,2,opt,name=responses,proto3" json:"responses,omitempty"`
+	Handshake    *GateHandshake    `protobuf:"bytes,3,opt,name=handshake,proto3" json:"handshake,omitempty"`
+	Ping         *GatePing         `protobuf:"bytes,4,opt,name=ping,proto3" json:"ping,omitempty"`
+	Pong         *GatePing         `protobuf:"bytes,5,opt,name=pong,proto3" json:"pong,omitempty"`
+	Data         *GateData         `protobuf:"bytes,6,opt,name=data,proto3" json:"data,omitempty"`
+	Window       *GateWindow       `protobuf:"bytes,7,opt,name=window,proto3" json:"window,omitempty"`
+	HandshakeAck *GateHandshakeAck `protobuf:"bytes,8,opt,name=handshake_ack,json=handshakeAck,proto3" json:"handshake_ack,omitempty"`
+	Cancel       *GateCancel       `protobuf:"bytes,9,opt,name=cancel,proto3" json:"cancel,omitempty"`
+	Register     *GateRegister     `protobuf:"bytes,10,opt,name=register,proto3" json:"register,omitempty"`
 }
 
 func (x *Packet) Reset() {
@@ -99,6 +206,41 @@ func (x *Packet) GetPong() *GatePing {
 	return nil
 }
 
+func (x *Packet) GetData() *GateData {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Packet) GetWindow() *GateWindow {
+	if x != nil {
+		return x.Window
+	}
+	return nil
+}
+
+func (x *Packet) GetHandshakeAck() *GateHandshakeAck {
+	if x != nil {
+		return x.HandshakeAck
+	}
+	return nil
+}
+
+func (x *Packet) GetCancel() *GateCancel {
+	if x != nil {
+		return x.Cancel
+	}
+	return nil
+}
+
+func (x *Packet) GetRegister() *GateRegister {
+	if x != nil {
+		return x.Register
+	}
+	return nil
+}
+
 type GatePing struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -160,6 +302,12 @@ type GateRequest struct {
 	Body          []byte        `protobuf:"bytes,14,opt,name=body,proto3" json:"body,omitempty"`
 	ContentLength int64         `protobuf:"varint,15,opt,name=content_length,json=contentLength,proto3" json:"content_length,omitempty"`
 	RemoteAddr    string        `protobuf:"bytes,16,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+	Stream        bool          `protobuf:"varint,17,opt,name=stream,proto3" json:"stream,omitempty"` // body follows as GateData frames
+	Window        uint32        `protobuf:"varint,18,opt,name=window,proto3" json:"window,omitempty"` // initial window granted for the response stream, 0 - respond inline
+	Priority      uint32        `protobuf:"varint,19,opt,name=priority,proto3" json:"priority,omitempty"`
+	BodyEncoding  GateEncoding  `protobuf:"varint,20,opt,name=body_encoding,json=bodyEncoding,proto3,enum=com.axgrid.axgate.GateEncoding" json:"body_encoding,omitempty"`
+	Trailer       []*GateHeader `protobuf:"bytes,21,rep,name=trailer,proto3" json:"trailer,omitempty"`                      // inline body trailers, streamed ones come with fin
+	RequestId     string        `protobuf:"bytes,22,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"` // X-Request-Id of the caller or made by the gate, for logs
 }
 
 func (x *GateRequest) Reset() {
@@ -257,6 +405,48 @@ func (x *GateRequest) GetRemoteAddr() string {
 	return ""
 }
 
+func (x *GateRequest) GetStream() bool {
+	if x != nil {
+		return x.Stream
+	}
+	return false
+}
+
+func (x *GateRequest) GetWindow() uint32 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+func (x *GateRequest) GetPriority() uint32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+func (x *GateRequest) GetBodyEncoding() GateEncoding {
+	if x != nil {
+		return x.BodyEncoding
+	}
+	return GateEncoding_ENCODING_NONE
+}
+
+func (x *GateRequest) GetTrailer() []*GateHeader {
+	if x != nil {
+		return x.Trailer
+	}
+	return nil
+}
+
+func (x *GateRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
 type GateHeader struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -323,6 +513,10 @@ type GateResponse struct {
 	Header        []*GateHeader `protobuf:"bytes,13,rep,name=header,proto3" json:"header,omitempty"`
 	Body          []byte        `protobuf:"bytes,14,opt,name=body,proto3" json:"body,omitempty"`
 	ContentLength int64         `protobuf:"varint,15,opt,name=content_length,json=contentLength,proto3" json:"content_length,omitempty"`
+	Stream        bool          `protobuf:"varint,16,opt,name=stream,proto3" json:"stream,omitempty"` // body follows as GateData frames
+	BodyEncoding  GateEncoding  `protobuf:"varint,17,opt,name=body_encoding,json=bodyEncoding,proto3,enum=com.axgrid.axgate.GateEncoding" json:"body_encoding,omitempty"`
+	Trailer       []*GateHeader `protobuf:"bytes,18,rep,name=trailer,proto3" json:"trailer,omitempty"`                                // inline body trailers, streamed ones come with fin
+	UpstreamTime  int64         `protobuf:"varint,19,opt,name=upstream_time,json=upstreamTime,proto3" json:"upstream_time,omitempty"` // nanoseconds between the client getting the request and sending the head
 }
 
 func (x *GateResponse) Reset() {
@@ -399,19 +593,236 @@ func (x *GateResponse) GetContentLength() int64 {
 	return 0
 }
 
+func (x *GateResponse) GetStream() bool {
+	if x != nil {
+		return x.Stream
+	}
+	return false
+}
+
+func (x *GateResponse) GetBodyEncoding() GateEncoding {
+	if x != nil {
+		return x.BodyEncoding
+	}
+	return GateEncoding_ENCODING_NONE
+}
+
+func (x *GateResponse) GetTrailer() []*GateHeader {
+	if x != nil {
+		return x.Trailer
+	}
+	return nil
+}
+
+func (x *GateResponse) GetUpstreamTime() int64 {
+	if x != nil {
+		return x.UpstreamTime
+	}
+	return 0
+}
+
+// GateData carries a chunk of a request or response body
+type GateData struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id       uint64        `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Data     []byte        `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Fin      bool          `protobuf:"varint,3,opt,name=fin,proto3" json:"fin,omitempty"`
+	Encoding GateEncoding  `protobuf:"varint,4,opt,name=encoding,proto3,enum=com.axgrid.axgate.GateEncoding" json:"encoding,omitempty"`
+	Trailer  []*GateHeader `protobuf:"bytes,5,rep,name=trailer,proto3" json:"trailer,omitempty"` // only with fin
+}
+
+func (x *GateData) Reset() {
+	*x = GateData{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gate_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GateData) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GateData) ProtoMessage() {}
+
+func (x *GateData) ProtoReflect() protoreflect.Message {
+	mi := &file_gate_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GateData.ProtoReflect.Descriptor instead.
+func (*GateData) Descriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *GateData) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *GateData) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *GateData) GetFin() bool {
+	if x != nil {
+		return x.Fin
+	}
+	return false
+}
+
+func (x *GateData) GetEncoding() GateEncoding {
+	if x != nil {
+		return x.Encoding
+	}
+	return GateEncoding_ENCODING_NONE
+}
+
+func (x *GateData) GetTrailer() []*GateHeader {
+	if x != nil {
+		return x.Trailer
+	}
+	return nil
+}
+
+// GateCancel tells the peer the stream is abandoned, it stops working on it
+type GateCancel struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (x *GateCancel) Reset() {
+	*x = GateCancel{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gate_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GateCancel) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GateCancel) ProtoMessage() {}
+
+func (x *GateCancel) ProtoReflect() protoreflect.Message {
+	mi := &file_gate_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GateCancel.ProtoReflect.Descriptor instead.
+func (*GateCancel) Descriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *GateCancel) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+// GateWindow lets the sender of stream id put increment more bytes in flight
+type GateWindow struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id        uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Increment uint32 `protobuf:"varint,2,opt,name=increment,proto3" json:"increment,omitempty"`
+}
+
+func (x *GateWindow) Reset() {
+	*x = GateWindow{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gate_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GateWindow) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GateWindow) ProtoMessage() {}
+
+func (x *GateWindow) ProtoReflect() protoreflect.Message {
+	mi := &file_gate_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GateWindow.ProtoReflect.Descriptor instead.
+func (*GateWindow) Descriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *GateWindow) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *GateWindow) GetIncrement() uint32 {
+	if x != nil {
+		return x.Increment
+	}
+	return 0
+}
+
 type GateHandshake struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Service string `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
-	Key     string `protobuf:"bytes,3,opt,name=key,proto3" json:"key,omitempty"`
+	Service      string         `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
+	Key          string         `protobuf:"bytes,3,opt,name=key,proto3" json:"key,omitempty"`
+	Window       uint32         `protobuf:"varint,4,opt,name=window,proto3" json:"window,omitempty"`   // initial window granted for request streams, 0 - requests inline
+	Version      uint32         `protobuf:"varint,5,opt,name=version,proto3" json:"version,omitempty"` // 0 - clients before version negotiation
+	Capabilities uint64         `protobuf:"varint,6,opt,name=capabilities,proto3" json:"capabilities,omitempty"`
+	Access       *GateAccess    `protobuf:"bytes,7,opt,name=access,proto3" json:"access,omitempty"`     // protection the client asks the gate to put in front of it
+	Services     []*GateService `protobuf:"bytes,8,rep,name=services,proto3" json:"services,omitempty"` // more services on this connection besides service
 }
 
 func (x *GateHandshake) Reset() {
 	*x = GateHandshake{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_gate_proto_msgTypes[5]
+		mi := &file_gate_proto_msgTypes[8]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -424,7 +835,7 @@ func (x *GateHandshake) String() string {
 func (*GateHandshake) ProtoMessage() {}
 
 func (x *GateHandshake) ProtoReflect() protoreflect.Message {
-	mi := &file_gate_proto_msgTypes[5]
+	mi := &file_gate_proto_msgTypes[8]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -437,7 +848,7 @@ func (x *GateHandshake) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use GateHandshake.ProtoReflect.Descriptor instead.
 func (*GateHandshake) Descriptor() ([]byte, []int) {
-	return file_gate_proto_rawDescGZIP(), []int{5}
+	return file_gate_proto_rawDescGZIP(), []int{8}
 }
 
 func (x *GateHandshake) GetService() string {
@@ -454,14 +865,354 @@ func (x *GateHandshake) GetKey() string {
 	return ""
 }
 
-var File_gate_proto protoreflect.FileDescriptor
+func (x *GateHandshake) GetWindow() uint32 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
 
-var file_gate_proto_rawDesc = []byte{
-	0x0a, 0x0a, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x11, 0x63, 0x6f,
-	0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x22,
-	0xa5, 0x02, 0x0a, 0x06, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x3a, 0x0a, 0x08, 0x72, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1e, 0x2e, 0x63,
-	0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65,
+func (x *GateHandshake) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *GateHandshake) GetCapabilities() uint64 {
+	if x != nil {
+		return x.Capabilities
+	}
+	return 0
+}
+
+func (x *GateHandshake) GetAccess() *GateAccess {
+	if x != nil {
+		return x.Access
+	}
+	return nil
+}
+
+func (x *GateHandshake) GetServices() []*GateService {
+	if x != nil {
+		return x.Services
+	}
+	return nil
+}
+
+type GateService struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name   string      `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Access *GateAccess `protobuf:"bytes,2,opt,name=access,proto3" json:"access,omitempty"`
+}
+
+func (x *GateService) Reset() {
+	*x = GateService{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gate_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GateService) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GateService) ProtoMessage() {}
+
+func (x *GateService) ProtoReflect() protoreflect.Message {
+	mi := &file_gate_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GateService.ProtoReflect.Descriptor instead.
+func (*GateService) Descriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GateService) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *GateService) GetAccess() *GateAccess {
+	if x != nil {
+		return x.Access
+	}
+	return nil
+}
+
+// GateRegister adds services to the connection or removes them after the handshake.
+// A service name served by another connection moves to this one.
+type GateRegister struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Add    []*GateService `protobuf:"bytes,1,rep,name=add,proto3" json:"add,omitempty"`
+	Remove []string       `protobuf:"bytes,2,rep,name=remove,proto3" json:"remove,omitempty"`
+}
+
+func (x *GateRegister) Reset() {
+	*x = GateRegister{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gate_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GateRegister) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GateRegister) ProtoMessage() {}
+
+func (x *GateRegister) ProtoReflect() protoreflect.Message {
+	mi := &file_gate_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GateRegister.ProtoReflect.Descriptor instead.
+func (*GateRegister) Descriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *GateRegister) GetAdd() []*GateService {
+	if x != nil {
+		return x.Add
+	}
+	return nil
+}
+
+func (x *GateRegister) GetRemove() []string {
+	if x != nil {
+		return x.Remove
+	}
+	return nil
+}
+
+// GateAccess is who may call a service: client networks and credentials.
+// With users or tokens set a request needs one of them.
+type GateAccess struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Allow  []string    `protobuf:"bytes,1,rep,name=allow,proto3" json:"allow,omitempty"` // networks or addresses, empty - any
+	Deny   []string    `protobuf:"bytes,2,rep,name=deny,proto3" json:"deny,omitempty"`
+	Users  []*GateUser `protobuf:"bytes,3,rep,name=users,proto3" json:"users,omitempty"`   // basic auth
+	Tokens []string    `protobuf:"bytes,4,rep,name=tokens,proto3" json:"tokens,omitempty"` // bearer tokens
+}
+
+func (x *GateAccess) Reset() {
+	*x = GateAccess{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gate_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GateAccess) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GateAccess) ProtoMessage() {}
+
+func (x *GateAccess) ProtoReflect() protoreflect.Message {
+	mi := &file_gate_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GateAccess.ProtoReflect.Descriptor instead.
+func (*GateAccess) Descriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *GateAccess) GetAllow() []string {
+	if x != nil {
+		return x.Allow
+	}
+	return nil
+}
+
+func (x *GateAccess) GetDeny() []string {
+	if x != nil {
+		return x.Deny
+	}
+	return nil
+}
+
+func (x *GateAccess) GetUsers() []*GateUser {
+	if x != nil {
+		return x.Users
+	}
+	return nil
+}
+
+func (x *GateAccess) GetTokens() []string {
+	if x != nil {
+		return x.Tokens
+	}
+	return nil
+}
+
+type GateUser struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name         string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	PasswordHash string `protobuf:"bytes,2,opt,name=password_hash,json=passwordHash,proto3" json:"password_hash,omitempty"` // bcrypt
+}
+
+func (x *GateUser) Reset() {
+	*x = GateUser{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gate_proto_msgTypes[12]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GateUser) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GateUser) ProtoMessage() {}
+
+func (x *GateUser) ProtoReflect() protoreflect.Message {
+	mi := &file_gate_proto_msgTypes[12]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GateUser.ProtoReflect.Descriptor instead.
+func (*GateUser) Descriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *GateUser) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *GateUser) GetPasswordHash() string {
+	if x != nil {
+		return x.PasswordHash
+	}
+	return ""
+}
+
+// GateHandshakeAck is the server answer on GateHandshake. Capabilities are the
+// ones both sides support, a non empty error means the handshake was rejected.
+type GateHandshakeAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version      uint32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Capabilities uint64 `protobuf:"varint,2,opt,name=capabilities,proto3" json:"capabilities,omitempty"`
+	Error        string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *GateHandshakeAck) Reset() {
+	*x = GateHandshakeAck{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gate_proto_msgTypes[13]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GateHandshakeAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GateHandshakeAck) ProtoMessage() {}
+
+func (x *GateHandshakeAck) ProtoReflect() protoreflect.Message {
+	mi := &file_gate_proto_msgTypes[13]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GateHandshakeAck.ProtoReflect.Descriptor instead.
+func (*GateHandshakeAck) Descriptor() ([]byte, []int) {
+	return file_gate_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *GateHandshakeAck) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *GateHandshakeAck) GetCapabilities() uint64 {
+	if x != nil {
+		return x.Capabilities
+	}
+	return 0
+}
+
+func (x *GateHandshakeAck) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_gate_proto protoreflect.FileDescriptor
+
+var file_gate_proto_rawDesc = []byte{
+	0x0a, 0x0a, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x11, 0x63, 0x6f,
+	0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x22,
+	0xcb, 0x04, 0x0a, 0x06, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x3a, 0x0a, 0x08, 0x72, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1e, 0x2e, 0x63,
+	0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65,
 	0x2e, 0x47, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x08, 0x72, 0x65,
 	0x71, 0x75, 0x65, 0x73, 0x74, 0x73, 0x12, 0x3d, 0x0a, 0x09, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e,
 	0x73, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x63, 0x6f, 0x6d, 0x2e,
@@ -477,29 +1228,62 @@ var file_gate_proto_rawDesc = []byte{
 	0x52, 0x04, 0x70, 0x69, 0x6e, 0x67, 0x12, 0x2f, 0x0a, 0x04, 0x70, 0x6f, 0x6e, 0x67, 0x18, 0x05,
 	0x20, 0x01, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69,
 	0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x50, 0x69, 0x6e,
-	0x67, 0x52, 0x04, 0x70, 0x6f, 0x6e, 0x67, 0x22, 0x1e, 0x0a, 0x08, 0x47, 0x61, 0x74, 0x65, 0x50,
-	0x69, 0x6e, 0x67, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x03, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x22, 0x82, 0x02, 0x0a, 0x0b, 0x47, 0x61, 0x74, 0x65,
-	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20,
-	0x01, 0x28, 0x04, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18,
-	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6d,
-	0x65, 0x74, 0x68, 0x6f, 0x64, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6d, 0x65, 0x74,
-	0x68, 0x6f, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x75, 0x72, 0x6c, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x03, 0x75, 0x72, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x6f, 0x73, 0x74, 0x18, 0x0c, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x04, 0x68, 0x6f, 0x73, 0x74, 0x12, 0x35, 0x0a, 0x06, 0x68, 0x65, 0x61,
-	0x64, 0x65, 0x72, 0x18, 0x0d, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x63, 0x6f, 0x6d, 0x2e,
+	0x67, 0x52, 0x04, 0x70, 0x6f, 0x6e, 0x67, 0x12, 0x2f, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18,
+	0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72,
+	0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x44, 0x61,
+	0x74, 0x61, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x35, 0x0a, 0x06, 0x77, 0x69, 0x6e, 0x64,
+	0x6f, 0x77, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61,
+	0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74,
+	0x65, 0x57, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x52, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x12,
+	0x48, 0x0a, 0x0d, 0x68, 0x61, 0x6e, 0x64, 0x73, 0x68, 0x61, 0x6b, 0x65, 0x5f, 0x61, 0x63, 0x6b,
+	0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x23, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67,
+	0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x48,
+	0x61, 0x6e, 0x64, 0x73, 0x68, 0x61, 0x6b, 0x65, 0x41, 0x63, 0x6b, 0x52, 0x0c, 0x68, 0x61, 0x6e,
+	0x64, 0x73, 0x68, 0x61, 0x6b, 0x65, 0x41, 0x63, 0x6b, 0x12, 0x35, 0x0a, 0x06, 0x63, 0x61, 0x6e,
+	0x63, 0x65, 0x6c, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x63, 0x6f, 0x6d, 0x2e,
 	0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61,
-	0x74, 0x65, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x06, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72,
-	0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04,
-	0x62, 0x6f, 0x64, 0x79, 0x12, 0x25, 0x0a, 0x0e, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x5f,
-	0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x63, 0x6f,
-	0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x12, 0x1f, 0x0a, 0x0b, 0x72,
-	0x65, 0x6d, 0x6f, 0x74, 0x65, 0x5f, 0x61, 0x64, 0x64, 0x72, 0x18, 0x10, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x0a, 0x72, 0x65, 0x6d, 0x6f, 0x74, 0x65, 0x41, 0x64, 0x64, 0x72, 0x22, 0x36, 0x0a, 0x0a,
+	0x74, 0x65, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x06, 0x63, 0x61, 0x6e, 0x63, 0x65, 0x6c,
+	0x12, 0x3b, 0x0a, 0x08, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x18, 0x0a, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e,
+	0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x52, 0x65, 0x67, 0x69, 0x73,
+	0x74, 0x65, 0x72, 0x52, 0x08, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x22, 0x1e, 0x0a,
+	0x08, 0x47, 0x61, 0x74, 0x65, 0x50, 0x69, 0x6e, 0x67, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x69, 0x6d,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x22, 0xec, 0x03,
+	0x0a, 0x0b, 0x47, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a,
+	0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a,
+	0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d,
+	0x65, 0x12, 0x16, 0x0a, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x18, 0x0a, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x75, 0x72, 0x6c,
+	0x18, 0x0b, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x75, 0x72, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x68,
+	0x6f, 0x73, 0x74, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x68, 0x6f, 0x73, 0x74, 0x12,
+	0x35, 0x0a, 0x06, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x18, 0x0d, 0x20, 0x03, 0x28, 0x0b, 0x32,
+	0x1d, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67,
+	0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x06,
+	0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x0e,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x25, 0x0a, 0x0e, 0x63, 0x6f,
+	0x6e, 0x74, 0x65, 0x6e, 0x74, 0x5f, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x0f, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74,
+	0x68, 0x12, 0x1f, 0x0a, 0x0b, 0x72, 0x65, 0x6d, 0x6f, 0x74, 0x65, 0x5f, 0x61, 0x64, 0x64, 0x72,
+	0x18, 0x10, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x72, 0x65, 0x6d, 0x6f, 0x74, 0x65, 0x41, 0x64,
+	0x64, 0x72, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x18, 0x11, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x06, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x69,
+	0x6e, 0x64, 0x6f, 0x77, 0x18, 0x12, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x77, 0x69, 0x6e, 0x64,
+	0x6f, 0x77, 0x12, 0x1a, 0x0a, 0x08, 0x70, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x18, 0x13,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x70, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x12, 0x44,
+	0x0a, 0x0d, 0x62, 0x6f, 0x64, 0x79, 0x5f, 0x65, 0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x18,
+	0x14, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1f, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72,
+	0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x45, 0x6e,
+	0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x52, 0x0c, 0x62, 0x6f, 0x64, 0x79, 0x45, 0x6e, 0x63, 0x6f,
+	0x64, 0x69, 0x6e, 0x67, 0x12, 0x37, 0x0a, 0x07, 0x74, 0x72, 0x61, 0x69, 0x6c, 0x65, 0x72, 0x18,
+	0x15, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72,
+	0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x48, 0x65,
+	0x61, 0x64, 0x65, 0x72, 0x52, 0x07, 0x74, 0x72, 0x61, 0x69, 0x6c, 0x65, 0x72, 0x12, 0x1d, 0x0a,
+	0x0a, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x16, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x09, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x49, 0x64, 0x22, 0x36, 0x0a, 0x0a,
 	0x47, 0x61, 0x74, 0x65, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65,
 	0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x16, 0x0a, 0x06,
 	0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x76, 0x61,
-	0x6c, 0x75, 0x65, 0x73, 0x22, 0xc5, 0x01, 0x0a, 0x0c, 0x47, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73,
+	0x6c, 0x75, 0x65, 0x73, 0x22, 0x81, 0x03, 0x0a, 0x0c, 0x47, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73,
 	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
 	0x04, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20,
 	0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x73, 0x74, 0x61,
@@ -511,14 +1295,97 @@ var file_gate_proto_rawDesc = []byte{
 	0x72, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x0c, 0x52,
 	0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x25, 0x0a, 0x0e, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74,
 	0x5f, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x63,
-	0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x22, 0x3b, 0x0a, 0x0d,
+	0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x12, 0x16, 0x0a, 0x06,
+	0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x18, 0x10, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x73, 0x74,
+	0x72, 0x65, 0x61, 0x6d, 0x12, 0x44, 0x0a, 0x0d, 0x62, 0x6f, 0x64, 0x79, 0x5f, 0x65, 0x6e, 0x63,
+	0x6f, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x11, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1f, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e,
+	0x47, 0x61, 0x74, 0x65, 0x45, 0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x52, 0x0c, 0x62, 0x6f,
+	0x64, 0x79, 0x45, 0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x37, 0x0a, 0x07, 0x74, 0x72,
+	0x61, 0x69, 0x6c, 0x65, 0x72, 0x18, 0x12, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e,
+	0x47, 0x61, 0x74, 0x65, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x07, 0x74, 0x72, 0x61, 0x69,
+	0x6c, 0x65, 0x72, 0x12, 0x23, 0x0a, 0x0d, 0x75, 0x70, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x5f,
+	0x74, 0x69, 0x6d, 0x65, 0x18, 0x13, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x75, 0x70, 0x73, 0x74,
+	0x72, 0x65, 0x61, 0x6d, 0x54, 0x69, 0x6d, 0x65, 0x22, 0xb6, 0x01, 0x0a, 0x08, 0x47, 0x61, 0x74,
+	0x65, 0x44, 0x61, 0x74, 0x61, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x04, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x10, 0x0a, 0x03, 0x66, 0x69, 0x6e,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x03, 0x66, 0x69, 0x6e, 0x12, 0x3b, 0x0a, 0x08, 0x65,
+	0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1f, 0x2e,
+	0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74,
+	0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x45, 0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x52, 0x08,
+	0x65, 0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x37, 0x0a, 0x07, 0x74, 0x72, 0x61, 0x69,
+	0x6c, 0x65, 0x72, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x63, 0x6f, 0x6d, 0x2e,
+	0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61,
+	0x74, 0x65, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x07, 0x74, 0x72, 0x61, 0x69, 0x6c, 0x65,
+	0x72, 0x22, 0x1c, 0x0a, 0x0a, 0x47, 0x61, 0x74, 0x65, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x69, 0x64, 0x22,
+	0x3a, 0x0a, 0x0a, 0x47, 0x61, 0x74, 0x65, 0x57, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x12, 0x0e, 0x0a,
+	0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x69, 0x64, 0x12, 0x1c, 0x0a,
+	0x09, 0x69, 0x6e, 0x63, 0x72, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x09, 0x69, 0x6e, 0x63, 0x72, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x22, 0x84, 0x02, 0x0a, 0x0d,
 	0x47, 0x61, 0x74, 0x65, 0x48, 0x61, 0x6e, 0x64, 0x73, 0x68, 0x61, 0x6b, 0x65, 0x12, 0x18, 0x0a,
 	0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07,
 	0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x03,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x42, 0x2d, 0x0a, 0x11, 0x63, 0x6f, 0x6d,
-	0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x67, 0x6f, 0x67, 0x61, 0x74, 0x65, 0x50, 0x01,
-	0xaa, 0x02, 0x15, 0x41, 0x78, 0x47, 0x72, 0x69, 0x64, 0x2e, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e,
-	0x61, 0x6c, 0x2e, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x69, 0x6e,
+	0x64, 0x6f, 0x77, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f,
+	0x77, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x22, 0x0a, 0x0c, 0x63,
+	0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x69, 0x65, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28,
+	0x04, 0x52, 0x0c, 0x63, 0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x69, 0x65, 0x73, 0x12,
+	0x35, 0x0a, 0x06, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x1d, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67,
+	0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x41, 0x63, 0x63, 0x65, 0x73, 0x73, 0x52, 0x06,
+	0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x12, 0x3a, 0x0a, 0x08, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x73, 0x18, 0x08, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1e, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61,
+	0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74,
+	0x65, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x52, 0x08, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x73, 0x22, 0x58, 0x0a, 0x0b, 0x47, 0x61, 0x74, 0x65, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x35, 0x0a, 0x06, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72,
+	0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x41, 0x63,
+	0x63, 0x65, 0x73, 0x73, 0x52, 0x06, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x58, 0x0a, 0x0c,
+	0x47, 0x61, 0x74, 0x65, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x12, 0x30, 0x0a, 0x03,
+	0x61, 0x64, 0x64, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1e, 0x2e, 0x63, 0x6f, 0x6d, 0x2e,
+	0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61, 0x74, 0x65, 0x2e, 0x47, 0x61,
+	0x74, 0x65, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x52, 0x03, 0x61, 0x64, 0x64, 0x12, 0x16,
+	0x0a, 0x06, 0x72, 0x65, 0x6d, 0x6f, 0x76, 0x65, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06,
+	0x72, 0x65, 0x6d, 0x6f, 0x76, 0x65, 0x22, 0x81, 0x01, 0x0a, 0x0a, 0x47, 0x61, 0x74, 0x65, 0x41,
+	0x63, 0x63, 0x65, 0x73, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x18, 0x01,
+	0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x12, 0x12, 0x0a, 0x04, 0x64,
+	0x65, 0x6e, 0x79, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04, 0x64, 0x65, 0x6e, 0x79, 0x12,
+	0x31, 0x0a, 0x05, 0x75, 0x73, 0x65, 0x72, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1b,
+	0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x61, 0x78, 0x67, 0x61,
+	0x74, 0x65, 0x2e, 0x47, 0x61, 0x74, 0x65, 0x55, 0x73, 0x65, 0x72, 0x52, 0x05, 0x75, 0x73, 0x65,
+	0x72, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x18, 0x04, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x06, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x22, 0x43, 0x0a, 0x08, 0x47, 0x61,
+	0x74, 0x65, 0x55, 0x73, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x70, 0x61,
+	0x73, 0x73, 0x77, 0x6f, 0x72, 0x64, 0x5f, 0x68, 0x61, 0x73, 0x68, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0c, 0x70, 0x61, 0x73, 0x73, 0x77, 0x6f, 0x72, 0x64, 0x48, 0x61, 0x73, 0x68, 0x22,
+	0x66, 0x0a, 0x10, 0x47, 0x61, 0x74, 0x65, 0x48, 0x61, 0x6e, 0x64, 0x73, 0x68, 0x61, 0x6b, 0x65,
+	0x41, 0x63, 0x6b, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x22, 0x0a,
+	0x0c, 0x63, 0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x69, 0x65, 0x73, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x04, 0x52, 0x0c, 0x63, 0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x69, 0x65,
+	0x73, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x2a, 0x6d, 0x0a, 0x0e, 0x47, 0x61, 0x74, 0x65, 0x43,
+	0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x12, 0x0c, 0x0a, 0x08, 0x43, 0x41, 0x50,
+	0x5f, 0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12, 0x11, 0x0a, 0x0d, 0x43, 0x41, 0x50, 0x5f, 0x53,
+	0x54, 0x52, 0x45, 0x41, 0x4d, 0x49, 0x4e, 0x47, 0x10, 0x01, 0x12, 0x13, 0x0a, 0x0f, 0x43, 0x41,
+	0x50, 0x5f, 0x43, 0x4f, 0x4d, 0x50, 0x52, 0x45, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x10, 0x02, 0x12,
+	0x0e, 0x0a, 0x0a, 0x43, 0x41, 0x50, 0x5f, 0x43, 0x41, 0x4e, 0x43, 0x45, 0x4c, 0x10, 0x04, 0x12,
+	0x15, 0x0a, 0x11, 0x43, 0x41, 0x50, 0x5f, 0x4d, 0x55, 0x4c, 0x54, 0x49, 0x5f, 0x53, 0x45, 0x52,
+	0x56, 0x49, 0x43, 0x45, 0x10, 0x08, 0x2a, 0x37, 0x0a, 0x0c, 0x47, 0x61, 0x74, 0x65, 0x45, 0x6e,
+	0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x11, 0x0a, 0x0d, 0x45, 0x4e, 0x43, 0x4f, 0x44, 0x49,
+	0x4e, 0x47, 0x5f, 0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12, 0x14, 0x0a, 0x10, 0x45, 0x4e, 0x43,
+	0x4f, 0x44, 0x49, 0x4e, 0x47, 0x5f, 0x44, 0x45, 0x46, 0x4c, 0x41, 0x54, 0x45, 0x10, 0x01, 0x42,
+	0x2d, 0x0a, 0x11, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x78, 0x67, 0x72, 0x69, 0x64, 0x2e, 0x67, 0x6f,
+	0x67, 0x61, 0x74, 0x65, 0x50, 0x01, 0xaa, 0x02, 0x15, 0x41, 0x78, 0x47, 0x72, 0x69, 0x64, 0x2e,
+	0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2e, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -533,28 +1400,55 @@ func file_gate_proto_rawDescGZIP() []byte {
 	return file_gate_proto_rawDescData
 }
 
-var file_gate_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_gate_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_gate_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
 var file_gate_proto_goTypes = []interface{}{
-	(*Packet)(nil),        // 0: com.axgrid.axgate.Packet
-	(*GatePing)(nil),      // 1: com.axgrid.axgate.GatePing
-	(*GateRequest)(nil),   // 2: com.axgrid.axgate.GateRequest
-	(*GateHeader)(nil),    // 3: com.axgrid.axgate.GateHeader
-	(*GateResponse)(nil),  // 4: com.axgrid.axgate.GateResponse
-	(*GateHandshake)(nil), // 5: com.axgrid.axgate.GateHandshake
+	(GateCapability)(0),      // 0: com.axgrid.axgate.GateCapability
+	(GateEncoding)(0),        // 1: com.axgrid.axgate.GateEncoding
+	(*Packet)(nil),           // 2: com.axgrid.axgate.Packet
+	(*GatePing)(nil),         // 3: com.axgrid.axgate.GatePing
+	(*GateRequest)(nil),      // 4: com.axgrid.axgate.GateRequest
+	(*GateHeader)(nil),       // 5: com.axgrid.axgate.GateHeader
+	(*GateResponse)(nil),     // 6: com.axgrid.axgate.GateResponse
+	(*GateData)(nil),         // 7: com.axgrid.axgate.GateData
+	(*GateCancel)(nil),       // 8: com.axgrid.axgate.GateCancel
+	(*GateWindow)(nil),       // 9: com.axgrid.axgate.GateWindow
+	(*GateHandshake)(nil),    // 10: com.axgrid.axgate.GateHandshake
+	(*GateService)(nil),      // 11: com.axgrid.axgate.GateService
+	(*GateRegister)(nil),     // 12: com.axgrid.axgate.GateRegister
+	(*GateAccess)(nil),       // 13: com.axgrid.axgate.GateAccess
+	(*GateUser)(nil),         // 14: com.axgrid.axgate.GateUser
+	(*GateHandshakeAck)(nil), // 15: com.axgrid.axgate.GateHandshakeAck
 }
 var file_gate_proto_depIdxs = []int32{
-	2, // 0: com.axgrid.axgate.Packet.requests:type_name -> com.axgrid.axgate.GateRequest
-	4, // 1: com.axgrid.axgate.Packet.responses:type_name -> com.axgrid.axgate.GateResponse
-	5, // 2: com.axgrid.axgate.Packet.handshake:type_name -> com.axgrid.axgate.GateHandshake
-	1, // 3: com.axgrid.axgate.Packet.ping:type_name -> com.axgrid.axgate.GatePing
-	1, // 4: com.axgrid.axgate.Packet.pong:type_name -> com.axgrid.axgate.GatePing
-	3, // 5: com.axgrid.axgate.GateRequest.header:type_name -> com.axgrid.axgate.GateHeader
-	3, // 6: com.axgrid.axgate.GateResponse.header:type_name -> com.axgrid.axgate.GateHeader
-	7, // [7:7] is the sub-list for method output_type
-	7, // [7:7] is the sub-list for method input_type
-	7, // [7:7] is the sub-list for extension type_name
-	7, // [7:7] is the sub-list for extension extendee
-	0, // [0:7] is the sub-list for field type_name
+	4,  // 0: com.axgrid.axgate.Packet.requests:type_name -> com.axgrid.axgate.GateRequest
+	6,  // 1: com.axgrid.axgate.Packet.responses:type_name -> com.axgrid.axgate.GateResponse
+	10, // 2: com.axgrid.axgate.Packet.handshake:type_name -> com.axgrid.axgate.GateHandshake
+	3,  // 3: com.axgrid.axgate.Packet.ping:type_name -> com.axgrid.axgate.GatePing
+	3,  // 4: com.axgrid.axgate.Packet.pong:type_name -> com.axgrid.axgate.GatePing
+	7,  // 5: com.axgrid.axgate.Packet.data:type_name -> com.axgrid.axgate.GateData
+	9,  // 6: com.axgrid.axgate.Packet.window:type_name -> com.axgrid.axgate.GateWindow
+	15, // 7: com.axgrid.axgate.Packet.handshake_ack:type_name -> com.axgrid.axgate.GateHandshakeAck
+	8,  // 8: com.axgrid.axgate.Packet.cancel:type_name -> com.axgrid.axgate.GateCancel
+	12, // 9: com.axgrid.axgate.Packet.register:type_name -> com.axgrid.axgate.GateRegister
+	5,  // 10: com.axgrid.axgate.GateRequest.header:type_name -> com.axgrid.axgate.GateHeader
+	1,  // 11: com.axgrid.axgate.GateRequest.body_encoding:type_name -> com.axgrid.axgate.GateEncoding
+	5,  // 12: com.axgrid.axgate.GateRequest.trailer:type_name -> com.axgrid.axgate.GateHeader
+	5,  // 13: com.axgrid.axgate.GateResponse.header:type_name -> com.axgrid.axgate.GateHeader
+	1,  // 14: com.axgrid.axgate.GateResponse.body_encoding:type_name -> com.axgrid.axgate.GateEncoding
+	5,  // 15: com.axgrid.axgate.GateResponse.trailer:type_name -> com.axgrid.axgate.GateHeader
+	1,  // 16: com.axgrid.axgate.GateData.encoding:type_name -> com.axgrid.axgate.GateEncoding
+	5,  // 17: com.axgrid.axgate.GateData.trailer:type_name -> com.axgrid.axgate.GateHeader
+	13, // 18: com.axgrid.axgate.GateHandshake.access:type_name -> com.axgrid.axgate.GateAccess
+	11, // 19: com.axgrid.axgate.GateHandshake.services:type_name -> com.axgrid.axgate.GateService
+	13, // 20: com.axgrid.axgate.GateService.access:type_name -> com.axgrid.axgate.GateAccess
+	11, // 21: com.axgrid.axgate.GateRegister.add:type_name -> com.axgrid.axgate.GateService
+	14, // 22: com.axgrid.axgate.GateAccess.users:type_name -> com.axgrid.axgate.GateUser
+	23, // [23:23] is the sub-list for method output_type
+	23, // [23:23] is the sub-list for method input_type
+	23, // [23:23] is the sub-list for extension type_name
+	23, // [23:23] is the sub-list for extension extendee
+	0,  // [0:23] is the sub-list for field type_name
 }
 
 func init() { file_gate_proto_init() }
@@ -624,6 +1518,42 @@ func file_gate_proto_init() {
 			}
 		}
 		file_gate_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GateData); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gate_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GateCancel); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gate_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GateWindow); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gate_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*GateHandshake); i {
 			case 0:
 				return &v.state
@@ -635,19 +1565,80 @@ func file_gate_proto_init() {
 				return nil
 			}
 		}
+		file_gate_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GateService); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gate_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GateRegister); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gate_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GateAccess); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gate_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GateUser); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gate_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GateHandshakeAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_gate_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   6,
+			NumEnums:      2,
+			NumMessages:   14,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_gate_proto_goTypes,
 		DependencyIndexes: file_gate_proto_depIdxs,
+		EnumInfos:         file_gate_proto_enumTypes,
 		MessageInfos:      file_gate_proto_msgTypes,
 	}.Build()
 	File_gate_proto = out.File
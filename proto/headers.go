@@ -0,0 +1,150 @@
+package proto
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hop-by-hop headers, RFC 7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders drops hop-by-hop headers and the ones listed in Connection.
+// "TE: trailers" survives, gRPC needs it end to end.
+func RemoveHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, sf := range strings.Split(f, ",") {
+			if sf = textproto.TrimString(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+	trailers := false
+	for _, v := range h["Te"] {
+		for _, sv := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(sv), "trailers") {
+				trailers = true
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// ParseTrustedProxies parses networks (or single addresses) of proxies
+// whose forwarding headers are kept
+func ParseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	return ParseNetworks(list)
+}
+
+// ParseNetworks parses networks in CIDR notation or single addresses, blanks are skipped
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %s", s)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// RemoteIP returns the address part of GateRequest.RemoteAddr
+func (x *GateRequest) RemoteIP() string {
+	host, _, err := net.SplitHostPort(x.RemoteAddr)
+	if err != nil {
+		return x.RemoteAddr
+	}
+	return host
+}
+
+// SetForwarded adds X-Forwarded-For/Proto/Host and Forwarded headers.
+// Forwarding headers of the incoming request are kept only when
+// it came from one of the trusted proxies.
+func (x *GateRequest) SetForwarded(scheme string, trusted []*net.IPNet) {
+	h := FromGateHeader(x.Header)
+	ip := x.RemoteIP()
+	if !ContainsIP(trusted, net.ParseIP(ip)) {
+		h.Del("X-Forwarded-For")
+		h.Del("X-Forwarded-Proto")
+		h.Del("X-Forwarded-Host")
+		h.Del("Forwarded")
+	}
+	if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+		h.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip)
+	} else {
+		h.Set("X-Forwarded-For", ip)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", scheme)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", x.Host)
+	}
+	node := ip
+	if strings.Contains(ip, ":") {
+		node = "[" + ip + "]"
+	}
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", quoteForwarded(node), quoteForwarded(x.Host), scheme)
+	if prior := h.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	h.Set("Forwarded", element)
+	x.Header = ToGateHeader(h)
+}
+
+// quoteForwarded quotes a Forwarded value unless it is a token, RFC 7239
+func quoteForwarded(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
+
+// ContainsIP tells if ip is in one of nets
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,17 +2,75 @@ package proto
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"google.golang.org/protobuf/proto"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"strings"
 	"sync/atomic"
 )
 
+// currentId numbers streams of requests, RequestId is the one to show people
 var currentId uint64
 
+// NextID returns a new stream number for a request
+func NextID() uint64 {
+	return atomic.AddUint64(&currentId, 1)
+}
+
+// RequestIDHeader carries the request id to the service and back to the caller
+const RequestIDHeader = "X-Request-Id"
+
+// RequestID returns X-Request-Id of req if it is a sane one, a new id otherwise
+func RequestID(req *http.Request) string {
+	if id := req.Header.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	return NewRequestID()
+}
+
+// NewRequestID makes a random 128-bit id, unique across restarts and instances
+func NewRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID keeps ids of callers to printable ascii fit for logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// MaxBodySize bounds bodies NewGateRequest and NewGateResponse read into memory
+var MaxBodySize int64 = 64 * 1024 * 1024
+
+var ErrBodyTooLarge = errors.New("body is too large")
+
+// ReadBody reads r to the end, ErrBodyTooLarge if it has more than limit bytes
+func ReadBody(r io.Reader, limit int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return b, nil
+}
+
+// ToGateHeader converts header without hop-by-hop headers, values are kept as is
 func ToGateHeader(header http.Header) []*GateHeader {
+	header = header.Clone()
+	RemoveHopHeaders(header)
 	var res []*GateHeader
 	for k, v := range header {
 		res = append(res, &GateHeader{
@@ -23,11 +81,16 @@ func ToGateHeader(header http.Header) []*GateHeader {
 	return res
 }
 
+// FromGateHeader converts header without hop-by-hop headers,
+// peers made before they were stripped may still send them
 func FromGateHeader(header []*GateHeader) http.Header {
 	res := http.Header{}
 	for _, h := range header {
-		res[h.Key] = h.Values
+		for _, v := range h.Values {
+			res.Add(h.Key, v)
+		}
 	}
+	RemoveHopHeaders(res)
 	return res
 }
 
@@ -37,21 +100,77 @@ func (x *GateRequest) ToHttp() (*http.Request, error) {
 		return nil, err
 	}
 	res.Header = FromGateHeader(x.Header)
+	if len(x.Trailer) > 0 {
+		// announced trailers of a streamed body come without values
+		res.Trailer = http.Header{}
+		for _, h := range x.Trailer {
+			res.Trailer[http.CanonicalHeaderKey(h.Key)] = h.Values
+		}
+	}
+	res.Host = x.Host
+	res.RemoteAddr = x.RemoteAddr
+	res.RequestURI = x.Url
 	return res, nil
 }
+
 func (x *GateResponse) ToHttp(w http.ResponseWriter) error {
-	for _, hd := range x.Header {
-		w.Header().Add(hd.Key, strings.Join(hd.Values, ","))
+	for k, v := range FromGateHeader(x.Header) {
+		w.Header()[k] = append(w.Header()[k], v...)
 	}
 	w.Header().Add("x-gate-ref", x.Name)
+	for _, h := range x.Trailer {
+		w.Header().Add("Trailer", h.Key)
+	}
 	w.WriteHeader((int)(x.StatusCode))
 	_, err := w.Write(x.Body)
+	WriteTrailer(w, x.Trailer)
 	return err
 }
 
+// TrailerKeys returns trailer without values, it announces trailers in a head
+// when the values come later with the body
+func TrailerKeys(trailer []*GateHeader) []*GateHeader {
+	var res []*GateHeader
+	for _, h := range trailer {
+		res = append(res, &GateHeader{Key: h.Key})
+	}
+	return res
+}
+
+// WriteTrailer sets trailer on w, call it after the body is written
+func WriteTrailer(w http.ResponseWriter, trailer []*GateHeader) {
+	for k, v := range FromGateHeader(trailer) {
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+}
+
+// hasBody tells if the request has a body regardless of its method
+func hasBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return false
+	}
+	return req.ContentLength != 0 || len(req.TransferEncoding) > 0
+}
+
+// NewGateRequest converts req with its whole body, up to MaxBodySize
 func NewGateRequest(req *http.Request) (*GateRequest, error) {
-	res := &GateRequest{
-		Id:            atomic.AddUint64(&currentId, 1),
+	res := NewGateRequestHead(req)
+	if body := NewRequestBody(req); body != nil {
+		bodyBytes, err := ReadBody(body, MaxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		res.Body = bodyBytes
+		res.Trailer = body.Trailer()
+	}
+	return res, nil
+}
+
+// NewGateRequestHead converts req without body
+func NewGateRequestHead(req *http.Request) *GateRequest {
+	return &GateRequest{
+		Id:            NextID(),
+		RequestId:     RequestID(req),
 		Method:        req.Method,
 		Url:           req.RequestURI,
 		Header:        ToGateHeader(req.Header),
@@ -59,30 +178,46 @@ func NewGateRequest(req *http.Request) (*GateRequest, error) {
 		RemoteAddr:    req.RemoteAddr,
 		ContentLength: req.ContentLength,
 	}
+}
 
-	switch req.Method {
-	case "POST", "PUT", "PATCH":
-		bodyBytes, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			return nil, err
-		}
-		res.Body = bodyBytes
+// RequestBody is a request body which knows its trailer
+type RequestBody struct {
+	req *http.Request
+}
+
+// NewRequestBody returns the body of req regardless of its method, nil if there is no body
+func NewRequestBody(req *http.Request) *RequestBody {
+	if !hasBody(req) {
+		return nil
 	}
-	return res, nil
+	return &RequestBody{req: req}
 }
+
+func (b *RequestBody) Read(p []byte) (int, error) { return b.req.Body.Read(p) }
+
+// Trailer returns the request trailer, values are set once the body is read
+func (b *RequestBody) Trailer() []*GateHeader { return ToGateHeader(b.req.Trailer) }
+
+// NewGateResponse converts resp with its whole body, up to MaxBodySize
 func NewGateResponse(resp *http.Response) (*GateResponse, error) {
-	body, err := io.ReadAll(resp.Body)
+	body, err := ReadBody(resp.Body, MaxBodySize)
 	if err != nil {
 		return nil, err
 	}
+	res := NewGateResponseHead(resp)
+	res.Body = body
+	res.Trailer = ToGateHeader(resp.Trailer)
+	return res, nil
+}
 
-	res := &GateResponse{
+// NewGateResponseHead converts resp without body, trailer keys are announced
+func NewGateResponseHead(resp *http.Response) *GateResponse {
+	return &GateResponse{
 		StatusCode:    int32(resp.StatusCode),
 		ContentLength: resp.ContentLength,
 		Header:        ToGateHeader(resp.Header),
-		Body:          body,
+		Trailer:       TrailerKeys(ToGateHeader(resp.Trailer)),
 	}
-	return res, nil
 }
 
 func GetPacket(b []byte) (*Packet, error) {
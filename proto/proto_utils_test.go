@@ -0,0 +1,183 @@
+package proto
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseKeepsMultiValueHeaders(t *testing.T) {
+	rs := &GateResponse{
+		Name:       "svc",
+		StatusCode: 200,
+		Header: ToGateHeader(http.Header{
+			"Set-Cookie": {"a=1; Path=/", "b=2; Expires=Wed, 21 Oct 2015 07:28:00 GMT"},
+			"Connection": {"close"},
+		}),
+	}
+	w := httptest.NewRecorder()
+	require.NoError(t, rs.ToHttp(w))
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Expires=Wed, 21 Oct 2015 07:28:00 GMT"}, w.Header().Values("Set-Cookie"))
+	assert.Empty(t, w.Header().Get("Connection"))
+}
+
+func TestHopHeadersRemoved(t *testing.T) {
+	h := http.Header{
+		"Connection":        {"keep-alive, X-Private"},
+		"X-Private":         {"secret"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"Upgrade":           {"websocket"},
+		"Te":                {"trailers, deflate"},
+		"Content-Type":      {"text/plain"},
+	}
+	res := FromGateHeader(ToGateHeader(h))
+	assert.Equal(t, http.Header{"Content-Type": {"text/plain"}, "Te": {"trailers"}}, res)
+	assert.Equal(t, "secret", h.Get("X-Private"), "source header is not changed")
+
+	// peers which do not strip them
+	res = FromGateHeader([]*GateHeader{{Key: "Upgrade", Values: []string{"h2c"}}, {Key: "Accept", Values: []string{"*/*"}}})
+	assert.Equal(t, http.Header{"Accept": {"*/*"}}, res)
+}
+
+func TestSetForwarded(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	require.NoError(t, err)
+	incoming := http.Header{
+		"X-Forwarded-For":   {"1.2.3.4"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=1.2.3.4;proto=https"},
+	}
+
+	rq := &GateRequest{Host: "svc.gate.io", RemoteAddr: "10.1.1.1:5555", Header: ToGateHeader(incoming)}
+	rq.SetForwarded("http", trusted)
+	h := FromGateHeader(rq.Header)
+	assert.Equal(t, "1.2.3.4, 10.1.1.1", h.Get("X-Forwarded-For"))
+	assert.Equal(t, "https", h.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "svc.gate.io", h.Get("X-Forwarded-Host"))
+	assert.Equal(t, "for=1.2.3.4;proto=https, for=10.1.1.1;host=svc.gate.io;proto=http", h.Get("Forwarded"))
+
+	rq = &GateRequest{Host: "svc.gate.io:8080", RemoteAddr: "[2001:db8::1]:5555", Header: ToGateHeader(incoming)}
+	rq.SetForwarded("http", trusted)
+	h = FromGateHeader(rq.Header)
+	assert.Equal(t, "2001:db8::1", h.Get("X-Forwarded-For"))
+	assert.Equal(t, "http", h.Get("X-Forwarded-Proto"))
+	assert.Equal(t, `for="[2001:db8::1]";host="svc.gate.io:8080";proto=http`, h.Get("Forwarded"))
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	_, err := ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+	res, err := ParseTrustedProxies([]string{"", " 192.168.0.1 "})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "192.168.0.1/32", res[0].String())
+}
+
+func TestNewGateRequestReadsBodyForAnyMethod(t *testing.T) {
+	var got []*GateRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rq, err := NewGateRequest(r)
+		require.NoError(t, err)
+		got = append(got, rq)
+	}))
+	defer srv.Close()
+
+	for _, method := range []string{"GET", "DELETE", "OPTIONS", "SEARCH"} {
+		rq, err := http.NewRequest(method, srv.URL+"/_search", strings.NewReader(`{"query":{}}`))
+		require.NoError(t, err)
+		_, err = http.DefaultClient.Do(rq)
+		require.NoError(t, err)
+	}
+	rq, err := http.NewRequest("GET", srv.URL, nil)
+	require.NoError(t, err)
+	_, err = http.DefaultClient.Do(rq)
+	require.NoError(t, err)
+
+	require.Len(t, got, 5)
+	for _, rq := range got[:4] {
+		assert.Equal(t, `{"query":{}}`, string(rq.Body), rq.Method)
+	}
+	assert.Empty(t, got[4].Body)
+}
+
+func TestRequestTrailers(t *testing.T) {
+	var got *GateRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		got, err = NewGateRequest(r)
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	rq, err := http.NewRequest("POST", srv.URL, io.MultiReader(strings.NewReader("chunked body")))
+	require.NoError(t, err)
+	rq.Trailer = http.Header{"X-Checksum": {"abc"}}
+	_, err = http.DefaultClient.Do(rq)
+	require.NoError(t, err)
+
+	require.NotNil(t, got)
+	assert.Equal(t, "chunked body", string(got.Body))
+	assert.Equal(t, http.Header{"X-Checksum": {"abc"}}, FromGateHeader(got.Trailer))
+
+	hr, err := got.ToHttp()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", hr.Trailer.Get("X-Checksum"))
+}
+
+func TestGrpcStyleResponseTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	}))
+	defer upstream.Close()
+	resp, err := http.Get(upstream.URL)
+	require.NoError(t, err)
+	rs, err := NewGateResponse(resp)
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}}, FromGateHeader(rs.Trailer))
+	assert.Empty(t, FromGateHeader(rs.Header).Get("Trailer"))
+
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, rs.ToHttp(w))
+	}))
+	defer front.Close()
+	resp, err = http.Get(front.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "message", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "ok", resp.Trailer.Get("Grpc-Message"))
+}
+
+func TestNewGateRequestBodyLimit(t *testing.T) {
+	defer func(n int64) { MaxBodySize = n }(MaxBodySize)
+	MaxBodySize = 4
+	_, err := NewGateRequest(httptest.NewRequest("POST", "/", strings.NewReader("12345")))
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	rq, err := NewGateRequest(httptest.NewRequest("POST", "/", strings.NewReader("1234")))
+	require.NoError(t, err)
+	assert.Equal(t, "1234", string(rq.Body))
+}
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	a, b := RequestID(r), RequestID(r)
+	assert.Len(t, a, 32)
+	assert.NotEqual(t, a, b)
+
+	r.Header.Set(RequestIDHeader, "caller-42")
+	assert.Equal(t, "caller-42", NewGateRequestHead(r).RequestId)
+	for _, bad := range []string{"two words", "quote\"", strings.Repeat("x", 129), "tab\t"} {
+		r.Header.Set(RequestIDHeader, bad)
+		assert.NotEqual(t, bad, RequestID(r))
+	}
+}
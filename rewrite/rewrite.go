@@ -0,0 +1,113 @@
+// Package rewrite changes headers, paths and queries of requests and responses
+// passing through the gate by rules from the config
+package rewrite
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// Rules of one service, applied in the order: path, query, host, headers
+type Rules struct {
+	Path     []PathRule  `yaml:"path"`
+	Query    QueryRules  `yaml:"query"`
+	Host     string      `yaml:"host"` // Host sent upstream, empty - as is
+	Request  HeaderRules `yaml:"request"`
+	Response HeaderRules `yaml:"response"`
+}
+
+// PathRule replaces matches of the Match regexp in the escaped path, Replace may use $1 or ${name}
+type PathRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+
+	re *regexp.Regexp
+}
+
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+	Remove []string          `yaml:"remove"`
+}
+
+type QueryRules struct {
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+	Remove []string          `yaml:"remove"`
+}
+
+// Compile checks the rules, call it before they are used: path rules which are not compiled are skipped
+func (r *Rules) Compile() error {
+	for i := range r.Path {
+		re, err := regexp.Compile(r.Path[i].Match)
+		if err != nil {
+			return fmt.Errorf("path rule %d: %w", i, err)
+		}
+		r.Path[i].re = re
+	}
+	return nil
+}
+
+// RewriteRequest applies the rules to req, RequestURI follows the new URL
+func (r *Rules) RewriteRequest(req *http.Request) {
+	if r == nil {
+		return
+	}
+	if len(r.Path) > 0 {
+		// escapes like %2F are kept, they are not path separators
+		escaped := req.URL.EscapedPath()
+		path := escaped
+		for _, p := range r.Path {
+			if p.re != nil {
+				path = p.re.ReplaceAllString(path, p.Replace)
+			}
+		}
+		if path != escaped {
+			if unescaped, err := url.PathUnescape(path); err == nil {
+				req.URL.Path, req.URL.RawPath = unescaped, path
+			}
+		}
+	}
+	if len(r.Query.Set) > 0 || len(r.Query.Add) > 0 || len(r.Query.Remove) > 0 {
+		q := req.URL.Query()
+		for _, k := range r.Query.Remove {
+			q.Del(k)
+		}
+		for k, v := range r.Query.Set {
+			q.Set(k, v)
+		}
+		for k, v := range r.Query.Add {
+			q.Add(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	if r.Host != "" {
+		req.Host = r.Host
+	}
+	r.Request.apply(req.Header)
+	if req.RequestURI != "" {
+		req.RequestURI = req.URL.RequestURI()
+	}
+}
+
+// RewriteResponse applies the response header rules to h
+func (r *Rules) RewriteResponse(h http.Header) {
+	if r == nil {
+		return
+	}
+	r.Response.apply(h)
+}
+
+func (r *HeaderRules) apply(h http.Header) {
+	for _, k := range r.Remove {
+		h.Del(k)
+	}
+	for k, v := range r.Set {
+		h.Set(k, v)
+	}
+	for k, v := range r.Add {
+		h.Add(k, v)
+	}
+}
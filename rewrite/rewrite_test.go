@@ -0,0 +1,115 @@
+package rewrite
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func compiled(t *testing.T, r *Rules) *Rules {
+	require.NoError(t, r.Compile())
+	return r
+}
+
+func TestRequestHeaders(t *testing.T) {
+	r := compiled(t, &Rules{Request: HeaderRules{
+		Set:    map[string]string{"X-Env": "preview"},
+		Add:    map[string]string{"Via": "gate"},
+		Remove: []string{"Authorization"},
+	}})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Env", "prod")
+	req.Header.Set("Via", "1.1 proxy")
+	r.RewriteRequest(req)
+	assert.Empty(t, req.Header.Get("Authorization"))
+	assert.Equal(t, []string{"preview"}, req.Header.Values("X-Env"))
+	assert.Equal(t, []string{"1.1 proxy", "gate"}, req.Header.Values("Via"))
+}
+
+func TestResponseHeaders(t *testing.T) {
+	r := compiled(t, &Rules{Response: HeaderRules{
+		Set:    map[string]string{"Cache-Control": "no-store"},
+		Remove: []string{"Server"},
+	}})
+	h := http.Header{"Server": {"dev-laptop"}, "Cache-Control": {"max-age=60"}}
+	r.RewriteResponse(h)
+	assert.Equal(t, http.Header{"Cache-Control": {"no-store"}}, h)
+}
+
+func TestPath(t *testing.T) {
+	r := compiled(t, &Rules{Path: []PathRule{
+		{Match: "^/api/v1(/|$)", Replace: "/v1$1"},
+		{Match: "^/old/(?P<rest>.*)", Replace: "/new/${rest}"},
+	}})
+	for path, want := range map[string]string{
+		"/api/v1/users?id=1": "/v1/users?id=1",
+		"/api/v1":            "/v1",
+		"/api/v10/users":     "/api/v10/users",
+		"/old/a%2Fb":         "/new/a%2Fb",
+		"/old/a%20b":         "/new/a%20b",
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		r.RewriteRequest(req)
+		assert.Equal(t, want, req.RequestURI, path)
+		assert.Equal(t, want, req.URL.RequestURI(), path)
+	}
+	assert.Error(t, (&Rules{Path: []PathRule{{Match: "("}}}).Compile())
+	// rules which are not compiled do nothing
+	req := httptest.NewRequest("GET", "/old/a", nil)
+	(&Rules{Path: []PathRule{{Match: "^/old", Replace: "/new"}}}).RewriteRequest(req)
+	assert.Equal(t, "/old/a", req.RequestURI)
+}
+
+func TestQuery(t *testing.T) {
+	r := compiled(t, &Rules{Query: QueryRules{
+		Set:    map[string]string{"env": "preview"},
+		Add:    map[string]string{"tag": "gate"},
+		Remove: []string{"token"},
+	}})
+	req := httptest.NewRequest("GET", "/search?q=go&token=secret&env=prod&tag=a", nil)
+	r.RewriteRequest(req)
+	q := req.URL.Query()
+	assert.Equal(t, "go", q.Get("q"))
+	assert.Empty(t, q.Get("token"))
+	assert.Equal(t, []string{"preview"}, q["env"])
+	assert.Equal(t, []string{"a", "gate"}, q["tag"])
+	assert.Equal(t, req.URL.RequestURI(), req.RequestURI)
+}
+
+func TestHost(t *testing.T) {
+	r := compiled(t, &Rules{Host: "app.local"})
+	req := httptest.NewRequest("GET", "http://svc.gate.test/", nil)
+	r.RewriteRequest(req)
+	assert.Equal(t, "app.local", req.Host)
+
+	req = httptest.NewRequest("GET", "http://svc.gate.test/", nil)
+	(*Rules)(nil).RewriteRequest(req)
+	assert.Equal(t, "svc.gate.test", req.Host)
+}
+
+func TestYaml(t *testing.T) {
+	var r Rules
+	require.NoError(t, yaml.Unmarshal([]byte(`
+path:
+  - match: ^/api/v1
+    replace: /v1
+query:
+  remove: [debug]
+host: app.local
+request:
+  set: {X-Env: preview}
+  remove: [Authorization]
+response:
+  add: {X-Served-By: gate}
+`), &r))
+	require.NoError(t, r.Compile())
+	assert.Equal(t, "/v1", r.Path[0].Replace)
+	assert.Equal(t, []string{"debug"}, r.Query.Remove)
+	assert.Equal(t, "app.local", r.Host)
+	assert.Equal(t, "preview", r.Request.Set["X-Env"])
+	assert.Equal(t, "gate", r.Response.Add["X-Served-By"])
+}
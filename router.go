@@ -0,0 +1,135 @@
+package axgate
+
+import (
+	"errors"
+	"fmt"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/rewrite"
+	"github.com/axgrid/axgate/tcp"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Route sends requests with the path under Prefix to an upstream,
+// a static directory or a handler, exactly one of them is set
+type Route struct {
+	Prefix string `yaml:"prefix"`
+	// StripPrefix removes Prefix from the path, /api/users goes as /users
+	StripPrefix bool         `yaml:"strip_prefix"`
+	Upstream    *Upstream    `yaml:"upstream"`
+	Dir         string       `yaml:"dir"`
+	Handler     http.Handler `yaml:"-"`
+	// Static options of Dir
+	Static *StaticOptions `yaml:"static"`
+
+	exchange exchangeHandler
+}
+
+// Router picks the route with the longest prefix matching the request path
+type Router struct {
+	routes []*Route
+}
+
+// NewRouter checks the routes of the service and prepares their upstreams
+func NewRouter(name string, routes ...*Route) (*Router, error) {
+	return newRouter(name, nil, routes...)
+}
+
+// newRouter is NewRouter with compiled rewrite rules of the upstreams, nil - the ones of SetRules
+func newRouter(name string, rules *rewrite.Rules, routes ...*Route) (*Router, error) {
+	r := &Router{}
+	for _, route := range routes {
+		set := 0
+		if route.Upstream != nil {
+			set++
+		}
+		if route.Dir != "" {
+			set++
+		}
+		if route.Handler != nil {
+			set++
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("route %s: set one of upstream, dir or handler", route.Prefix)
+		}
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return nil, fmt.Errorf("route %s: prefix must start with /", route.Prefix)
+		}
+		switch {
+		case route.Upstream != nil:
+			h, err := route.Upstream.exchange(name, rules)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", route.Prefix, err)
+			}
+			route.exchange = h
+		case route.Dir != "":
+			h, err := NewStaticHandler(route.Dir, route.Static)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", route.Prefix, err)
+			}
+			route.exchange = handlerExchange(h)
+		default:
+			route.exchange = handlerExchange(route.Handler)
+		}
+		r.routes = append(r.routes, route)
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool { return len(r.routes[i].Prefix) > len(r.routes[j].Prefix) })
+	return r, nil
+}
+
+// NewRouterClient tunnels requests of the service to the routes
+func NewRouterClient(name string, gateAddress string, routes []*Route, args ...string) error {
+	if len(routes) == 0 {
+		return errors.New("no routes")
+	}
+	r, err := NewRouter(name, routes...)
+	if err != nil {
+		return err
+	}
+	return tcp.NewStreamClient(name, gateAddress, r.exchange, args...)
+}
+
+// match returns the route for path, nil if there is none
+func (r *Router) match(path string) *Route {
+	for _, route := range r.routes {
+		if matchPrefix(path, route.Prefix) {
+			return route
+		}
+	}
+	return nil
+}
+
+// matchPrefix matches whole path segments: /api matches /api and /api/users, not /apix
+func matchPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func (r *Router) exchange(request *pproto.GateRequest, ex *tcp.Exchange) error {
+	path, query := request.Url, ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i:]
+	}
+	route := r.match(path)
+	if route == nil {
+		if err := ex.WriteHead(&pproto.GateResponse{
+			StatusCode: http.StatusNotFound,
+			Header:     []*pproto.GateHeader{{Key: "Content-Type", Values: []string{"text/plain; charset=utf-8"}}},
+		}); err != nil {
+			return err
+		}
+		_, err := ex.Write([]byte("404 page not found\n"))
+		return err
+	}
+	if route.StripPrefix {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(route.Prefix, "/"))
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		request.Url = path + query
+	}
+	return route.exchange(request, ex)
+}
@@ -0,0 +1,131 @@
+package axgate
+
+import (
+	"fmt"
+	"github.com/axgrid/axgate/rewrite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRouterMatch(t *testing.T) {
+	ok := http.NotFoundHandler()
+	r, err := NewRouter("svc",
+		&Route{Prefix: "/", Handler: ok},
+		&Route{Prefix: "/api", Handler: ok},
+		&Route{Prefix: "/api/v2/", Handler: ok},
+	)
+	require.NoError(t, err)
+	for path, want := range map[string]string{
+		"/":          "/",
+		"/api":       "/api",
+		"/api/users": "/api",
+		"/apix":      "/",
+		"/api/v2/x":  "/api/v2/",
+		"/api/v2":    "/api",
+	} {
+		assert.Equal(t, want, r.match(path).Prefix, path)
+	}
+
+	r, err = NewRouter("svc", &Route{Prefix: "/api", Handler: ok})
+	require.NoError(t, err)
+	assert.Nil(t, r.match("/static"))
+
+	_, err = NewRouter("svc", &Route{Prefix: "/", Handler: ok, Dir: "."})
+	assert.Error(t, err)
+	_, err = NewRouter("svc", &Route{Prefix: "api", Handler: ok})
+	assert.Error(t, err)
+}
+
+func TestRouterClientFromConfig(t *testing.T) {
+	echo := func(tag string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", tag, r.URL.RequestURI())
+		}))
+	}
+	api, ws := echo("api"), echo("ws")
+	defer api.Close()
+	defer ws.Close()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("static"), 0600))
+
+	tcpAddress, httpAddress := startGate(t)
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`
+gate: %s
+services:
+  routed:
+    routes:
+      - prefix: /api
+        upstream: {address: %q}
+      - prefix: /ws/
+        strip_prefix: true
+        upstream: {address: %q}
+      - prefix: /
+        dir: %q
+`, tcpAddress, api.URL, ws.URL, dir)), 0600))
+	config, err := LoadClientConfig(path)
+	require.NoError(t, err)
+	go config.Run()
+
+	get := func(path string) (int, string) {
+		rq, _ := http.NewRequest("GET", "http://"+httpAddress+path, nil)
+		rq.Host = "routed.gate.test"
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	require.Eventually(t, func() bool {
+		code, _ := get("/")
+		return code == 200
+	}, 5*time.Second, 50*time.Millisecond)
+
+	for path, want := range map[string]string{
+		"/api/users?id=1": "api /api/users?id=1",
+		"/ws/chat?room=1": "ws /chat?room=1",
+		"/ws/":            "ws /",
+		"/":               "static",
+	} {
+		code, body := get(path)
+		assert.Equal(t, 200, code, path)
+		assert.Equal(t, want, body, path)
+	}
+	code, _ := get("/missing.txt")
+	assert.Equal(t, 404, code)
+}
+
+func TestClientConfigRules(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer srv.Close()
+	// rules set before are kept for services the config has no rules for
+	require.NoError(t, SetRules("rules-kept", &rewrite.Rules{Path: []rewrite.PathRule{{Match: "^/$", Replace: "/kept"}}}))
+	defer SetRules("rules-kept", nil)
+
+	tcpAddress, httpAddress := startGate(t)
+	upstream := func() []*Route { return []*Route{{Prefix: "/", Upstream: &Upstream{Address: srv.URL}}} }
+	config := &ClientConfig{Gate: tcpAddress, Services: map[string]*ClientService{
+		"rules-kept":   {Routes: upstream()},
+		"rules-config": {Routes: upstream(), Rewrite: &rewrite.Rules{Path: []rewrite.PathRule{{Match: "^/$", Replace: "/config"}}}},
+	}}
+	client, err := config.NewClient()
+	require.NoError(t, err)
+	go client.Run()
+	defer client.Close()
+
+	assert.Equal(t, "/kept", eventually(t, httpAddress, "rules-kept"))
+	assert.Equal(t, "/config", eventually(t, httpAddress, "rules-config"))
+	// the rules of the config stay on its client
+	assert.Nil(t, rulesOf("rules-config"))
+}
@@ -0,0 +1,179 @@
+package axgate
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// StaticOptions of a directory served by NewStaticClient, nil - listings only
+type StaticOptions struct {
+	// NoListing answers 404 for directories without index.html
+	NoListing bool `yaml:"no_listing"`
+	// SPA serves /index.html for missing paths without an extension,
+	// client side routes of single page apps need it
+	SPA bool `yaml:"spa"`
+	// Zip lets download a directory as a zip archive made on the fly, /dir/?zip
+	Zip bool `yaml:"zip"`
+}
+
+// NewStaticClient serves files of dir to the service
+func NewStaticClient(name string, gateAddress string, dir string, opts *StaticOptions, args ...string) error {
+	h, err := NewStaticHandler(dir, opts)
+	if err != nil {
+		return err
+	}
+	return tcp.NewStreamClient(name, gateAddress, handlerExchange(h), args...)
+}
+
+type staticHandler struct {
+	fsys fs.FS
+	opts StaticOptions
+}
+
+// NewStaticHandler serves files of dir with Range, ETag and If-None-Match support
+func NewStaticHandler(dir string, opts *StaticOptions) (http.Handler, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	h := &staticHandler{fsys: os.DirFS(dir)}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h, nil
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	st, err := fs.Stat(h.fsys, fsName(name))
+	if errors.Is(err, fs.ErrNotExist) && h.opts.SPA && path.Ext(name) == "" {
+		name = "/index.html"
+		st, err = fs.Stat(h.fsys, "index.html")
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !st.IsDir() {
+		h.serveFile(w, r, name)
+		return
+	}
+	if h.opts.Zip && r.URL.Query().Has("zip") {
+		h.serveZip(w, r, name)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(name)+"/", http.StatusMovedPermanently)
+		return
+	}
+	index := path.Join(name, "index.html")
+	if st, err := fs.Stat(h.fsys, fsName(index)); err == nil && !st.IsDir() {
+		h.serveFile(w, r, index)
+		return
+	}
+	if h.opts.NoListing {
+		http.NotFound(w, r)
+		return
+	}
+	http.FileServer(http.FS(h.fsys)).ServeHTTP(w, r)
+}
+
+// serveFile answers ranges and conditional requests by http.ServeContent
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.fsys.Open(fsName(name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, st.ModTime().UnixNano(), st.Size()))
+	http.ServeContent(w, r, name, st.ModTime(), rs)
+}
+
+// serveZip streams the directory as a zip archive, errors after the head
+// is sent only cut the archive
+func (h *staticHandler) serveZip(w http.ResponseWriter, r *http.Request, name string) {
+	base := path.Base(name)
+	if base == "/" {
+		base = "root"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, base))
+	zw := zip.NewWriter(w)
+	root := fsName(name)
+	err := fs.WalkDir(h.fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		if root == "." {
+			hdr.Name = p
+		}
+		hdr.Method = zip.Deflate
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		f, err := h.fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(dst, f)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("dir", name).Str("request-id", r.Header.Get(pproto.RequestIDHeader)).Msg("fail to zip directory")
+	}
+}
+
+// fsName turns a cleaned url path into an fs.FS name
+func fsName(name string) string {
+	if name == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,127 @@
+package axgate
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func staticDir(t *testing.T) string {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "docs", "img"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>app</h1>"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.js"), []byte("0123456789"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "a.txt"), []byte("a"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "img", "b.txt"), []byte("b"), 0600))
+	return dir
+}
+
+func fetch(t *testing.T, url string, header ...string) (*http.Response, string) {
+	rq, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i] == "Host" {
+			rq.Host = header[i+1]
+		} else {
+			rq.Header.Set(header[i], header[i+1])
+		}
+	}
+	resp, err := http.DefaultTransport.RoundTrip(rq)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(b)
+}
+
+func TestStaticHandler(t *testing.T) {
+	h, err := NewStaticHandler(staticDir(t), &StaticOptions{SPA: true, Zip: true})
+	require.NoError(t, err)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, body := fetch(t, srv.URL+"/app.js")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0123456789", body)
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	resp, _ = fetch(t, srv.URL+"/app.js", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, body = fetch(t, srv.URL+"/app.js", "Range", "bytes=2-4")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "234", body)
+
+	// spa fallback only for paths without an extension
+	resp, body = fetch(t, srv.URL+"/users/42")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "<h1>app</h1>", body)
+	resp, _ = fetch(t, srv.URL+"/missing.js")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	resp, _ = fetch(t, srv.URL+"/docs")
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	resp, body = fetch(t, srv.URL+"/docs/")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, body, `<a href="a.txt">a.txt</a>`)
+
+	resp, body = fetch(t, srv.URL+"/docs/?zip")
+	assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	zr, err := zip.NewReader(bytes.NewReader([]byte(body)), int64(len(body)))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.ElementsMatch(t, []string{"a.txt", "img/b.txt"}, names)
+
+	_, body = fetch(t, srv.URL+"/../../etc/passwd")
+	assert.Equal(t, "<h1>app</h1>", body)
+}
+
+func TestStaticHandlerOptions(t *testing.T) {
+	h, err := NewStaticHandler(staticDir(t), &StaticOptions{NoListing: true})
+	require.NoError(t, err)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, _ := fetch(t, srv.URL+"/docs/")
+	assert.Equal(t, 404, resp.StatusCode)
+	resp, _ = fetch(t, srv.URL+"/docs/?zip")
+	assert.Equal(t, 404, resp.StatusCode)
+	resp, _ = fetch(t, srv.URL+"/users/42")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	_, err = NewStaticHandler(filepath.Join(t.TempDir(), "missing"), nil)
+	assert.Error(t, err)
+}
+
+func TestStaticClient(t *testing.T) {
+	dir := staticDir(t)
+	big := strings.Repeat("x", 3*flushSize)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "big.bin"), []byte(big), 0600))
+	tcpAddress, httpAddress := startGate(t)
+	go NewStaticClient("static", tcpAddress, dir, nil)
+	eventually(t, httpAddress, "static")
+
+	get := func(path string, header ...string) (*http.Response, string) {
+		return fetch(t, "http://"+httpAddress+path, append([]string{"Host", "static.gate.test"}, header...)...)
+	}
+	_, body := get("/big.bin")
+	assert.Equal(t, big, body)
+	resp, body := get("/big.bin", "Range", "bytes=10-19")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "xxxxxxxxxx", body)
+	resp, _ = get("/app.js", "If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
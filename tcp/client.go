@@ -1,16 +1,23 @@
 package tcp
 
 import (
+	"errors"
+	"fmt"
 	pproto "github.com/axgrid/axgate/proto"
-	bit_utils "github.com/axgrid/axgate/shared/bit-utils"
+	"github.com/axgrid/axgate/tracing"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/protobuf/proto"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
+// reconnectTTL is the first pause before reconnecting to the gate, it doubles
+// up to maxReconnectTTL while connections fail or do not last
 var reconnectTTL = time.Millisecond * 100
+var maxReconnectTTL = time.Second * 30
 var pingTTL = time.Second * 10
 var tr = &http.Transport{
 	MaxIdleConns:       10,
@@ -18,56 +25,322 @@ var tr = &http.Transport{
 	DisableCompression: true,
 }
 
+// protection asked from the gate by service name
+var (
+	access     = map[string]*pproto.GateAccess{}
+	accessLock sync.Mutex
+)
+
+// SetAccess asks the gate to let only matching callers to the service,
+// it is sent in the handshake so it applies from the next (re)connect
+func SetAccess(name string, a *pproto.GateAccess) {
+	accessLock.Lock()
+	defer accessLock.Unlock()
+	if a == nil {
+		delete(access, name)
+	} else {
+		access[name] = a
+	}
+}
+
 type fListener func(request *pproto.GateRequest) (*pproto.GateResponse, error)
 
 func NewClient(name string, gateAddress string, listener fListener, args ...string) (err error) {
-	log.Info().Str("name", name).Str("address", gateAddress).Msg("start gate-client")
-	key := ""
+	return NewStreamClient(name, gateAddress, listener.exchange, args...)
+}
+
+// NewStreamClient is NewClient for listeners which stream the request and
+// response bodies through the Exchange instead of holding them in memory
+func NewStreamClient(name string, gateAddress string, listener fStreamListener, args ...string) (err error) {
+	c := NewMultiClient(gateAddress, args...)
+	c.Add(name, listener)
+	return c.Run()
+}
+
+// Client serves several services over one connection to the gate,
+// services can be added and removed while it runs
+type Client struct {
+	gate string
+	key  string
+
+	lock      sync.Mutex
+	names     []string // in the order of Add, the first one goes in the handshake
+	listeners map[string]fStreamListener
+	m         *mux // current connection, nil - not connected
+	added     chan struct{}
+	done      chan struct{} // closed by Close
+	closed    bool
+	// pauses before reconnecting, reconnectTTL and maxReconnectTTL
+	reconnect, maxReconnect time.Duration
+
+	// OnRequest is called after a request is served with the status sent,
+	// 0 if no head could be sent, set it before Run
+	OnRequest func(request *pproto.GateRequest, status int32, duration time.Duration, err error)
+	// Tracer gets a span per request, continuing the trace of the gate, nil - no spans
+	Tracer *tracing.Tracer
+}
+
+func NewMultiClient(gateAddress string, args ...string) *Client {
+	c := &Client{
+		gate:      gateAddress,
+		listeners: map[string]fStreamListener{},
+		added:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+
+		reconnect:    reconnectTTL,
+		maxReconnect: maxReconnectTTL,
+	}
 	if len(args) > 0 {
-		key = args[0]
+		c.key = args[0]
+	}
+	return c
+}
+
+// Add serves the service by listener, the gate learns about it at once
+// if connected, a service served by another connection moves to this one
+func (c *Client) Add(name string, listener fStreamListener) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.listeners[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.listeners[name] = listener
+	select {
+	case c.added <- struct{}{}:
+	default:
+	}
+	if c.m != nil {
+		c.register(&pproto.GateRegister{Add: gateServices(name)})
+	}
+}
+
+// Remove stops serving the service, requests to it get 404 from the gate
+func (c *Client) Remove(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.listeners[name]; !ok {
+		return
+	}
+	delete(c.listeners, name)
+	for i, n := range c.names {
+		if n == name {
+			c.names = append(c.names[:i], c.names[i+1:]...)
+			break
+		}
+	}
+	if c.m != nil {
+		c.register(&pproto.GateRegister{Remove: []string{name}})
+	}
+}
+
+// Connected tells if the client has a connection to the gate
+func (c *Client) Connected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.m != nil
+}
+
+// Names returns the services of the client
+func (c *Client) Names() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.names...)
+}
+
+// register sends the changes to the gate, under c.lock,
+// gates without CapMultiService ignore them
+func (c *Client) register(r *pproto.GateRegister) {
+	err := c.m.send(&pproto.Packet{Register: r})
+	if err != nil {
+		log.Error().Err(err).Msg("fail to send register")
 	}
-	tcpAddr, err := net.ResolveTCPAddr("tcp", gateAddress)
+}
+
+// ErrClientClosed is returned by Run after Close
+var ErrClientClosed = errors.New("tcp: client closed")
+
+// RejectedError is returned by Run when the gate refuses the handshake,
+// for a wrong key or a bad service, the same handshake is refused again
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "tcp: handshake rejected: " + e.Reason
+}
+
+// Run connects to the gate and serves requests, reconnecting with backoff when
+// the connection is lost. It stops with *RejectedError if the gate refuses the handshake.
+func (c *Client) Run() error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", c.gate)
 	if err != nil {
 		return err
 	}
+	log.Info().Strs("names", c.Names()).Str("address", c.gate).Msg("start gate-client")
+	backoff := c.reconnect
+	// retry waits for the backoff and doubles it, false if the client is closed meanwhile
+	retry := func() bool {
+		if !c.wait(backoff) {
+			return false
+		}
+		backoff = min(2*backoff, c.maxReconnect)
+		return true
+	}
 	for {
+		if len(c.Names()) == 0 {
+			select {
+			case <-c.added:
+			case <-c.done:
+				return ErrClientClosed
+			}
+			continue
+		}
 		conn, err := net.DialTCP("tcp", nil, tcpAddr)
 		if err != nil {
-			log.Debug().Err(err).Msg("fail to create tcp-connection")
-			time.Sleep(reconnectTTL)
+			log.Debug().Err(err).Dur("retry", backoff).Msg("fail to create tcp-connection")
+			if !retry() {
+				return ErrClientClosed
+			}
 			continue
 		}
-		err = handshake(conn, name, key)
-		if err != nil {
-			log.Error().Err(err).Msg("fail to send handshake")
+		m := newMux(conn, defaultWindow)
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			m.close()
+			return ErrClientClosed
+		}
+		names := append([]string(nil), c.names...)
+		if len(names) > 0 {
+			err = handshake(m, c.key, names...)
+		}
+		c.m = m
+		c.lock.Unlock()
+		if len(names) == 0 || err != nil {
+			c.disconnect(m)
+			if err != nil {
+				log.Error().Err(err).Dur("retry", backoff).Msg("fail to send handshake")
+				if !retry() {
+					return ErrClientClosed
+				}
+			}
 			continue
 		}
-		ex := ping(conn)
-		err = clientLoop(conn, listener)
+		start := time.Now()
+		ex := ping(m)
+		err = clientLoop(m, c.dispatch)
 		ex <- true
+		c.disconnect(m)
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			return err
+		}
 		if err != nil {
-			log.Error().Err(err).Msg("client error")
+			log.Error().Err(err).Dur("retry", backoff).Msg("client error")
+		}
+		if time.Since(start) >= c.maxReconnect {
+			// the connection lasted, it is not one of a series of failures
+			backoff = c.reconnect
 		}
+		if !retry() {
+			return ErrClientClosed
+		}
+	}
+}
+
+// wait sleeps for d, false if the client is closed meanwhile
+func (c *Client) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Close drops the connection and stops Run
+func (c *Client) Close() error {
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	m := c.m
+	c.lock.Unlock()
+	if m != nil {
+		m.close()
+	}
+	return nil
+}
+
+func (c *Client) disconnect(m *mux) {
+	m.close()
+	c.lock.Lock()
+	c.m = nil
+	c.lock.Unlock()
+}
+
+// dispatch passes the request to the listener of its service
+func (c *Client) dispatch(request *pproto.GateRequest, ex *Exchange) error {
+	c.lock.Lock()
+	listener := c.listeners[request.Name]
+	if listener == nil && request.Name == "" && len(c.names) > 0 {
+		listener = c.listeners[c.names[0]]
 	}
+	c.lock.Unlock()
+	if listener == nil {
+		if err := ex.WriteHead(&pproto.GateResponse{
+			StatusCode: http.StatusNotFound,
+			Header:     []*pproto.GateHeader{{Key: "Content-Type", Values: []string{"text/plain; charset=utf-8"}}},
+		}); err != nil {
+			return err
+		}
+		_, err := ex.Write([]byte(fmt.Sprintf("service %s is not served here\n", request.Name)))
+		return err
+	}
+	span := c.Tracer.Start("client "+request.Name, tracing.Server, tracing.FromHeader(pproto.FromGateHeader(request.Header)))
+	if span != nil {
+		// the upstream continues the trace under the span of the client
+		header := pproto.FromGateHeader(request.Header)
+		span.Context.Inject(header)
+		request.Header = pproto.ToGateHeader(header)
+		span.SetAttr("http.request.method", request.Method)
+		span.SetAttr("url.full", request.Url)
+	}
+	start := time.Now()
+	err := listener(request, ex)
+	if err != nil {
+		// the failure is answered here for OnRequest and the span to see its status
+		answerError(ex, err)
+	}
+	if span != nil {
+		span.SetAttr("http.response.status_code", ex.Status())
+		if err != nil {
+			span.SetError(err.Error())
+		}
+		span.Finish()
+	}
+	if c.OnRequest != nil {
+		c.OnRequest(request, ex.Status(), time.Since(start), err)
+	}
+	return err
 }
 
-func ping(conn net.Conn) chan bool {
+func ping(m *mux) chan bool {
 	pingInterval := time.NewTicker(pingTTL)
 	closeChan := make(chan bool, 1)
 	go func() {
+		defer pingInterval.Stop()
 		for {
 			select {
 			case <-pingInterval.C:
-				p := &pproto.Packet{
+				err := m.send(&pproto.Packet{
 					Ping: &pproto.GatePing{
 						Time: time.Now().UnixMilli(),
 					},
-				}
-				b, err := proto.Marshal(p)
-				if err != nil {
-					return
-				}
-				_, err = conn.Write(bit_utils.AddSize(b))
+				})
 				if err != nil {
 					return
 				}
@@ -79,9 +352,12 @@ func ping(conn net.Conn) chan bool {
 	return closeChan
 }
 
-func clientLoop(conn net.Conn, listener fListener) (err error) {
+func clientLoop(m *mux, listener fStreamListener) (err error) {
 	dataChannel := make(chan []byte)
+	rejected := make(chan error, 1)
+	processed := make(chan struct{})
 	go func() {
+		defer close(processed)
 		for {
 			data, ok := <-dataChannel
 			if !ok {
@@ -89,10 +365,10 @@ func clientLoop(conn net.Conn, listener fListener) (err error) {
 				return
 			}
 			var p pproto.Packet
-			err = proto.Unmarshal(data, &p)
+			err := proto.Unmarshal(data, &p)
 			if err != nil {
 				log.Error().Err(err).Msg("fail to unmarshal")
-				conn.Close()
+				m.close()
 				return
 			}
 
@@ -100,94 +376,111 @@ func clientLoop(conn net.Conn, listener fListener) (err error) {
 			case p.Pong != nil:
 				//log.Debug().Int64("ms", time.Now().UnixMilli()-p.Pong.Time).Msg("ping")
 				break
+			case p.HandshakeAck != nil:
+				ack := p.HandshakeAck
+				if ack.Error != "" {
+					log.Error().Str("error", ack.Error).Msg("handshake rejected")
+					rejected <- &RejectedError{Reason: ack.Error}
+					m.close()
+					return
+				}
+				m.caps = ack.Capabilities & capabilities
+				log.Debug().Uint32("version", ack.Version).Uint64("capabilities", m.caps).Msg("handshake accepted")
+			case p.Data != nil:
+				err := m.deliver(p.Data)
+				if err != nil {
+					log.Error().Err(err).Uint64("id", p.Data.Id).Msg("protocol error")
+					m.close()
+				}
+			case p.Window != nil:
+				m.grant(p.Window)
+			case p.Cancel != nil:
+				m.cancelStream(p.Cancel)
 			case p.Requests != nil:
-				go func(conn net.Conn) {
-					resp, err := listener(p.Requests)
-					if err != nil {
-						log.Error().Err(err).Msg("error in listener")
-						return
-					}
-					resp.Id = p.Requests.Id
-					resp.Name = p.Requests.Name
-					p := &pproto.Packet{
-						Responses: resp,
-					}
-					b, err := proto.Marshal(p)
-					if err != nil {
-						log.Error().Err(err).Msg("error marshal response")
-						return
-					}
-					_, err = conn.Write(bit_utils.AddSize(b))
-					if err != nil {
-						log.Error().Err(err).Msg("error send data")
-						return
-					}
-				}(conn)
+				rq := p.Requests
+				body, err := decompress(rq.Body, rq.BodyEncoding, frameLimit())
+				if err != nil {
+					log.Error().Err(err).Uint64("id", rq.Id).Str("request-id", rq.RequestId).Msg("protocol error")
+					m.close()
+					return
+				}
+				rq.Body, rq.BodyEncoding = body, pproto.GateEncoding_ENCODING_NONE
+				streaming := rq.Window > 0 && m.has(CapStreaming)
+				st := m.open(rq.Id, rq.Priority, rq.Window, streaming, rq.Stream)
+				go serve(st, rq, streaming, listener)
 			}
 
 		}
 	}()
-	err = readerTL(conn, dataChannel)
-	if err != nil {
-		log.Error().Err(err).Msg("read error")
-	}
-
-	//for {
-	//	b, err := readTL(conn)
-	//	if err != nil {
-	//		return err
-	//	}
-	//	var p pproto.Packet
-	//	err = proto.Unmarshal(b, &p)
-	//	if err != nil {
-	//		return err
-	//	}
-	//	switch {
-	//	case p.Pong != nil:
-	//		log.Debug().Int64("ms", time.Now().UnixMilli()-p.Pong.Time).Msg("ping")
-	//		break
-	//	case p.Requests != nil:
-	//		go func(conn net.Conn) {
-	//			resp, err := listener(p.Requests)
-	//			if err != nil {
-	//				log.Error().Err(err).Msg("error in listener")
-	//				return
-	//			}
-	//			resp.Id = p.Requests.Id
-	//			resp.Name = p.Requests.Name
-	//			p := &pproto.Packet{
-	//				Responses: resp,
-	//			}
-	//			b, err := proto.Marshal(p)
-	//			if err != nil {
-	//				log.Error().Err(err).Msg("error marshal response")
-	//				return
-	//			}
-	//			_, err = conn.Write(bit_utils.AddSize(b))
-	//			if err != nil {
-	//				log.Error().Err(err).Msg("error send data")
-	//				return
-	//			}
-	//		}(conn)
-	//	}
-	//}
+	err = readerTL(m.conn, dataChannel)
+	m.close()
+	// the last packets, like a rejecting ack, are handled by now
+	<-processed
+	select {
+	case e := <-rejected:
+		return e
+	default:
+	}
 	return err
 }
 
-func handshake(conn net.Conn, name string, key string) error {
-	pck := &pproto.Packet{
-		Handshake: &pproto.GateHandshake{
-			Service: name,
-			Key:     key,
-		},
-	}
-	data, err := proto.Marshal(pck)
+// serve calls listener for the request, the response is streamed
+// if the gate supports it and granted a response window
+func serve(st *Stream, request *pproto.GateRequest, streaming bool, listener fStreamListener) {
+	defer st.Close()
+	ex := newExchange(st, request, streaming)
+	err := listener(request, ex)
 	if err != nil {
-		return err
+		ex.Log().Error().Err(err).Msg("error in listener")
+		answerError(ex, err)
 	}
-	_, err = conn.Write(bit_utils.AddSize(data))
+	err = ex.Finish(nil)
 	if err != nil {
-		return err
+		ex.Log().Error().Err(err).Msg("error send data")
 	}
-	return nil
+}
+
+// answerError sends 502 with the error of the listener, or 413 for a too large body,
+// unless the head is already sent
+func answerError(ex *Exchange, err error) {
+	if ex.HeadSent() {
+		return
+	}
+	status := http.StatusBadGateway
+	if errors.Is(err, ErrBodyTooLarge) {
+		status = http.StatusRequestEntityTooLarge
+	}
+	ex.WriteHead(&pproto.GateResponse{
+		StatusCode: int32(status),
+		Header:     []*pproto.GateHeader{{Key: "Content-Type", Values: []string{"text/plain; charset=utf-8"}}},
+	})
+	ex.Write([]byte(fmt.Sprintf("%d %s: %s", status, strings.ToLower(http.StatusText(status)), err.Error())))
+}
+
+// services with the access asked for them by SetAccess
+func gateServices(names ...string) []*pproto.GateService {
+	accessLock.Lock()
+	defer accessLock.Unlock()
+	var res []*pproto.GateService
+	for _, name := range names {
+		res = append(res, &pproto.GateService{Name: name, Access: access[name]})
+	}
+	return res
+}
+
+// handshake sends the first service as the one of the connection,
+// the others are served if the gate supports CapMultiService
+func handshake(m *mux, key string, names ...string) error {
+	list := gateServices(names...)
+	return m.send(&pproto.Packet{
+		Handshake: &pproto.GateHandshake{
+			Service:      list[0].Name,
+			Key:          key,
+			Window:       m.window,
+			Version:      ProtocolVersion,
+			Capabilities: capabilities,
+			Access:       list[0].Access,
+			Services:     list[1:],
+		},
+	})
 }
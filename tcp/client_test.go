@@ -0,0 +1,210 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var requestId uint64 = 1 << 40
+
+func named(name string) fStreamListener {
+	return fListener(func(request *pproto.GateRequest) (*pproto.GateResponse, error) {
+		return &pproto.GateResponse{StatusCode: 200, Body: []byte(name + " " + request.Name)}, nil
+	}).exchange
+}
+
+// get sends a request to the service and returns the status and body
+func get(t *testing.T, s *Server, name string) (int32, string) {
+	st, err := s.Send(&pproto.GateRequest{Id: atomic.AddUint64(&requestId, 1), Name: name, Method: "GET", Url: "/"}, nil)
+	require.NoError(t, err)
+	defer st.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	head, err := st.Response(ctx)
+	require.NoError(t, err)
+	b, err := io.ReadAll(st)
+	require.NoError(t, err)
+	return head.StatusCode, string(b)
+}
+
+func waitGone(t *testing.T, s *Server, name string) {
+	require.Eventually(t, func() bool {
+		return s.conn(name) == nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestMultiServiceClient(t *testing.T) {
+	s, addr := startServer(t, "")
+	c := NewMultiClient(addr)
+	c.Add("multi-a", named("a"))
+	c.Add("multi-b", named("b"))
+	go c.Run()
+	waitService(t, s, "multi-a")
+	waitService(t, s, "multi-b")
+
+	assert.Same(t, s.conn("multi-a"), s.conn("multi-b"))
+	_, body := get(t, s, "multi-a")
+	assert.Equal(t, "a multi-a", body)
+	_, body = get(t, s, "multi-b")
+	assert.Equal(t, "b multi-b", body)
+
+	// added and removed over the same connection
+	c.Add("multi-c", named("c"))
+	waitService(t, s, "multi-c")
+	_, body = get(t, s, "multi-c")
+	assert.Equal(t, "c multi-c", body)
+	c.Remove("multi-a")
+	waitGone(t, s, "multi-a")
+	_, body = get(t, s, "multi-b")
+	assert.Equal(t, "b multi-b", body)
+}
+
+func TestMultiServiceTakeover(t *testing.T) {
+	s, addr := startServer(t, "")
+	c := NewMultiClient(addr)
+	c.Add("takeover-a", named("first"))
+	c.Add("takeover-b", named("first"))
+	go c.Run()
+	waitService(t, s, "takeover-b")
+
+	// a legacy client takes one name, the first connection keeps the other
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	writePacket(t, conn, &pproto.Packet{Handshake: &pproto.GateHandshake{Service: "takeover-a"}})
+	require.Eventually(t, func() bool {
+		return s.conn("takeover-a") != s.conn("takeover-b")
+	}, 2*time.Second, 10*time.Millisecond)
+	_, body := get(t, s, "takeover-b")
+	assert.Equal(t, "first takeover-b", body)
+
+	// the connection is dropped with its names
+	conn.Close()
+	waitGone(t, s, "takeover-a")
+}
+
+func TestClientAnswersUnknownService(t *testing.T) {
+	c := NewMultiClient("")
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	m := newMux(c1, defaultWindow)
+	go clientLoop(m, c.dispatch)
+
+	writePacket(t, c2, &pproto.Packet{Requests: &pproto.GateRequest{Id: 1, Name: "nobody", Method: "GET"}})
+	p, err := readPacket(c2)
+	require.NoError(t, err)
+	require.NotNil(t, p.Responses)
+	assert.Equal(t, int32(404), p.Responses.StatusCode)
+}
+
+func TestClientReportsSentStatus(t *testing.T) {
+	s, addr := startServer(t, "")
+	c := NewMultiClient(addr)
+	c.Add("failing", func(request *pproto.GateRequest, ex *Exchange) error {
+		return errors.New("upstream is down")
+	})
+	statuses := make(chan int32, 1)
+	c.OnRequest = func(request *pproto.GateRequest, status int32, duration time.Duration, err error) {
+		assert.Error(t, err)
+		statuses <- status
+	}
+	go c.Run()
+	defer c.Close()
+	waitService(t, s, "failing")
+
+	status, body := get(t, s, "failing")
+	assert.Equal(t, int32(502), status)
+	assert.Equal(t, "502 bad gateway: upstream is down", body)
+	assert.Equal(t, int32(502), <-statuses)
+}
+
+func TestClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	c := NewMultiClient(l.Addr().String())
+	c.Add("closing", named("a"))
+	ran := make(chan error, 1)
+	go func() { ran <- c.Run() }()
+	waitService(t, s, "closing")
+
+	require.NoError(t, c.Close())
+	select {
+	case err := <-ran:
+		assert.ErrorIs(t, err, ErrClientClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("client is still running")
+	}
+	waitGone(t, s, "closing")
+
+	require.NoError(t, s.Close())
+	select {
+	case err := <-served:
+		assert.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("server is still serving")
+	}
+}
+
+func TestClientStopsWhenRejected(t *testing.T) {
+	_, addr := startServer(t, "k3y")
+	c := NewMultiClient(addr, "wrong")
+	c.Add("rejected", named("a"))
+	ran := make(chan error, 1)
+	go func() { ran <- c.Run() }()
+	select {
+	case err := <-ran:
+		var rejected *RejectedError
+		require.ErrorAs(t, err, &rejected)
+		assert.Equal(t, "unauthorized", rejected.Reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("client is still reconnecting")
+	}
+}
+
+func TestClientReconnectBackoff(t *testing.T) {
+	// a gate which drops every connection
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan time.Time, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- time.Now()
+		}
+	}()
+	c := NewMultiClient(l.Addr().String())
+	c.reconnect, c.maxReconnect = 5*time.Millisecond, 40*time.Millisecond
+	c.Add("dropped", named("a"))
+	go c.Run()
+	defer c.Close()
+
+	var times []time.Time
+	for len(times) < 7 {
+		select {
+		case at := <-accepted:
+			times = append(times, at)
+		case <-time.After(2 * time.Second):
+			t.Fatal("client does not reconnect")
+		}
+	}
+	// 5, 10, 20, 40, 40, 40ms
+	assert.GreaterOrEqual(t, times[4].Sub(times[3]), 30*time.Millisecond)
+	assert.Less(t, times[6].Sub(times[5]), time.Second)
+}
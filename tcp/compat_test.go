@@ -0,0 +1,214 @@
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	pproto "github.com/axgrid/axgate/proto"
+	bit_utils "github.com/axgrid/axgate/shared/bit-utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func writePacket(t *testing.T, conn net.Conn, p *pproto.Packet) {
+	b, err := proto.Marshal(p)
+	require.NoError(t, err)
+	_, err = conn.Write(bit_utils.AddSize(b))
+	require.NoError(t, err)
+}
+
+func readPacket(conn net.Conn) (*pproto.Packet, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.LittleEndian.Uint32(head))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return pproto.GetPacket(b)
+}
+
+func startServer(t *testing.T, key string) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{Key: key}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String()
+}
+
+func waitService(t *testing.T, s *Server, name string) {
+	require.Eventually(t, func() bool {
+		return s.conn(name) != nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// TestServerCompatibility runs clients of every protocol generation against the server
+func TestServerCompatibility(t *testing.T) {
+	cases := []struct {
+		name      string
+		handshake *pproto.GateHandshake
+		ack       bool
+		streaming bool
+	}{
+		{"legacy", &pproto.GateHandshake{}, false, false},
+		{"legacy-with-window", &pproto.GateHandshake{Window: defaultWindow}, false, false},
+		{"v1-no-capabilities", &pproto.GateHandshake{Version: 1, Window: defaultWindow}, true, false},
+		{"v1-streaming", &pproto.GateHandshake{Version: 1, Capabilities: CapStreaming, Window: defaultWindow}, true, true},
+		{"v2-unknown-capabilities", &pproto.GateHandshake{Version: 2, Capabilities: CapStreaming | 1<<40, Window: defaultWindow}, true, true},
+	}
+	s, addr := startServer(t, "")
+	for i, c := range cases {
+		c := c
+		name := fmt.Sprintf("compat-%d", i)
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			c.handshake.Service = name
+			writePacket(t, conn, &pproto.Packet{Handshake: c.handshake})
+
+			// ping answer comes after the ack, if there is one
+			writePacket(t, conn, &pproto.Packet{Ping: &pproto.GatePing{Time: 42}})
+			p, err := readPacket(conn)
+			require.NoError(t, err)
+			if c.ack {
+				require.NotNil(t, p.HandshakeAck)
+				assert.Empty(t, p.HandshakeAck.Error)
+				assert.Equal(t, uint32(ProtocolVersion), p.HandshakeAck.Version)
+				assert.Zero(t, p.HandshakeAck.Capabilities&^capabilities)
+				p, err = readPacket(conn)
+				require.NoError(t, err)
+			}
+			require.NotNil(t, p.Pong)
+			assert.Equal(t, int64(42), p.Pong.Time)
+			waitService(t, s, name)
+
+			st, err := s.Send(&pproto.GateRequest{Id: uint64(1000 + i), Name: name, Method: "POST", Body: []byte("request body")}, nil)
+			require.NoError(t, err)
+			defer st.Close()
+
+			p, err = readPacket(conn)
+			require.NoError(t, err)
+			rq := p.Requests
+			require.NotNil(t, rq)
+			if c.streaming {
+				assert.True(t, rq.Stream)
+				assert.NotZero(t, rq.Window)
+				assert.Empty(t, rq.Body)
+				var body []byte
+				for {
+					p, err = readPacket(conn)
+					require.NoError(t, err)
+					require.NotNil(t, p.Data)
+					body = append(body, p.Data.Data...)
+					if p.Data.Fin {
+						break
+					}
+				}
+				assert.Equal(t, "request body", string(body))
+				writePacket(t, conn, &pproto.Packet{Responses: &pproto.GateResponse{Id: rq.Id, StatusCode: 200, Stream: true}})
+				writePacket(t, conn, &pproto.Packet{Data: &pproto.GateData{Id: rq.Id, Data: []byte("response body")}})
+				writePacket(t, conn, &pproto.Packet{Data: &pproto.GateData{Id: rq.Id, Fin: true}})
+			} else {
+				assert.False(t, rq.Stream)
+				assert.Zero(t, rq.Window)
+				assert.Equal(t, "request body", string(rq.Body))
+				writePacket(t, conn, &pproto.Packet{Responses: &pproto.GateResponse{Id: rq.Id, StatusCode: 200, Body: []byte("response body")}})
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			rs, err := st.Response(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, int32(200), rs.StatusCode)
+			body, err := io.ReadAll(st)
+			require.NoError(t, err)
+			assert.Equal(t, "response body", string(rs.Body)+string(body))
+		})
+	}
+}
+
+func TestServerRejectsHandshake(t *testing.T) {
+	_, addr := startServer(t, "secret")
+
+	t.Run("legacy", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		writePacket(t, conn, &pproto.Packet{Handshake: &pproto.GateHandshake{Service: "rejected-legacy", Key: "wrong"}})
+		_, err = readPacket(conn)
+		assert.Error(t, err)
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		writePacket(t, conn, &pproto.Packet{Handshake: &pproto.GateHandshake{Service: "rejected-v1", Key: "wrong", Version: 1}})
+		p, err := readPacket(conn)
+		require.NoError(t, err)
+		require.NotNil(t, p.HandshakeAck)
+		assert.Equal(t, "unauthorized", p.HandshakeAck.Error)
+		_, err = readPacket(conn)
+		assert.Error(t, err)
+	})
+}
+
+func TestServerKeepsRequestedAccess(t *testing.T) {
+	s, addr := startServer(t, "")
+	access := &pproto.GateAccess{Allow: []string{"10.0.0.0/8"}, Tokens: []string{"t0ken"}}
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	writePacket(t, conn, &pproto.Packet{Handshake: &pproto.GateHandshake{Service: "protected", Version: 1, Access: access}})
+	p, err := readPacket(conn)
+	require.NoError(t, err)
+	require.NotNil(t, p.HandshakeAck)
+	assert.Empty(t, p.HandshakeAck.Error)
+	waitService(t, s, "protected")
+	assert.Equal(t, access.Tokens, s.Access("protected").Tokens)
+
+	bad, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer bad.Close()
+	writePacket(t, bad, &pproto.Packet{Handshake: &pproto.GateHandshake{Service: "badly-protected", Version: 1, Access: &pproto.GateAccess{
+		Users: []*pproto.GateUser{{Name: "admin", PasswordHash: "plain"}},
+	}}})
+	p, err = readPacket(bad)
+	require.NoError(t, err)
+	require.NotNil(t, p.HandshakeAck)
+	assert.Contains(t, p.HandshakeAck.Error, "bad access")
+}
+
+// TestClientWithLegacyServer checks the client falls back to inline bodies
+// when the server never acknowledges the handshake
+func TestClientWithLegacyServer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	m := newMux(c1, defaultWindow)
+	require.NoError(t, handshake(m, "", "legacy-server"))
+	go clientLoop(m, fListener(func(request *pproto.GateRequest) (*pproto.GateResponse, error) {
+		return &pproto.GateResponse{StatusCode: 200, Body: append([]byte("echo "), request.Body...)}, nil
+	}).exchange)
+
+	p, err := readPacket(c2)
+	require.NoError(t, err)
+	require.NotNil(t, p.Handshake)
+	assert.Equal(t, uint32(ProtocolVersion), p.Handshake.Version)
+
+	writePacket(t, c2, &pproto.Packet{Requests: &pproto.GateRequest{Id: 1, Name: "legacy-server", Method: "POST", Body: []byte("hi")}})
+	p, err = readPacket(c2)
+	require.NoError(t, err)
+	require.NotNil(t, p.Responses)
+	assert.False(t, p.Responses.Stream)
+	assert.Equal(t, "echo hi", string(p.Responses.Body))
+}
@@ -0,0 +1,126 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"expvar"
+	pproto "github.com/axgrid/axgate/proto"
+	"io"
+	"strings"
+	"sync"
+)
+
+var (
+	compressionThreshold = 1024 // smaller bodies and frames go raw
+	compressionLevel     = flate.BestSpeed
+
+	// compressionStats is published as axgate_compression in expvar
+	compressionStats = expvar.NewMap("axgate_compression")
+
+	errInflateLimit = errors.New("decompressed frame is too big")
+)
+
+// content types which are already compressed
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, compressionLevel)
+		return w
+	},
+}
+
+func init() {
+	compressionStats.Set("ratio", expvar.Func(func() interface{} {
+		raw, packed := compressionStats.Get("raw_bytes"), compressionStats.Get("compressed_bytes")
+		if raw == nil || packed == nil || raw.(*expvar.Int).Value() == 0 {
+			return 1.0
+		}
+		return float64(packed.(*expvar.Int).Value()) / float64(raw.(*expvar.Int).Value())
+	}))
+}
+
+// compressible tells if a body with the header is worth compressing
+func compressible(header []*pproto.GateHeader) bool {
+	for _, h := range header {
+		if len(h.Values) == 0 {
+			continue
+		}
+		switch strings.ToLower(h.Key) {
+		case "content-encoding":
+			if v := strings.TrimSpace(h.Values[0]); v != "" && !strings.EqualFold(v, "identity") {
+				return false
+			}
+		case "content-type":
+			ct := strings.ToLower(h.Values[0])
+			if strings.HasPrefix(ct, "image/svg") {
+				continue
+			}
+			for _, t := range incompressibleTypes {
+				if strings.HasPrefix(ct, t) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// compress deflates data if it is big enough and actually gets smaller
+func compress(data []byte) ([]byte, pproto.GateEncoding) {
+	if len(data) < compressionThreshold {
+		return data, pproto.GateEncoding_ENCODING_NONE
+	}
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil || buf.Len() >= len(data) {
+		compressionStats.Add("skipped_frames", 1)
+		return data, pproto.GateEncoding_ENCODING_NONE
+	}
+	compressionStats.Add("frames", 1)
+	compressionStats.Add("raw_bytes", int64(len(data)))
+	compressionStats.Add("compressed_bytes", int64(buf.Len()))
+	return buf.Bytes(), pproto.GateEncoding_ENCODING_DEFLATE
+}
+
+// decompress restores data, limit < 0 means no limit on the result size
+func decompress(data []byte, encoding pproto.GateEncoding, limit int) ([]byte, error) {
+	switch encoding {
+	case pproto.GateEncoding_ENCODING_NONE:
+		return data, nil
+	case pproto.GateEncoding_ENCODING_DEFLATE:
+		var r io.Reader = flate.NewReader(bytes.NewReader(data))
+		if limit >= 0 {
+			r = io.LimitReader(r, int64(limit)+1)
+		}
+		res, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if limit >= 0 && len(res) > limit {
+			return nil, errInflateLimit
+		}
+		return res, nil
+	}
+	return nil, errors.New("unknown encoding " + encoding.String())
+}
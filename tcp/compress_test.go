@@ -0,0 +1,69 @@
+package tcp
+
+import (
+	"bytes"
+	"expvar"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestCompressible(t *testing.T) {
+	header := func(k, v string) []*pproto.GateHeader {
+		return []*pproto.GateHeader{{Key: k, Values: []string{v}}}
+	}
+	assert.True(t, compressible(nil))
+	assert.True(t, compressible(header("Content-Type", "application/json")))
+	assert.True(t, compressible(header("Content-Type", "image/svg+xml")))
+	assert.True(t, compressible(header("Content-Encoding", "identity")))
+	assert.False(t, compressible(header("Content-Type", "image/png")))
+	assert.False(t, compressible(header("Content-Type", "application/zip")))
+	assert.False(t, compressible(header("Content-Encoding", "gzip")))
+	assert.False(t, compressible(header("content-encoding", "br")))
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	small := []byte("tiny")
+	res, enc := compress(small)
+	assert.Equal(t, pproto.GateEncoding_ENCODING_NONE, enc)
+	assert.Equal(t, small, res)
+
+	data := bytes.Repeat([]byte(`{"key":"value"},`), 1000)
+	res, enc = compress(data)
+	assert.Equal(t, pproto.GateEncoding_ENCODING_DEFLATE, enc)
+	assert.Less(t, len(res), len(data))
+
+	back, err := decompress(res, enc, -1)
+	require.NoError(t, err)
+	assert.Equal(t, data, back)
+
+	_, err = decompress(res, enc, len(data)-1)
+	assert.Equal(t, errInflateLimit, err)
+}
+
+func TestStreamCompression(t *testing.T) {
+	a, b := pipeMux(t)
+	a.caps, b.caps = capabilities, capabilities
+	body := bytes.Repeat([]byte("compress me please "), 50000)
+	frames := func() int64 {
+		if v, ok := compressionStats.Get("frames").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := frames()
+
+	out := a.open(1, 0, defaultWindow, true, false)
+	out.compressFor([]*pproto.GateHeader{{Key: "Content-Type", Values: []string{"application/json"}}})
+	in := b.open(1, 0, defaultWindow, false, true)
+	go func() {
+		out.Write(body)
+		out.CloseWrite()
+	}()
+	res, err := io.ReadAll(in)
+	require.NoError(t, err)
+	assert.Equal(t, body, res)
+	assert.Greater(t, frames(), before)
+}
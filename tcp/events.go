@@ -0,0 +1,71 @@
+package tcp
+
+import (
+	"sync"
+	"time"
+)
+
+// types of Event
+const (
+	EventConnected    = "service.connected"    // a client registered the service
+	EventDisconnected = "service.disconnected" // the service is not served anymore
+	EventReplaced     = "service.replaced"     // another connection took the service over
+	EventRejected     = "handshake.rejected"   // a client was refused, see Reason
+	EventRequestError = "request.error"        // the gate failed a request to the service
+)
+
+// Event is a change of the gate state
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Service    string    `json:"service,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"` // of the client connection
+	Reason     string    `json:"reason,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"` // of the failed request
+	Method     string    `json:"method,omitempty"`     // of the failed request
+	URL        string    `json:"url,omitempty"`
+	Status     int       `json:"status,omitempty"`
+}
+
+// Events passes events to subscribers, the zero value is ready to use
+type Events struct {
+	lock sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel of the events published from now on, size of them
+// are buffered and the rest is dropped while the subscriber is behind.
+// cancel unsubscribes and closes the channel.
+func (e *Events) Subscribe(size int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, size)
+	e.lock.Lock()
+	if e.subs == nil {
+		e.subs = map[chan Event]struct{}{}
+	}
+	e.subs[ch] = struct{}{}
+	e.lock.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.lock.Lock()
+			delete(e.subs, ch)
+			e.lock.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends the event to subscribers, it never blocks
+func (e *Events) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
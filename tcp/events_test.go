@@ -0,0 +1,69 @@
+package tcp
+
+import (
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+		return Event{}
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	s, addr := startServer(t, "k3y")
+	events, cancel := s.Events.Subscribe(10)
+	defer cancel()
+
+	c := NewMultiClient(addr, "k3y")
+	c.Add("events", named("first"))
+	go c.Run()
+	ev := nextEvent(t, events)
+	assert.Equal(t, EventConnected, ev.Type)
+	assert.Equal(t, "events", ev.Service)
+	assert.False(t, ev.Time.IsZero())
+
+	c2 := NewMultiClient(addr, "k3y")
+	c2.Add("events", named("second"))
+	go c2.Run()
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventReplaced, ev.Type)
+	assert.Contains(t, ev.Reason, "was served by")
+	c.Close()
+
+	c2.Close()
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventDisconnected, ev.Type)
+	assert.Equal(t, "events", ev.Service)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	writePacket(t, conn, &pproto.Packet{Handshake: &pproto.GateHandshake{Service: "intruder", Key: "wrong", Version: 1}})
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventRejected, ev.Type)
+	assert.Equal(t, "intruder", ev.Service)
+	assert.Equal(t, "unauthorized", ev.Reason)
+}
+
+func TestEventsDropForSlowSubscriber(t *testing.T) {
+	var e Events
+	events, cancel := e.Subscribe(1)
+	e.Publish(Event{Type: EventConnected})
+	e.Publish(Event{Type: EventDisconnected})
+	assert.Equal(t, EventConnected, (<-events).Type)
+	cancel()
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+	e.Publish(Event{Type: EventConnected})
+}
@@ -0,0 +1,193 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"time"
+)
+
+var errHeadSent = errors.New("response head is already sent")
+
+// Exchange is the client side of one tunneled request.
+// The request body is read from it and the response is written to it:
+// WriteHead, then Write the body and Finish. When the gate supports streams
+// everything goes out as soon as it is written, otherwise the response is
+// sent inline on Finish.
+type Exchange struct {
+	st        *Stream
+	request   *pproto.GateRequest
+	body      io.Reader
+	streaming bool
+	head      *pproto.GateResponse
+	buf       []byte
+	tooLarge  bool // the inline response did not fit in a frame
+	finished  bool
+	start     time.Time // the request came, upstream time of the response is since then
+	log       zerolog.Logger
+}
+
+type fStreamListener func(request *pproto.GateRequest, exchange *Exchange) error
+
+func newExchange(st *Stream, request *pproto.GateRequest, streaming bool) *Exchange {
+	ex := &Exchange{
+		st:        st,
+		request:   request,
+		streaming: streaming,
+		start:     time.Now(),
+		log:       log.With().Str("service", request.Name).Str("request-id", request.RequestId).Logger(),
+	}
+	if request.Stream {
+		ex.body = st
+	} else {
+		ex.body = bytes.NewReader(request.Body)
+	}
+	return ex
+}
+
+// Context is done when the request is canceled at the gate
+// (the caller went away) or the gate connection is lost
+func (e *Exchange) Context() context.Context {
+	return e.st.Context()
+}
+
+// Log is the client logger with the service and the request id of the gate
+func (e *Exchange) Log() *zerolog.Logger {
+	return &e.log
+}
+
+// Read reads the request body
+func (e *Exchange) Read(p []byte) (int, error) {
+	return e.body.Read(p)
+}
+
+// Trailer returns the request trailer, call it after Read returned io.EOF
+func (e *Exchange) Trailer() []*pproto.GateHeader {
+	if e.request.Stream {
+		return e.st.Trailer()
+	}
+	return e.request.Trailer
+}
+
+// Streaming tells if the response goes to the gate as it is written
+func (e *Exchange) Streaming() bool {
+	return e.streaming
+}
+
+// HeadSent tells if WriteHead was called
+func (e *Exchange) HeadSent() bool {
+	return e.head != nil
+}
+
+// Status of the sent response head, 0 before WriteHead
+func (e *Exchange) Status() int32 {
+	if e.head == nil {
+		return 0
+	}
+	return e.head.StatusCode
+}
+
+// WriteHead sends the response head, its body and trailer are ignored,
+// announce trailers with pproto.TrailerKeys
+func (e *Exchange) WriteHead(resp *pproto.GateResponse) error {
+	if e.head != nil {
+		return errHeadSent
+	}
+	resp.Id = e.request.Id
+	resp.Name = e.request.Name
+	resp.Body = nil
+	resp.UpstreamTime = int64(time.Since(e.start))
+	e.head = resp
+	if !e.streaming {
+		return nil
+	}
+	resp.Stream = true
+	e.st.compressFor(resp.Header)
+	return e.st.m.send(&pproto.Packet{
+		Responses: resp,
+	})
+}
+
+// Write writes the response body
+func (e *Exchange) Write(p []byte) (int, error) {
+	if e.head == nil {
+		if err := e.WriteHead(&pproto.GateResponse{StatusCode: 200}); err != nil {
+			return 0, err
+		}
+	}
+	if !e.streaming {
+		if len(e.buf)+len(p) > inlineLimit() {
+			e.tooLarge = true
+			return 0, ErrBodyTooLarge
+		}
+		e.buf = append(e.buf, p...)
+		return len(p), nil
+	}
+	return e.st.Write(p)
+}
+
+// Finish ends the response with the trailer
+func (e *Exchange) Finish(trailer []*pproto.GateHeader) error {
+	if e.finished {
+		return nil
+	}
+	if e.head == nil {
+		if err := e.WriteHead(&pproto.GateResponse{StatusCode: 200}); err != nil {
+			return err
+		}
+	}
+	e.finished = true
+	if e.streaming {
+		return e.st.CloseWriteTrailer(trailer)
+	}
+	resp := e.head
+	resp.Body, resp.Trailer = e.buf, trailer
+	if e.tooLarge {
+		resp = &pproto.GateResponse{
+			Id:         resp.Id,
+			Name:       resp.Name,
+			StatusCode: http.StatusBadGateway,
+			Header:     []*pproto.GateHeader{{Key: "Content-Type", Values: []string{"text/plain; charset=utf-8"}}},
+			Body:       []byte("502 bad gateway: response is too large"),
+		}
+	}
+	if e.st.m.has(CapCompression) && compressible(resp.Header) {
+		resp.Body, resp.BodyEncoding = compress(resp.Body)
+	}
+	// inline heads go out with the whole body
+	resp.UpstreamTime = int64(time.Since(e.start))
+	return e.st.m.send(&pproto.Packet{
+		Responses: resp,
+	})
+}
+
+// exchange adapts a listener taking whole bodies to the Exchange
+func (l fListener) exchange(request *pproto.GateRequest, ex *Exchange) error {
+	if request.Stream {
+		// the listener takes the whole body as it would come inline
+		body, err := pproto.ReadBody(ex, int64(inlineLimit()))
+		if err != nil {
+			return err
+		}
+		request.Body, request.Trailer = body, ex.Trailer()
+		request.Stream = false
+	}
+	resp, err := l(request)
+	if err != nil {
+		return err
+	}
+	body, trailer := resp.Body, resp.Trailer
+	resp.Trailer = pproto.TrailerKeys(trailer)
+	if err = ex.WriteHead(resp); err != nil {
+		return err
+	}
+	if _, err = ex.Write(body); err != nil {
+		return err
+	}
+	return ex.Finish(trailer)
+}
@@ -0,0 +1,44 @@
+package tcp
+
+import (
+	"errors"
+	pproto "github.com/axgrid/axgate/proto"
+	"net/http"
+	"sync/atomic"
+)
+
+const defaultMaxFrameSize = 64 * 1024 * 1024
+
+var (
+	// maxFrameSize bounds a packet on the wire, inline bodies must fit in one,
+	// it is read with frameLimit as the config may change it at any time
+	maxFrameSize int64 = defaultMaxFrameSize
+
+	ErrFrameTooLarge = errors.New("frame is too large")
+	ErrBodyTooLarge  = pproto.ErrBodyTooLarge
+)
+
+// SetMaxFrameSize sets the biggest packet accepted from the peer, n <= 0 restores the default.
+// Peers with a bigger limit may send frames this side drops the connection on.
+func SetMaxFrameSize(n int) {
+	if n <= 0 {
+		n = defaultMaxFrameSize
+	}
+	atomic.StoreInt64(&maxFrameSize, int64(n))
+}
+
+func frameLimit() int {
+	return int(atomic.LoadInt64(&maxFrameSize))
+}
+
+// inlineLimit is the biggest body sent inline, the rest of the frame is left for the head
+func inlineLimit() int {
+	return inlineSize(frameLimit())
+}
+
+func inlineSize(n int) int {
+	if n > 2*http.DefaultMaxHeaderBytes {
+		return n - http.DefaultMaxHeaderBytes
+	}
+	return n / 2
+}
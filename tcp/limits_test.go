@@ -0,0 +1,116 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func withMaxFrameSize(t *testing.T, n int) {
+	SetMaxFrameSize(n)
+	t.Cleanup(func() { SetMaxFrameSize(0) })
+}
+
+func lengthPrefix(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+	return b
+}
+
+func TestReaderRejectsOversizedFrame(t *testing.T) {
+	for _, size := range []uint32{uint32(defaultMaxFrameSize) + 1, 0xFFFFFFFF} {
+		c1, c2 := net.Pipe()
+		go c2.Write(lengthPrefix(size))
+		dataChannel := make(chan []byte, 1)
+		err := readerTL(c1, dataChannel)
+		assert.ErrorIs(t, err, ErrFrameTooLarge)
+		_, ok := <-dataChannel
+		assert.False(t, ok)
+		c2.Close()
+	}
+}
+
+func TestServerDropsOversizedFrame(t *testing.T) {
+	_, addr := startServer(t, "")
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	writePacket(t, conn, &pproto.Packet{Handshake: &pproto.GateHandshake{Service: "oversized", Version: 1}})
+	_, err = readPacket(conn)
+	require.NoError(t, err)
+
+	_, err = conn.Write(lengthPrefix(0xFFFFFFF0))
+	require.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err, "the server closes the connection")
+}
+
+func TestClientDropsOversizedFrame(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	m := newMux(c1, defaultWindow)
+	go handshake(m, "", "oversized-client")
+	_, err := readPacket(c2)
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- clientLoop(m, fListener(func(request *pproto.GateRequest) (*pproto.GateResponse, error) {
+			return &pproto.GateResponse{StatusCode: 200}, nil
+		}).exchange)
+	}()
+	go c2.Write(lengthPrefix(0xFFFFFFF0))
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrFrameTooLarge)
+	case <-time.After(2 * time.Second):
+		t.Fatal("client kept the connection")
+	}
+}
+
+func TestInlineBodyLimit(t *testing.T) {
+	withMaxFrameSize(t, 1024)
+	s, addr := startServer(t, "")
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	// a client without streams takes bodies inline
+	writePacket(t, conn, &pproto.Packet{Handshake: &pproto.GateHandshake{Service: "inline-limit", Version: 1}})
+	_, err = readPacket(conn)
+	require.NoError(t, err)
+	waitService(t, s, "inline-limit")
+
+	_, err = s.Send(&pproto.GateRequest{Id: 1, Name: "inline-limit"}, bytes.NewReader(make([]byte, inlineLimit()+1)))
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	st, err := s.Send(&pproto.GateRequest{Id: 2, Name: "inline-limit"}, bytes.NewReader(make([]byte, inlineLimit())))
+	require.NoError(t, err)
+	st.Close()
+}
+
+func TestInlineResponseLimit(t *testing.T) {
+	withMaxFrameSize(t, 1024)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	m := newMux(c1, defaultWindow)
+	go handshake(m, "", "inline-response")
+	_, err := readPacket(c2)
+	require.NoError(t, err)
+	go clientLoop(m, fListener(func(request *pproto.GateRequest) (*pproto.GateResponse, error) {
+		return &pproto.GateResponse{StatusCode: 200, Body: make([]byte, 4096)}, nil
+	}).exchange)
+
+	writePacket(t, c2, &pproto.Packet{Requests: &pproto.GateRequest{Id: 1, Name: "inline-response", Method: "GET"}})
+	p, err := readPacket(c2)
+	require.NoError(t, err)
+	require.NotNil(t, p.Responses)
+	assert.Equal(t, int32(502), p.Responses.StatusCode)
+	assert.Contains(t, string(p.Responses.Body), "too large")
+}
@@ -0,0 +1,473 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	pproto "github.com/axgrid/axgate/proto"
+	bit_utils "github.com/axgrid/axgate/shared/bit-utils"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	defaultWindow   = 256 * 1024 // bytes a peer may have in flight per stream
+	maxChunkSize    = 16 * 1024  // biggest GateData payload
+	maxStreamBuffer = 64 * 1024  // bytes queued per stream before Write blocks
+	defaultPriority = 16
+	maxPriority     = 256
+)
+
+var (
+	errMuxClosed      = errors.New("connection closed")
+	errWindowExceeded = errors.New("stream window exceeded")
+	errStreamClosed   = errors.New("stream closed")
+	errCanceled       = errors.New("stream canceled by peer")
+)
+
+// mux multiplexes logical streams over one gate connection.
+// Control packets (handshake, ping, heads, window updates) are written first,
+// stream data is interleaved by weighted fair queueing, so a big body does not
+// block other requests and a stalled reader only stops its own stream.
+type mux struct {
+	conn    net.Conn
+	lock    sync.Mutex
+	cond    *sync.Cond
+	control [][]byte
+	streams map[uint64]*Stream
+	vtime   float64
+	window  uint32 // receive window granted to the peer for each stream
+	caps    uint64 // capabilities negotiated in the handshake
+	closed  bool
+	closing bool
+	done    chan struct{}
+}
+
+// Stream is one request/response exchange inside a mux.
+// Write sends body bytes to the peer, Read returns body bytes from the peer.
+type Stream struct {
+	id     uint64
+	m      *mux
+	weight float64
+	vtime  float64
+	head   chan *pproto.GateResponse
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	compress   bool
+	sendWindow int64
+	out        []byte
+	outFin     bool
+	outTrailer []*pproto.GateHeader
+	finSent    bool
+
+	in         []byte
+	inFin      bool
+	inTrailer  []*pproto.GateHeader
+	consumed   uint32
+	recvWindow uint32
+	released   bool
+	canceled   bool
+}
+
+func newMux(conn net.Conn, window uint32) *mux {
+	m := &mux{
+		conn:    conn,
+		streams: map[uint64]*Stream{},
+		window:  window,
+		done:    make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.lock)
+	go m.writeLoop()
+	return m
+}
+
+// open registers stream id. sendWindow is the window granted by the peer,
+// sendStream tells if the peer expects our side of the body as GateData frames,
+// recvStream - if we expect the peer's side that way.
+func (m *mux) open(id uint64, priority uint32, sendWindow uint32, sendStream bool, recvStream bool) *Stream {
+	if priority == 0 {
+		priority = defaultPriority
+	}
+	if priority > maxPriority {
+		priority = maxPriority
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stream{
+		id:         id,
+		ctx:        ctx,
+		cancel:     cancel,
+		m:          m,
+		weight:     float64(priority),
+		vtime:      m.vtime,
+		head:       make(chan *pproto.GateResponse, 1),
+		sendWindow: int64(sendWindow),
+		finSent:    !sendStream,
+		inFin:      !recvStream,
+		recvWindow: m.window,
+	}
+	m.streams[id] = s
+	return s
+}
+
+// has tells if capability c was negotiated with the peer
+func (m *mux) has(c uint64) bool {
+	return m.caps&c == c
+}
+
+// send queues a control packet
+func (m *mux) send(p *pproto.Packet) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.sendLocked(p)
+}
+
+func (m *mux) sendLocked(p *pproto.Packet) error {
+	if m.closed {
+		return errMuxClosed
+	}
+	b, err := proto.Marshal(p)
+	if err != nil {
+		return err
+	}
+	m.control = append(m.control, bit_utils.AddSize(b))
+	m.cond.Broadcast()
+	return nil
+}
+
+// deliver puts a data frame into its stream. Frames for unknown or released
+// streams are dropped but credited back, so the peer is never stuck on them.
+func (m *mux) deliver(d *pproto.GateData) (err error) {
+	d.Data, err = decompress(d.Data, d.Encoding, maxChunkSize)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.streams[d.Id]
+	if !ok || s.released {
+		if len(d.Data) > 0 {
+			return m.sendLocked(&pproto.Packet{Window: &pproto.GateWindow{Id: d.Id, Increment: uint32(len(d.Data))}})
+		}
+		return nil
+	}
+	if uint64(len(s.in))+uint64(s.consumed)+uint64(len(d.Data)) > uint64(s.recvWindow) {
+		return errWindowExceeded
+	}
+	s.in = append(s.in, d.Data...)
+	if d.Fin {
+		s.inFin = true
+		s.inTrailer = d.Trailer
+	}
+	m.cond.Broadcast()
+	return nil
+}
+
+// grant applies a window update from the peer
+func (m *mux) grant(w *pproto.GateWindow) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s, ok := m.streams[w.Id]; ok {
+		s.sendWindow += int64(w.Increment)
+		m.cond.Broadcast()
+	}
+}
+
+// response hands the response head to the stream waiting for it
+func (m *mux) response(r *pproto.GateResponse) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.streams[r.Id]
+	if !ok {
+		return false
+	}
+	if !r.Stream {
+		s.inFin = true
+		m.cond.Broadcast()
+	}
+	select {
+	case s.head <- r:
+	default:
+	}
+	return true
+}
+
+// cancelStream stops the stream abandoned by the peer
+func (m *mux) cancelStream(c *pproto.GateCancel) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s, ok := m.streams[c.Id]; ok && !s.released {
+		s.canceled = true
+		s.out = nil
+		s.outFin = true
+		s.cancel()
+		m.cond.Broadcast()
+	}
+}
+
+func (m *mux) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closeLocked()
+}
+
+// flushAndClose closes the connection once the queued control packets are written
+func (m *mux) flushAndClose() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closing = true
+	m.cond.Broadcast()
+}
+
+func (m *mux) closeLocked() {
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+		for _, s := range m.streams {
+			s.cancel()
+		}
+		m.cond.Broadcast()
+	}
+	_ = m.conn.Close()
+}
+
+func (m *mux) writeLoop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for {
+		var s *Stream
+		for !m.closed && len(m.control) == 0 && !m.closing {
+			if s = m.next(); s != nil {
+				break
+			}
+			m.cond.Wait()
+		}
+		if m.closing && len(m.control) == 0 {
+			m.closeLocked()
+		}
+		if m.closed {
+			return
+		}
+		var frame []byte
+		var data *pproto.GateData
+		var compressed bool
+		if len(m.control) > 0 {
+			frame = m.control[0]
+			m.control[0] = nil
+			m.control = m.control[1:]
+		} else {
+			data, compressed = m.frame(s)
+		}
+		m.lock.Unlock()
+		if data != nil {
+			if compressed {
+				data.Data, data.Encoding = compress(data.Data)
+			}
+			b, _ := proto.Marshal(&pproto.Packet{Data: data})
+			frame = bit_utils.AddSize(b)
+		}
+		_, err := m.conn.Write(frame)
+		m.lock.Lock()
+		if err != nil {
+			m.closeLocked()
+			return
+		}
+	}
+}
+
+// next returns the ready stream with the smallest virtual time
+func (m *mux) next() *Stream {
+	var res *Stream
+	for _, s := range m.streams {
+		if s.finSent {
+			continue
+		}
+		ready := (len(s.out) > 0 && s.sendWindow > 0) || (s.outFin && len(s.out) == 0)
+		if ready && (res == nil || s.vtime < res.vtime) {
+			res = s
+		}
+	}
+	return res
+}
+
+// frame cuts the next GateData frame from the stream
+func (m *mux) frame(s *Stream) (*pproto.GateData, bool) {
+	n := len(s.out)
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	if int64(n) > s.sendWindow {
+		n = int(s.sendWindow)
+	}
+	d := &pproto.GateData{Id: s.id, Data: append([]byte(nil), s.out[:n]...)}
+	s.out = s.out[n:]
+	s.sendWindow -= int64(n)
+	if s.outFin && len(s.out) == 0 {
+		d.Fin = true
+		d.Trailer = s.outTrailer
+		s.finSent = true
+		if s.released {
+			delete(m.streams, s.id)
+		}
+	}
+	start := s.vtime
+	if m.vtime > start {
+		start = m.vtime
+	}
+	m.vtime = start
+	s.vtime = start + float64(n+1)/s.weight
+	m.cond.Broadcast()
+	return d, s.compress
+}
+
+// compressFor enables compression of our side of the body
+// if it was negotiated and the body with the header is compressible
+func (s *Stream) compressFor(header []*pproto.GateHeader) {
+	s.m.lock.Lock()
+	defer s.m.lock.Unlock()
+	s.compress = s.m.has(CapCompression) && compressible(header)
+}
+
+// Context is done when the peer cancels the stream, the connection is lost
+// or the stream is closed
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Response waits for the response head of the stream
+func (s *Stream) Response(ctx context.Context) (*pproto.GateResponse, error) {
+	select {
+	case r := <-s.head:
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.m.done:
+		return nil, errMuxClosed
+	case <-s.ctx.Done():
+		// closed or canceled, a head which made it in time still counts
+		select {
+		case r := <-s.head:
+			return r, nil
+		default:
+			return nil, errStreamClosed
+		}
+	}
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	m := s.m
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := 0
+	for len(p) > 0 {
+		for !m.closed && !s.outFin && len(s.out) >= maxStreamBuffer {
+			m.cond.Wait()
+		}
+		if m.closed {
+			return n, errMuxClosed
+		}
+		if s.canceled {
+			return n, errCanceled
+		}
+		if s.outFin {
+			return n, io.ErrClosedPipe
+		}
+		k := maxStreamBuffer - len(s.out)
+		if k > len(p) {
+			k = len(p)
+		}
+		s.out = append(s.out, p[:k]...)
+		p = p[k:]
+		n += k
+		m.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// CloseWrite sends fin after the queued data
+func (s *Stream) CloseWrite() error {
+	return s.CloseWriteTrailer(nil)
+}
+
+// CloseWriteTrailer sends fin with the trailer after the queued data
+func (s *Stream) CloseWriteTrailer(trailer []*pproto.GateHeader) error {
+	s.m.lock.Lock()
+	defer s.m.lock.Unlock()
+	if !s.outFin {
+		s.outFin = true
+		s.outTrailer = trailer
+	}
+	s.m.cond.Broadcast()
+	return nil
+}
+
+// Trailer returns the trailer sent by the peer with fin, call it after Read returned io.EOF
+func (s *Stream) Trailer() []*pproto.GateHeader {
+	s.m.lock.Lock()
+	defer s.m.lock.Unlock()
+	return s.inTrailer
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	m := s.m
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for len(s.in) == 0 && !s.inFin && !m.closed && !s.released && !s.canceled {
+		m.cond.Wait()
+	}
+	if len(s.in) == 0 {
+		switch {
+		case s.canceled:
+			return 0, errCanceled
+		case s.inFin:
+			return 0, io.EOF
+		case s.released:
+			return 0, errStreamClosed
+		}
+		return 0, errMuxClosed
+	}
+	n := copy(p, s.in)
+	s.in = s.in[n:]
+	s.consumed += uint32(n)
+	if !s.inFin && s.consumed >= s.recvWindow/2 {
+		err := m.sendLocked(&pproto.Packet{Window: &pproto.GateWindow{Id: s.id, Increment: s.consumed}})
+		if err != nil {
+			return n, err
+		}
+		s.consumed = 0
+	}
+	return n, nil
+}
+
+// Close releases the stream: unsent data is dropped, fin is still sent,
+// and whatever the peer keeps sending is discarded. If the peer did not
+// finish its side yet it is told to stop working on the stream.
+func (s *Stream) Close() error {
+	m := s.m
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s.released {
+		return nil
+	}
+	s.released = true
+	s.cancel()
+	if !s.inFin && !s.canceled && m.has(CapCancel) {
+		_ = m.sendLocked(&pproto.Packet{Cancel: &pproto.GateCancel{Id: s.id}})
+	}
+	if !s.outFin {
+		s.out = nil
+		s.outFin = true
+	}
+	if !s.inFin && (s.consumed > 0 || len(s.in) > 0) {
+		_ = m.sendLocked(&pproto.Packet{Window: &pproto.GateWindow{Id: s.id, Increment: s.consumed + uint32(len(s.in))}})
+	}
+	s.in = nil
+	if s.finSent {
+		delete(m.streams, s.id)
+	}
+	m.cond.Broadcast()
+	return nil
+}
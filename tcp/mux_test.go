@@ -0,0 +1,161 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pump feeds frames read from the mux connection back into it
+func pump(m *mux) {
+	dataChannel := make(chan []byte)
+	go readerTL(m.conn, dataChannel)
+	go func() {
+		for data := range dataChannel {
+			var p pproto.Packet
+			if proto.Unmarshal(data, &p) != nil {
+				m.close()
+				return
+			}
+			switch {
+			case p.Data != nil:
+				if m.deliver(p.Data) != nil {
+					m.close()
+				}
+			case p.Window != nil:
+				m.grant(p.Window)
+			case p.Responses != nil:
+				m.response(p.Responses)
+			}
+		}
+	}()
+}
+
+func pipeMux(t *testing.T) (*mux, *mux) {
+	c1, c2 := net.Pipe()
+	a, b := newMux(c1, defaultWindow), newMux(c2, defaultWindow)
+	pump(a)
+	pump(b)
+	t.Cleanup(func() {
+		a.close()
+		b.close()
+	})
+	return a, b
+}
+
+func TestStreamTransfersBody(t *testing.T) {
+	a, b := pipeMux(t)
+	body := bytes.Repeat([]byte("0123456789"), 100000)
+	out := a.open(1, 0, defaultWindow, true, false)
+	in := b.open(1, 0, defaultWindow, false, true)
+	go func() {
+		out.Write(body)
+		out.CloseWrite()
+	}()
+	res, err := io.ReadAll(in)
+	require.NoError(t, err)
+	assert.Equal(t, body, res)
+}
+
+func TestSlowStreamDoesNotBlockOthers(t *testing.T) {
+	a, b := pipeMux(t)
+	slowOut := a.open(1, 0, defaultWindow, true, false)
+	b.open(1, 0, defaultWindow, false, true) // nobody reads it
+	written := make(chan struct{})
+	go func() {
+		slowOut.Write(make([]byte, defaultWindow*4))
+		close(written)
+	}()
+
+	fastOut := a.open(2, 0, defaultWindow, true, false)
+	fastIn := b.open(2, 0, defaultWindow, false, true)
+	go func() {
+		fastOut.Write([]byte("hello"))
+		fastOut.CloseWrite()
+	}()
+	res, err := io.ReadAll(fastIn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(res))
+
+	select {
+	case <-written:
+		t.Fatal("slow stream is not throttled by its window")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStreamResponseHead(t *testing.T) {
+	a, b := pipeMux(t)
+	st := a.open(7, 0, defaultWindow, false, true)
+	require.NoError(t, b.send(&pproto.Packet{Responses: &pproto.GateResponse{Id: 7, StatusCode: 201, Body: []byte("inline")}}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rs, err := st.Response(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int32(201), rs.StatusCode)
+	res, err := io.ReadAll(st)
+	require.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func TestStreamTrailer(t *testing.T) {
+	a, b := pipeMux(t)
+	out := a.open(1, 0, defaultWindow, true, false)
+	in := b.open(1, 0, defaultWindow, false, true)
+	trailer := []*pproto.GateHeader{{Key: "Grpc-Status", Values: []string{"0"}}}
+	go func() {
+		out.Write([]byte("data"))
+		out.CloseWriteTrailer(trailer)
+	}()
+	res, err := io.ReadAll(in)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(res))
+	require.Len(t, in.Trailer(), 1)
+	assert.Equal(t, "Grpc-Status", in.Trailer()[0].Key)
+}
+
+func TestPriorityShare(t *testing.T) {
+	a, b := pipeMux(t)
+	size := defaultWindow * 16
+	var received [2]int64
+	done := make(chan struct{})
+	for i, priority := range []uint32{64, 8} {
+		id := uint64(i + 1)
+		out := a.open(id, priority, defaultWindow, true, false)
+		in := b.open(id, priority, defaultWindow, false, true)
+		go func() {
+			out.Write(make([]byte, size))
+			out.CloseWrite()
+		}()
+		i := i
+		go func() {
+			buf := make([]byte, maxChunkSize)
+			for {
+				n, err := in.Read(buf)
+				atomic.AddInt64(&received[i], int64(n))
+				if err != nil {
+					if i == 0 {
+						close(done)
+					}
+					return
+				}
+			}
+		}()
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the stream did not finish")
+	}
+	// both saturate the link, the one of 8 times the weight gets most of it
+	high, low := atomic.LoadInt64(&received[0]), atomic.LoadInt64(&received[1])
+	assert.Greater(t, high, 3*low)
+}
@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	pproto "github.com/axgrid/axgate/proto"
@@ -8,88 +9,341 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	services      = map[string]*GateConn{}
-	servicesLock  = sync.Mutex{}
-	connectionTTL = time.Second * 30
-)
+var connectionTTL = time.Second * 30
+
+// Server accepts client connections and sends them requests of their services.
+// The zero value is ready to use.
+type Server struct {
+	// Key clients must present in the handshake, empty - any client
+	Key string
+	// ConnectionTTL closes connections silent for longer, 0 - 30s
+	ConnectionTTL time.Duration
+	// Log is the logger of the server, nil - the global one
+	Log *zerolog.Logger
+	// Events tells about services coming and going and rejected clients
+	Events Events
+
+	maxFrameSize int64 // atomic, 0 - SetMaxFrameSize of the package
+
+	lock      sync.Mutex
+	services  map[string]*GateConn
+	conns     map[*GateConn]struct{}
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// DefaultServer is used by NewServer and the package functions
+var DefaultServer = &Server{}
+
+// Logger returns Log or the global logger
+func (s *Server) Logger() *zerolog.Logger {
+	if s.Log != nil {
+		return s.Log
+	}
+	return &log.Logger
+}
+
+func (s *Server) ttl() time.Duration {
+	if s.ConnectionTTL > 0 {
+		return s.ConnectionTTL
+	}
+	return connectionTTL
+}
+
+// SetMaxFrameSize sets the biggest packet accepted from clients of the server,
+// n <= 0 - the one of the package
+func (s *Server) SetMaxFrameSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&s.maxFrameSize, int64(n))
+}
+
+func (s *Server) frameLimit() int {
+	if n := atomic.LoadInt64(&s.maxFrameSize); n > 0 {
+		return int(n)
+	}
+	return frameLimit()
+}
 
 type GateConn struct {
 	net.Conn
-	lock     sync.Mutex
-	name     string
-	requests map[uint64]chan *pproto.GateResponse
-	log      zerolog.Logger
+	server   *Server
+	mux      *mux
+	name     string // service of the handshake
+	ready    bool   // handshake is done
+	version  uint32 // negotiated protocol version
+	window   uint32 // window granted by the client for request streams
+	inFlight int64  // requests acquired with Acquire and not released yet
+	// services of the connection with the protection asked by the client (or nil),
+	// guarded by the server lock
+	served map[string]*pproto.GateAccess
+	log    zerolog.Logger
 }
 
-func GetServicesNames() []string {
+func GetServicesNames() []string { return DefaultServer.Names() }
+
+// Names returns the services connected to the server
+func (s *Server) Names() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	var res []string
-	for k := range services {
+	for k := range s.services {
 		res = append(res, k)
 	}
 	return res
 }
 
-func Send(request *pproto.GateRequest) (chan *pproto.GateResponse, error) {
-	servicesLock.Lock()
-	defer servicesLock.Unlock()
-	conn, ok := services[request.Name]
-	if !ok {
+func Connected(name string) bool { return DefaultServer.Connected(name) }
+
+// Connected tells if a client serves the service
+func (s *Server) Connected(name string) bool {
+	return s.conn(name) != nil
+}
+
+// conn returns the connection serving the service, nil if there is none
+func (s *Server) conn(name string) *GateConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.services[name]
+}
+
+func Acquire(name string, max int) (release func(), ok bool) {
+	return DefaultServer.Acquire(name, max)
+}
+
+// Acquire reserves a request slot on the connection of the service,
+// it fails if max requests are in flight already. max <= 0 is unlimited.
+// Call release when the request is done.
+func (s *Server) Acquire(name string, max int) (release func(), ok bool) {
+	conn := s.conn(name)
+	if conn == nil {
+		return func() {}, true
+	}
+	for {
+		n := atomic.LoadInt64(&conn.inFlight)
+		if max > 0 && n >= int64(max) {
+			return nil, false
+		}
+		if atomic.CompareAndSwapInt64(&conn.inFlight, n, n+1) {
+			return func() { atomic.AddInt64(&conn.inFlight, -1) }, true
+		}
+	}
+}
+
+func Access(name string) *pproto.GateAccess { return DefaultServer.Access(name) }
+
+// Access returns the protection the service asked for in its handshake, nil if none
+func (s *Server) Access(name string) *pproto.GateAccess {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if conn, ok := s.services[name]; ok {
+		return conn.served[name]
+	}
+	return nil
+}
+
+func InFlight(name string) int64 { return DefaultServer.InFlight(name) }
+
+// InFlight returns the number of acquired requests on the service connection
+func (s *Server) InFlight(name string) int64 {
+	if conn := s.conn(name); conn != nil {
+		return atomic.LoadInt64(&conn.inFlight)
+	}
+	return 0
+}
+
+func Send(request *pproto.GateRequest, body io.Reader) (*Stream, error) {
+	return DefaultServer.Send(request, body)
+}
+
+// Send opens a stream for the request on the service connection.
+// body (or request.Body if it is nil) is streamed when the client supports it,
+// if body has a Trailer() []*pproto.GateHeader method it gives the trailer
+// after the body is read. Wait for the head with Stream.Response and read the
+// response body from the Stream, Close it when done.
+func (s *Server) Send(request *pproto.GateRequest, body io.Reader) (*Stream, error) {
+	conn := s.conn(request.Name)
+	if conn == nil {
 		return nil, fmt.Errorf("service %s not found", request.Name)
 	}
-	b, err := proto.Marshal(&pproto.Packet{
+	if body == nil && len(request.Body) > 0 {
+		body = &inlineBody{Reader: bytes.NewReader(request.Body), trailer: request.Trailer}
+		request.Body = nil
+	}
+	if body != nil {
+		if conn.window > 0 {
+			request.Stream = true
+			request.Trailer = pproto.TrailerKeys(trailerOf(body))
+		} else {
+			b, err := pproto.ReadBody(body, int64(inlineSize(s.frameLimit())))
+			if err != nil {
+				return nil, err
+			}
+			request.Body, request.Trailer = b, trailerOf(body)
+			body = nil
+			if conn.mux.has(CapCompression) && compressible(request.Header) {
+				request.Body, request.BodyEncoding = compress(request.Body)
+			}
+		}
+	}
+	if conn.mux.has(CapStreaming) {
+		request.Window = conn.mux.window
+	}
+	st := conn.mux.open(request.Id, request.Priority, conn.window, request.Stream, true)
+	st.compressFor(request.Header)
+	err := conn.mux.send(&pproto.Packet{
 		Requests: request,
 	})
 	if err != nil {
+		st.Close()
 		return nil, err
 	}
-	_, err = conn.Write(bit_utils.AddSize(b))
-	if err != nil {
-		return nil, err
+	conn.log.Debug().Uint64("id", request.Id).Str("request-id", request.RequestId).Msg("send request")
+	if request.Stream {
+		go func() {
+			_, err := io.Copy(st, body)
+			if err != nil {
+				// a cut body must not look complete to the client
+				conn.log.Debug().Err(err).Uint64("id", request.Id).Str("request-id", request.RequestId).Msg("fail to send request body")
+				st.Close()
+				return
+			}
+			st.CloseWriteTrailer(trailerOf(body))
+		}()
 	}
-	conn.log.Debug().Uint64("id", request.Id).Msg("send request")
-	conn.lock.Lock()
-	defer conn.lock.Unlock()
-	conn.requests[request.Id] = make(chan *pproto.GateResponse)
-	return conn.requests[request.Id], nil
+	return st, nil
+}
+
+type inlineBody struct {
+	io.Reader
+	trailer []*pproto.GateHeader
+}
+
+func (b *inlineBody) Trailer() []*pproto.GateHeader { return b.trailer }
+
+func trailerOf(body io.Reader) []*pproto.GateHeader {
+	if t, ok := body.(interface{ Trailer() []*pproto.GateHeader }); ok {
+		return t.Trailer()
+	}
+	return nil
 }
 
 func NewServer(bindAddress string, key string) error {
+	DefaultServer.Key = key
+	return DefaultServer.ListenAndServe(bindAddress)
+}
+
+// ListenAndServe listens on the tcp address and serves clients until Close
+func (s *Server) ListenAndServe(bindAddress string) error {
 	l, err := net.Listen("tcp", bindAddress)
 	if err != nil {
 		return err
 	}
-	log.Info().Str("address", bindAddress).Msg("start tcp-server")
-	listener(l, key)
-	return nil
+	s.Logger().Info().Str("address", bindAddress).Msg("start tcp-server")
+	return s.Serve(l)
 }
 
-func listener(l net.Listener, key string) {
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("tcp: server closed")
+
+// Serve accepts client connections on l until it fails or the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]struct{}{}
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, l)
+		s.lock.Unlock()
+	}()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			log.Error().Err(err).Msg("error accepting connection")
-			break
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			s.Logger().Error().Err(err).Msg("error accepting connection")
+			return err
 		}
-		log.Debug().Str("remote-addr", conn.RemoteAddr().String()).Msg("new connection")
-		gc := &GateConn{
-			Conn:     conn,
-			lock:     sync.Mutex{},
-			requests: map[uint64]chan *pproto.GateResponse{},
+		s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves one client connection, net.Pipe ends work too
+func (s *Server) ServeConn(conn net.Conn) {
+	s.Logger().Debug().Str("remote-addr", conn.RemoteAddr().String()).Msg("new connection")
+	gc := &GateConn{
+		Conn:   conn,
+		server: s,
+		mux:    newMux(conn, defaultWindow),
+		served: map[string]*pproto.GateAccess{},
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	if s.conns == nil {
+		s.conns = map[*GateConn]struct{}{}
+	}
+	s.conns[gc] = struct{}{}
+	s.lock.Unlock()
+	go func() {
+		connection(gc, s.Key)
+		s.lock.Lock()
+		delete(s.conns, gc)
+		s.lock.Unlock()
+	}()
+}
+
+// Close stops the listeners and drops every client connection
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.services = nil
+	var conns []*GateConn
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
 		}
-		go connection(gc, key)
 	}
+	s.lock.Unlock()
+	for _, c := range conns {
+		c.mux.close()
+	}
+	return err
 }
 
 func connection(conn *GateConn, key string) {
-	defer conn.Close()
-	conn.log = log.With().Str("remote-addr", conn.RemoteAddr().String()).Logger()
-	err := conn.SetReadDeadline(time.Now().Add(connectionTTL))
+	defer conn.mux.close()
+	defer conn.unregisterAll()
+	s := conn.server
+	conn.log = s.Logger().With().Str("remote-addr", conn.RemoteAddr().String()).Logger()
+	err := conn.SetReadDeadline(time.Now().Add(s.ttl()))
 	if err != nil {
 		conn.log.Error().Err(err).Msg("set timeout error")
 		return
@@ -106,14 +360,14 @@ func connection(conn *GateConn, key string) {
 			err = proto.Unmarshal(data, &p)
 			if err != nil {
 				conn.log.Error().Err(err).Msg("fail to unmarshal")
-				conn.Close()
+				conn.mux.close()
 				return
 			}
 
-			go process(&p, conn, key)
+			process(&p, conn, key)
 		}
 	}()
-	err = readerTL(conn, dataChannel)
+	err = readFrames(conn, dataChannel, s.ttl(), s.frameLimit, conn.log)
 	if err != nil {
 		conn.log.Error().Err(err).Msg("read error")
 	}
@@ -121,48 +375,197 @@ func connection(conn *GateConn, key string) {
 
 func process(p *pproto.Packet, conn *GateConn, key string) {
 	switch {
-	case p.Handshake != nil && conn.name == "":
+	case p.Handshake != nil && !conn.ready:
 		if key != "" && p.Handshake.Key != key {
 			conn.log.Error().Msg("unauthorized")
-			conn.Close()
+			conn.reject(p.Handshake, "unauthorized")
 			return
 		}
+		conn.version = minVersion(p.Handshake.Version, ProtocolVersion)
+		conn.mux.caps = p.Handshake.Capabilities & capabilities
+		list := []*pproto.GateService{{Name: p.Handshake.Service, Access: p.Handshake.Access}}
+		if conn.mux.has(CapMultiService) {
+			list = append(list, p.Handshake.Services...)
+		}
+		for _, s := range list {
+			if err := validService(s); err != nil {
+				conn.log.Error().Err(err).Str("service", s.Name).Msg("bad service")
+				conn.reject(p.Handshake, err.Error())
+				return
+			}
+		}
 		conn.name = p.Handshake.Service
+		conn.ready = true
+		if conn.mux.has(CapStreaming) {
+			conn.window = p.Handshake.Window
+		}
 		conn.log = conn.log.With().Str("service", conn.name).Logger()
-		conn.log.Info().Msg("handshake")
-		servicesLock.Lock()
-		defer servicesLock.Unlock()
-		old, ok := services[conn.name]
-		if ok {
-			old.Close()
-		}
-		services[conn.name] = conn
+		conn.log.Info().Uint32("version", conn.version).Uint64("capabilities", conn.mux.caps).Int("services", len(list)).Msg("handshake")
+		if p.Handshake.Version > 0 {
+			err := conn.mux.send(&pproto.Packet{
+				HandshakeAck: &pproto.GateHandshakeAck{
+					Version:      conn.version,
+					Capabilities: conn.mux.caps,
+				},
+			})
+			if err != nil {
+				conn.mux.close()
+				return
+			}
+		}
+		conn.register(list)
 		break
-	case p.Responses != nil && conn.name != "":
-		id := p.Responses.Id
-		conn.lock.Lock()
-		defer conn.lock.Unlock()
-		ch, ok := conn.requests[id]
-		if !ok {
-			conn.log.Warn().Msg("request not found")
+	case p.Register != nil && conn.ready && conn.mux.has(CapMultiService):
+		var list []*pproto.GateService
+		for _, s := range p.Register.Add {
+			if err := validService(s); err != nil {
+				conn.log.Error().Err(err).Str("add", s.Name).Msg("bad service")
+				continue
+			}
+			list = append(list, s)
+		}
+		conn.unregister(p.Register.Remove)
+		conn.register(list)
+		break
+	case p.Responses != nil && conn.ready:
+		body, err := decompress(p.Responses.Body, p.Responses.BodyEncoding, conn.server.frameLimit())
+		if err != nil {
+			conn.log.Error().Err(err).Uint64("id", p.Responses.Id).Msg("protocol error")
+			conn.mux.close()
 			return
 		}
-		ch <- p.Responses
+		p.Responses.Body, p.Responses.BodyEncoding = body, pproto.GateEncoding_ENCODING_NONE
+		if !conn.mux.response(p.Responses) {
+			conn.log.Warn().Uint64("id", p.Responses.Id).Msg("request not found")
+		}
+		break
+	case p.Data != nil && conn.ready:
+		err := conn.mux.deliver(p.Data)
+		if err != nil {
+			conn.log.Error().Err(err).Uint64("id", p.Data.Id).Msg("protocol error")
+			conn.mux.close()
+		}
+		break
+	case p.Window != nil && conn.ready:
+		conn.mux.grant(p.Window)
+		break
+	case p.Cancel != nil && conn.ready:
+		conn.mux.cancelStream(p.Cancel)
 		break
 	case p.Ping != nil:
-		b, err := proto.Marshal(&pproto.Packet{
+		conn.log.Debug().Int64("ping", p.Ping.Time).Msg("ping")
+		err := conn.mux.send(&pproto.Packet{
 			Pong: p.Ping,
 		})
-		log.Debug().Int64("ping", p.Ping.Time).Msg("ping")
 		if err != nil {
-			conn.Close()
+			conn.mux.close()
 		}
-		conn.Write(bit_utils.AddSize(b))
 		break
 	}
 }
 
+func validService(s *pproto.GateService) error {
+	if s.Name == "" {
+		return errors.New("empty service name")
+	}
+	if s.Access != nil {
+		if err := s.Access.Validate(); err != nil {
+			return fmt.Errorf("bad access: %w", err)
+		}
+	}
+	return nil
+}
+
+// register makes the connection serve the services, a service moves here
+// from the connection it was on, which is closed if it has nothing left to serve
+func (conn *GateConn) register(list []*pproto.GateService) {
+	s := conn.server
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.services == nil {
+		s.services = map[string]*GateConn{}
+	}
+	for _, svc := range list {
+		ev := Event{Type: EventConnected, Service: svc.Name, RemoteAddr: conn.RemoteAddr().String()}
+		if old, ok := s.services[svc.Name]; ok && old != conn {
+			delete(old.served, svc.Name)
+			if len(old.served) == 0 {
+				old.mux.close()
+			}
+			ev.Type, ev.Reason = EventReplaced, "was served by "+old.RemoteAddr().String()
+		}
+		s.services[svc.Name] = conn
+		_, again := conn.served[svc.Name]
+		conn.served[svc.Name] = svc.Access
+		conn.log.Info().Str("add", svc.Name).Msg("service registered")
+		if !again {
+			s.Events.Publish(ev)
+		}
+	}
+}
+
+func (conn *GateConn) unregisterAll() {
+	conn.server.lock.Lock()
+	var names []string
+	for name := range conn.served {
+		names = append(names, name)
+	}
+	conn.server.lock.Unlock()
+	conn.unregister(names)
+}
+
+// unregister removes the services from the connection
+func (conn *GateConn) unregister(names []string) {
+	s := conn.server
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, name := range names {
+		if _, ok := conn.served[name]; !ok {
+			continue
+		}
+		delete(conn.served, name)
+		if s.services[name] == conn {
+			delete(s.services, name)
+		}
+		conn.log.Info().Str("remove", name).Msg("service unregistered")
+		s.Events.Publish(Event{Type: EventDisconnected, Service: name, RemoteAddr: conn.RemoteAddr().String()})
+	}
+}
+
+// reject answers the handshake with an error if the client understands it
+// and closes the connection
+func (conn *GateConn) reject(handshake *pproto.GateHandshake, reason string) {
+	conn.server.Events.Publish(Event{
+		Type:       EventRejected,
+		Service:    handshake.Service,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Reason:     reason,
+	})
+	if handshake.Version == 0 {
+		conn.mux.close()
+		return
+	}
+	err := conn.mux.send(&pproto.Packet{
+		HandshakeAck: &pproto.GateHandshakeAck{
+			Version: minVersion(handshake.Version, ProtocolVersion),
+			Error:   reason,
+		},
+	})
+	if err != nil {
+		conn.mux.close()
+		return
+	}
+	conn.mux.flushAndClose()
+}
+
 func readerTL(conn net.Conn, dataChannel chan []byte) error {
+	return readFrames(conn, dataChannel, connectionTTL, frameLimit, log.Logger)
+}
+
+// readFrames sends packets read from conn to dataChannel until the connection fails,
+// frames over limit() fail it, it is read per frame as the config may change
+func readFrames(conn net.Conn, dataChannel chan []byte, ttl time.Duration, limit func() int, log zerolog.Logger) error {
+	defer close(dataChannel)
 	defer conn.Close()
 	buf := make([]byte, 4096)
 	var data []byte
@@ -177,12 +580,16 @@ func readerTL(conn net.Conn, dataChannel chan []byte) error {
 			log.Error().Err(err).Msg("connection closed")
 			return errors.New("connection closed")
 		}
-		_ = conn.SetReadDeadline(time.Now().Add(connectionTTL))
+		_ = conn.SetReadDeadline(time.Now().Add(ttl))
 		data = append(data, buf[:i]...)
 		for { // Нужен если получили 2-ва пакета вместе
 			ld := len(data)
 			if ld >= 4 {
 				l4 := bit_utils.GetUInt32FromBytes(data[:4])
+				if max := limit(); uint64(l4) > uint64(max) {
+					log.Error().Uint32("size", l4).Int("max", max).Msg("protocol error")
+					return ErrFrameTooLarge
+				}
 				if uint32(ld) >= l4+4 {
 					dataChannel <- data[4 : l4+4]
 					data = data[l4+4:]
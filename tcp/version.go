@@ -0,0 +1,27 @@
+package tcp
+
+import (
+	pproto "github.com/axgrid/axgate/proto"
+)
+
+// ProtocolVersion is the gate protocol spoken by this package,
+// 0 is the protocol of clients made before the handshake negotiation.
+const ProtocolVersion = 1
+
+// Capability bits exchanged in the handshake, see GateCapability in gate.proto
+const (
+	CapStreaming    = uint64(pproto.GateCapability_CAP_STREAMING)
+	CapCompression  = uint64(pproto.GateCapability_CAP_COMPRESSION)
+	CapCancel       = uint64(pproto.GateCapability_CAP_CANCEL)
+	CapMultiService = uint64(pproto.GateCapability_CAP_MULTI_SERVICE)
+)
+
+// capabilities implemented by this side of the protocol
+var capabilities = CapStreaming | CapCompression | CapCancel | CapMultiService
+
+func minVersion(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,109 @@
+// Package tracing continues W3C trace context (traceparent, tracestate) through
+// the gate and the client and exports their spans to an OTLP/HTTP collector
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	traceparentHeader = "Traceparent"
+	tracestateHeader  = "Tracestate"
+)
+
+// SpanContext is the part of a span which goes to other processes
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+	State   string // tracestate, passed on as is
+}
+
+// IsValid tells if the context has both ids
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// Traceparent is the header value, version 00
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", c.TraceID, c.SpanID, flags)
+}
+
+// ParseTraceparent reads the header value, ok is false if it is not a valid one
+func ParseTraceparent(s string) (c SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return c, false
+	}
+	// version 00 has exactly four fields, later versions may add some
+	if parts[0] == "00" && len(parts) != 4 {
+		return c, false
+	}
+	var flags [1]byte
+	if !decodeHex(c.TraceID[:], parts[1]) || !decodeHex(c.SpanID[:], parts[2]) || !decodeHex(flags[:], parts[3]) {
+		return c, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c, c.IsValid()
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// FromHeader reads the context of the headers, it is not valid if there is none
+func FromHeader(h http.Header) SpanContext {
+	c, ok := ParseTraceparent(h.Get(traceparentHeader))
+	if !ok {
+		return SpanContext{}
+	}
+	c.State = h.Get(tracestateHeader)
+	return c
+}
+
+// Inject sets the headers to the context
+func (c SpanContext) Inject(h http.Header) {
+	h.Set(traceparentHeader, c.Traceparent())
+	if c.State != "" {
+		h.Set(tracestateHeader, c.State)
+	} else {
+		h.Del(tracestateHeader)
+	}
+}
+
+// child is a context of a new span under c, a new trace if c is not valid
+func (c SpanContext) child() SpanContext {
+	res := SpanContext{TraceID: c.TraceID, Sampled: c.Sampled, State: c.State}
+	if !c.IsValid() {
+		rand.Read(res.TraceID[:])
+		res.Sampled = true
+	}
+	rand.Read(res.SpanID[:])
+	return res
+}
+
+type spanKey struct{}
+
+// WithSpan returns a context carrying the span
+func WithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFrom returns the span of the context, nil if there is none
+func SpanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
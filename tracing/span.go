@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"sync"
+	"time"
+)
+
+// Kind of a span as in OTLP
+type Kind int
+
+const (
+	Internal Kind = 1
+	Server   Kind = 2 // handles a request from a remote caller
+	Client   Kind = 3 // sends a request to a remote service
+)
+
+// Span is a timed operation of a trace, methods of a nil span do nothing
+type Span struct {
+	tracer *Tracer
+	Name   string
+	Kind   Kind
+	// Context is of this span, pass it on to make children in other processes
+	Context SpanContext
+	Parent  [8]byte // zero for a root span
+	Start   time.Time
+	End     time.Time
+
+	lock  sync.Mutex
+	attrs map[string]interface{}
+	err   string
+	ended bool
+}
+
+// Child starts a span under s, nil if s is nil
+func (s *Span) Child(name string, kind Kind) *Span {
+	return s.ChildAt(name, kind, time.Now())
+}
+
+// ChildAt starts a span under s at a time in the past
+func (s *Span) ChildAt(name string, kind Kind, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.StartAt(name, kind, s.Context, start)
+}
+
+// SetAttr sets an attribute, values are strings, ints, floats or bools
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.attrs == nil {
+		s.attrs = map[string]interface{}{}
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = message
+}
+
+// Finish ends the span now and sends it to the exporter
+func (s *Span) Finish() {
+	s.FinishAt(time.Now())
+}
+
+// FinishAt ends the span at t, only the first call counts
+func (s *Span) FinishAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended, s.End = true, t
+	s.lock.Unlock()
+	if s.Context.Sampled {
+		s.tracer.export(s)
+	}
+}
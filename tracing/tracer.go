@@ -0,0 +1,248 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	queueSize     = 2048 // spans waiting for export, the rest is dropped
+	batchSize     = 256
+	flushInterval = time.Second
+	exportClient  = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Config of the span export
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces url of the collector, http://localhost:4318/v1/traces
+	Endpoint string `yaml:"endpoint"`
+	// Service is the service.name of the spans
+	Service string `yaml:"service"`
+	// Headers are sent with every export (api keys of the collector)
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Tracer starts spans and exports the finished ones in batches,
+// a nil tracer starts nil spans
+type Tracer struct {
+	config Config
+	queue  chan *Span
+	done   chan struct{}
+
+	lock   sync.RWMutex
+	closed bool
+}
+
+// New starts the exporter of the config, Close the tracer to flush it
+func New(c *Config) (*Tracer, error) {
+	if c.Endpoint == "" {
+		return nil, errors.New("tracing: no endpoint")
+	}
+	t := &Tracer{config: *c, queue: make(chan *Span, queueSize), done: make(chan struct{})}
+	if t.config.Service == "" {
+		t.config.Service = "axgate"
+	}
+	go t.run()
+	return t, nil
+}
+
+// Start starts a span under parent, a new trace if parent is not valid
+func (t *Tracer) Start(name string, kind Kind, parent SpanContext) *Span {
+	return t.StartAt(name, kind, parent, time.Now())
+}
+
+// StartAt starts a span at a time in the past
+func (t *Tracer) StartAt(name string, kind Kind, parent SpanContext, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, Name: name, Kind: kind, Context: parent.child(), Start: start}
+	if parent.IsValid() {
+		s.Parent = parent.SpanID
+	}
+	return s
+}
+
+func (t *Tracer) export(s *Span) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+// Close exports the spans left, spans finished after it are dropped
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.lock.Unlock()
+	<-t.done
+	return nil
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				t.send(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.send(batch)
+		batch = nil
+	}
+}
+
+func (t *Tracer) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.otlp(batch))
+	if err != nil {
+		return
+	}
+	rq, err := http.NewRequest("POST", t.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Error().Err(err).Msg("fail to export spans")
+		return
+	}
+	rq.Header.Set("Content-Type", "application/json")
+	for k, v := range t.config.Headers {
+		rq.Header.Set(k, v)
+	}
+	resp, err := exportClient.Do(rq)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("collector answered %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Int("spans", len(batch)).Msg("fail to export spans")
+	}
+}
+
+// otlp types are the json encoding of ExportTraceServiceRequest
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		TraceState   string     `json:"traceState,omitempty"`
+		Name         string     `json:"name"`
+		Kind         Kind       `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       otlpStatus `json:"status"`
+	}
+	otlpAttr struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 2 - error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (t *Tracer) otlp(batch []*Span) *otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.lock.Lock()
+		o := otlpSpan{
+			TraceID:    hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:     hex.EncodeToString(s.Context.SpanID[:]),
+			TraceState: s.Context.State,
+			Name:       s.Name,
+			Kind:       s.Kind,
+			Start:      strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes: attrs(s.attrs),
+		}
+		if s.Parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.lock.Unlock()
+		spans = append(spans, o)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: attrs(map[string]interface{}{"service.name": t.config.Service})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "axgate"}, Spans: spans}},
+	}}}
+}
+
+func attrs(m map[string]interface{}) []otlpAttr {
+	var res []otlpAttr
+	for k, v := range m {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int32:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		res = append(res, otlpAttr{Key: k, Value: value})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
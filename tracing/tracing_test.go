@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	c, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	assert.True(t, c.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", c.Traceparent())
+
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(bad)
+		assert.False(t, ok, bad)
+	}
+	// later versions may have more fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assert.True(t, ok)
+}
+
+func TestHeaderPropagation(t *testing.T) {
+	in := http.Header{}
+	in.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	in.Set("tracestate", "vendor=x")
+	parent := FromHeader(in)
+	require.True(t, parent.IsValid())
+
+	c := parent.child()
+	assert.Equal(t, parent.TraceID, c.TraceID)
+	assert.NotEqual(t, parent.SpanID, c.SpanID)
+	assert.False(t, c.Sampled)
+	out := http.Header{}
+	c.Inject(out)
+	assert.Equal(t, c, FromHeader(out))
+	assert.Equal(t, "vendor=x", out.Get("tracestate"))
+
+	root := SpanContext{}.child()
+	assert.True(t, root.IsValid())
+	assert.True(t, root.Sampled)
+}
+
+func TestExport(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "k3y", r.Header.Get("X-Api-Key"))
+		b, _ := io.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer collector.Close()
+	tracer, err := New(&Config{Endpoint: collector.URL, Service: "gate", Headers: map[string]string{"X-Api-Key": "k3y"}})
+	require.NoError(t, err)
+
+	root := tracer.Start("root", Server, SpanContext{})
+	child := root.Child("child", Client)
+	child.SetAttr("n", 5)
+	child.SetError("failed")
+	child.Finish()
+	root.Finish()
+	root.Finish()
+	// not sampled spans are not exported
+	tracer.Start("skipped", Server, SpanContext{TraceID: root.Context.TraceID, SpanID: root.Context.SpanID}).Finish()
+	require.NoError(t, tracer.Close())
+	tracer.Start("late", Server, SpanContext{}).Finish()
+
+	var rq otlpRequest
+	require.NoError(t, json.Unmarshal(<-bodies, &rq))
+	require.Len(t, rq.ResourceSpans, 1)
+	assert.Equal(t, "gate", rq.ResourceSpans[0].Resource.Attributes[0].Value["stringValue"])
+	spans := rq.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, 2, spans[0].Status.Code)
+	assert.Equal(t, "5", spans[0].Attributes[0].Value["intValue"])
+	assert.Empty(t, spans[1].ParentSpanID)
+	assert.Len(t, bodies, 0)
+
+	var none *Tracer
+	assert.Nil(t, none.Start("x", Server, SpanContext{}))
+	none.Start("x", Server, SpanContext{}).Finish()
+}
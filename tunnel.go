@@ -0,0 +1,52 @@
+package axgate
+
+import (
+	"context"
+	"errors"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/tcp"
+	"io"
+	"net"
+	"net/http"
+)
+
+var errNotStreaming = errors.New("tcp tunnel needs a gate with streams")
+
+// NewTCPClient tunnels a tcp server: every request to the service is one
+// connection to address, the request body goes to it and what it sends back
+// is the response body. Callers stream both, like `axgate connect` does.
+func NewTCPClient(name string, gateAddress string, address string, args ...string) error {
+	return tcp.NewStreamClient(name, gateAddress, tcpExchange(address), args...)
+}
+
+func tcpExchange(address string) exchangeHandler {
+	return func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		if !ex.Streaming() {
+			return errNotStreaming
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ex.Context(), "tcp", address)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		stop := context.AfterFunc(ex.Context(), func() { conn.Close() })
+		defer stop()
+		err = ex.WriteHead(&pproto.GateResponse{
+			StatusCode:    http.StatusOK,
+			ContentLength: -1,
+			Header:        []*pproto.GateHeader{{Key: "Content-Type", Values: []string{"application/octet-stream"}}},
+		})
+		if err != nil {
+			return err
+		}
+		go func() {
+			io.Copy(conn, ex)
+			if c, ok := conn.(*net.TCPConn); ok {
+				c.CloseWrite()
+			}
+		}()
+		_, err = io.Copy(ex, conn)
+		return err
+	}
+}
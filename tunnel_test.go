@@ -0,0 +1,66 @@
+package axgate
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// upperServer answers every line in upper case
+func upperServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				lines := bufio.NewScanner(conn)
+				for lines.Scan() {
+					io.WriteString(conn, strings.ToUpper(lines.Text())+"\n")
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTCPClient(t *testing.T) {
+	tcpAddress, httpAddress := startGate(t)
+	go NewTCPClient("upper", tcpAddress, upperServer(t))
+	eventually(t, httpAddress, "upper")
+
+	pr, pw := io.Pipe()
+	rq, err := http.NewRequest("POST", "http://"+httpAddress+"/", pr)
+	require.NoError(t, err)
+	rq.Host = "upper.gate.test"
+	go io.WriteString(pw, "hello\n")
+	resp, err := http.DefaultTransport.RoundTrip(rq)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// lines go back and forth over one request
+	lines := bufio.NewReader(resp.Body)
+	line, err := lines.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO\n", line)
+	go io.WriteString(pw, "world\n")
+	line, err = lines.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "WORLD\n", line)
+
+	pw.Close()
+	rest, err := io.ReadAll(lines)
+	assert.NoError(t, err)
+	assert.Empty(t, rest)
+}
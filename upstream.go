@@ -0,0 +1,145 @@
+package axgate
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	pproto "github.com/axgrid/axgate/proto"
+	"github.com/axgrid/axgate/rewrite"
+	"github.com/axgrid/axgate/tcp"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Upstream is where NewUpstreamClient sends requests of the service and how
+type Upstream struct {
+	// Address is http://, https://, h2c:// (HTTP/2 without TLS) or unix:///path/to.sock
+	Address string `yaml:"address"`
+	// PreserveHost sends the Host the caller asked the gate for (<service>.<host>)
+	PreserveHost bool `yaml:"preserve_host"`
+	// Host is sent instead of the one of Address, virtual hosts upstream need it
+	Host string `yaml:"host"`
+	// ServerName overrides TLS SNI and the name the certificate is checked against
+	ServerName string `yaml:"server_name"`
+	// CAFile has PEM certificates trusted besides the system ones
+	CAFile string `yaml:"ca_file"`
+	// InsecureSkipVerify accepts any certificate, only for self-signed dev servers
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// Socket is a unix socket dialed instead of the Address host
+	Socket string `yaml:"socket"`
+}
+
+// client returns the http client for the upstream and the base of request urls
+func (u *Upstream) client() (*http.Client, string, error) {
+	address, socket, base := u.Address, u.Socket, tr
+	switch {
+	case strings.HasPrefix(address, "h2c://"):
+		base = h2cTr
+		address = "http://" + strings.TrimPrefix(address, "h2c://")
+	case strings.HasPrefix(address, "unix://"):
+		socket = strings.TrimPrefix(address, "unix://")
+		address = "http://localhost"
+	}
+	address = strings.TrimSuffix(address, "/")
+	if socket == "" && u.ServerName == "" && u.CAFile == "" && !u.InsecureSkipVerify {
+		return &http.Client{Transport: base}, address, nil
+	}
+	t := base.Clone()
+	if u.ServerName != "" || u.CAFile != "" || u.InsecureSkipVerify {
+		t.TLSClientConfig = &tls.Config{
+			ServerName:         u.ServerName,
+			InsecureSkipVerify: u.InsecureSkipVerify,
+		}
+		if u.CAFile != "" {
+			pem, err := os.ReadFile(u.CAFile)
+			if err != nil {
+				return nil, "", err
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, "", fmt.Errorf("no certificates in %s", u.CAFile)
+			}
+			t.TLSClientConfig.RootCAs = pool
+		}
+	}
+	if socket != "" {
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+	return &http.Client{Transport: t}, address, nil
+}
+
+// NewUpstreamClient tunnels requests of the service to the upstream
+func NewUpstreamClient(name string, gateAddress string, upstream *Upstream, args ...string) error {
+	if upstream == nil {
+		return errors.New("upstream is nil")
+	}
+	h, err := upstream.exchange(name, nil)
+	if err != nil {
+		return err
+	}
+	return tcp.NewStreamClient(name, gateAddress, h, args...)
+}
+
+// exchange serves requests of the service by the upstream,
+// rules are applied to them, nil - the ones set by SetRules
+func (u *Upstream) exchange(name string, rules *rewrite.Rules) (exchangeHandler, error) {
+	client, requestAddress, err := u.client()
+	if err != nil {
+		return nil, err
+	}
+	return func(request *pproto.GateRequest, ex *tcp.Exchange) error {
+		trailer := http.Header{}
+		for _, h := range request.Trailer {
+			trailer[http.CanonicalHeaderKey(h.Key)] = h.Values
+		}
+		httpRequest, err := http.NewRequestWithContext(ex.Context(), request.Method, fmt.Sprintf("%s%s", requestAddress, request.Url), upstreamBody(request, ex, trailer))
+		if err != nil {
+			return err
+		}
+		httpRequest.Header = pproto.FromGateHeader(request.Header)
+		switch {
+		case u.PreserveHost:
+			httpRequest.Host = request.Host
+		case u.Host != "":
+			httpRequest.Host = u.Host
+		}
+		r := rules
+		if r == nil {
+			r = rulesOf(name)
+		}
+		r.RewriteRequest(httpRequest)
+		if request.Stream {
+			httpRequest.ContentLength = request.ContentLength
+		}
+		if len(trailer) > 0 {
+			httpRequest.Trailer = trailer
+			httpRequest.ContentLength = -1 // trailers go only with chunked body
+		}
+		httpResponse, err := client.Do(httpRequest)
+		if err != nil {
+			return err
+		}
+		defer httpResponse.Body.Close()
+		r.RewriteResponse(httpResponse.Header)
+		err = ex.WriteHead(pproto.NewGateResponseHead(httpResponse))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ex, httpResponse.Body)
+		if err != nil {
+			return err
+		}
+		return ex.Finish(pproto.ToGateHeader(httpResponse.Trailer))
+	}, nil
+}
@@ -0,0 +1,96 @@
+package axgate
+
+import (
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var echoHost = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, r.Host)
+})
+
+// eventually gets / of the service through the gate until it answers 200
+func eventually(t *testing.T, httpAddress string, service string) string {
+	var body string
+	require.Eventually(t, func() bool {
+		rq, _ := http.NewRequest("GET", "http://"+httpAddress+"/", nil)
+		rq.Host = service + ".gate.test"
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body = string(b)
+		return resp.StatusCode == 200
+	}, 5*time.Second, 50*time.Millisecond)
+	return body
+}
+
+func TestUpstreamHost(t *testing.T) {
+	srv := httptest.NewServer(echoHost)
+	defer srv.Close()
+	tcpAddress, httpAddress := startGate(t)
+	go NewHTTPClient("host-default", tcpAddress, srv.URL)
+	go NewUpstreamClient("host-preserve", tcpAddress, &Upstream{Address: srv.URL, PreserveHost: true})
+	go NewUpstreamClient("host-custom", tcpAddress, &Upstream{Address: srv.URL, Host: "app.local"})
+
+	assert.Equal(t, srv.Listener.Addr().String(), eventually(t, httpAddress, "host-default"))
+	assert.Equal(t, "host-preserve.gate.test", eventually(t, httpAddress, "host-preserve"))
+	assert.Equal(t, "app.local", eventually(t, httpAddress, "host-custom"))
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(echoHost)
+	defer srv.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	tcpAddress, httpAddress := startGate(t)
+	go NewUpstreamClient("tls-ca", tcpAddress, &Upstream{Address: srv.URL, CAFile: ca, ServerName: "example.com"})
+	go NewUpstreamClient("tls-insecure", tcpAddress, &Upstream{Address: srv.URL, InsecureSkipVerify: true})
+	go NewHTTPClient("tls-untrusted", tcpAddress, srv.URL)
+
+	assert.Equal(t, srv.Listener.Addr().String(), eventually(t, httpAddress, "tls-ca"))
+	assert.Equal(t, srv.Listener.Addr().String(), eventually(t, httpAddress, "tls-insecure"))
+	require.Eventually(t, func() bool {
+		rq, _ := http.NewRequest("GET", "http://"+httpAddress+"/", nil)
+		rq.Host = "tls-untrusted.gate.test"
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusBadGateway
+	}, 5*time.Second, 50*time.Millisecond)
+
+	err := NewUpstreamClient("tls-bad-ca", tcpAddress, &Upstream{Address: srv.URL, CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+}
+
+func TestUpstreamUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+	}))
+
+	tcpAddress, httpAddress := startGate(t)
+	go NewHTTPClient("unix", tcpAddress, "unix://"+socket)
+	go NewUpstreamClient("unix-host", tcpAddress, &Upstream{Address: "http://docker", Socket: socket})
+
+	assert.Equal(t, "localhost /", eventually(t, httpAddress, "unix"))
+	assert.Equal(t, "docker /", eventually(t, httpAddress, "unix-host"))
+}